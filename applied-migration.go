@@ -2,7 +2,10 @@ package pgxschema
 
 import (
 	"fmt"
+	"strings"
 	"time"
+
+	"github.com/jackc/pgx/v4"
 )
 
 // AppliedMigration represents a successfully-executed migration. It embeds
@@ -14,6 +17,10 @@ type AppliedMigration struct {
 	// Checksum is the MD5 hash of the Script for this migration
 	Checksum string
 
+	// ChecksumAlgorithm is the name of the algorithm which produced Checksum.
+	// Rows recorded before this was tracked are assumed to be "md5".
+	ChecksumAlgorithm string
+
 	// ExecutionTimeInMillis is populated after the migration is run, indicating
 	// how much time elapsed while the Script was executing.
 	ExecutionTimeInMillis int
@@ -21,21 +28,58 @@ type AppliedMigration struct {
 	// AppliedAt is the time at which this particular migration's Script began
 	// executing (not when it completed executing).
 	AppliedAt time.Time
+
+	// BuildVersion and BuildCommit identify the build of the application which
+	// applied this migration. They are blank unless the Migrator was created
+	// with the WithBuildInfo() option.
+	BuildVersion string
+	BuildCommit  string
+
+	// RolledBackAt is the time at which this migration was marked as rolled
+	// back, or nil if it has not been. Rolled back migrations are treated as
+	// not applied, so Apply will run them again.
+	RolledBackAt *time.Time
+
+	// ChecksumSignature is the signature of Checksum recorded when the
+	// Migrator was created with the WithChecksumSigner() option. It is blank
+	// otherwise.
+	ChecksumSignature string
+
+	// Ordinal is the position of this migration in the order in which
+	// migrations were applied, starting at 1. It is 0 unless the Migrator was
+	// created with the WithOrdinalColumn() option, and for migrations applied
+	// before the option was used.
+	Ordinal int64
+
+	// IDVersion and IDName are the version and name parts of the ID, as
+	// parsed by Migrator.ParseID, for display. They are blank if the ID
+	// doesn't match the Migrator's ID pattern.
+	IDVersion string
+	IDName    string
 }
 
 // GetAppliedMigrations retrieves all already-applied migrations in a map keyed
-// by the migration IDs
+// by the migration IDs. If a migration has been recorded more than once (e.g.
+// because it was rolled back and applied again), the most recent record is
+// returned.
 //
 func (m Migrator) GetAppliedMigrations(db Queryer) (applied map[string]*AppliedMigration, err error) {
 	applied = make(map[string]*AppliedMigration)
 	migrations := make([]*AppliedMigration, 0)
 
-	tn := QuotedTableName(m.schemaName, m.tableName)
-	query := fmt.Sprintf(`
-		SELECT id, checksum, execution_time_in_millis, applied_at
+	err = m.resolveQuoting(db)
+	if err != nil {
+		return applied, err
+	}
+
+	query := m.requoted(m.dialect.SelectSQL(m.schemaName, m.tableName))
+	if len(m.scanColumns) > 0 || len(m.optionalSelectColumns()) > 0 {
+		query = fmt.Sprintf(`
+		SELECT %s
 		FROM %s
-		ORDER BY id ASC
-	`, tn)
+		ORDER BY id ASC, applied_at ASC
+	`, m.selectColumns(), m.QuotedTableName())
+	}
 
 	rows, err := db.Query(m.ctx, query)
 	if err != nil {
@@ -44,12 +88,239 @@ func (m Migrator) GetAppliedMigrations(db Queryer) (applied map[string]*AppliedM
 	defer rows.Close()
 
 	for rows.Next() {
-		migration := AppliedMigration{}
-		err = rows.Scan(&migration.ID, &migration.Checksum, &migration.ExecutionTimeInMillis, &migration.AppliedAt)
-		migrations = append(migrations, &migration)
+		var migration *AppliedMigration
+		migration, err = m.scan(rows)
+		if err != nil {
+			return applied, err
+		}
+		migrations = append(migrations, migration)
 	}
+
 	for _, migration := range migrations {
 		applied[migration.ID] = migration
 	}
+
+	return applied, rows.Err()
+}
+
+// currentlyApplied retrieves the applied migrations like GetAppliedMigrations,
+// but leaves out those which have been marked as rolled back
+func (m Migrator) currentlyApplied(db Queryer) (map[string]*AppliedMigration, error) {
+	applied, err := m.GetAppliedMigrations(db)
+	for id, migration := range applied {
+		if migration.RolledBackAt != nil {
+			delete(applied, id)
+		}
+	}
 	return applied, err
 }
+
+// appliedHistory retrieves the applied migrations in the order in which they
+// were applied. Migrations marked as rolled back are not included.
+//
+func (m Migrator) appliedHistory(db Queryer) (history []*AppliedMigration, err error) {
+	history = make([]*AppliedMigration, 0)
+
+	err = m.resolveQuoting(db)
+	if err != nil {
+		return history, err
+	}
+
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM %s
+		WHERE rolled_back_at IS NULL
+		ORDER BY applied_at ASC, id ASC
+	`, m.selectColumns(), m.QuotedTableName())
+
+	rows, err := db.Query(m.ctx, query)
+	if err != nil {
+		return history, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var migration *AppliedMigration
+		migration, err = m.scan(rows)
+		if err != nil {
+			return history, err
+		}
+		history = append(history, migration)
+	}
+	return history, rows.Err()
+}
+
+// appliedIDs retrieves the IDs of all already-applied migrations from the
+// Migrator's Store. It is a cheaper alternative to GetAppliedMigrations for
+// callers which only need to know which migrations have run. Migrations
+// marked as rolled back are not included.
+//
+func (m Migrator) appliedIDs(db Queryer) (ids map[string]struct{}, err error) {
+	return m.trackingStore().AppliedIDs(m.ctx, db)
+}
+
+// trackedIDs retrieves the IDs of the migrations recorded in the tracking
+// table, for the default Store
+func (m Migrator) trackedIDs(db Queryer) (ids map[string]struct{}, err error) {
+	ids = make(map[string]struct{})
+
+	err = m.resolveQuoting(db)
+	if err != nil {
+		return ids, err
+	}
+
+	tn := m.QuotedTableName()
+	query := fmt.Sprintf(`
+		SELECT DISTINCT id
+		FROM %s
+		WHERE rolled_back_at IS NULL
+	`, tn)
+
+	rows, err := db.Query(m.ctx, query)
+	if err != nil {
+		return ids, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return ids, err
+		}
+		ids[id] = struct{}{}
+	}
+	return ids, rows.Err()
+}
+
+// SlowMigrations retrieves the applied migrations whose recorded execution
+// time exceeded the provided threshold, ordered from slowest to fastest.
+// Migrations which were rolled back are left out. This is useful for
+// surfacing slow DDL which may need to be optimized.
+//
+func (m Migrator) SlowMigrations(db Queryer, threshold time.Duration) (slow []*AppliedMigration, err error) {
+	slow = make([]*AppliedMigration, 0)
+
+	err = m.resolveQuoting(db)
+	if err != nil {
+		return slow, err
+	}
+
+	tn := m.QuotedTableName()
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM %s
+		WHERE execution_time_in_millis > $1 AND rolled_back_at IS NULL
+		ORDER BY execution_time_in_millis DESC, id ASC
+	`, m.selectColumns(), tn)
+
+	rows, err := db.Query(m.ctx, query, threshold.Milliseconds())
+	if err != nil {
+		return slow, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var migration *AppliedMigration
+		migration, err = m.scan(rows)
+		if err != nil {
+			return slow, err
+		}
+		slow = append(slow, migration)
+	}
+	return slow, rows.Err()
+}
+
+// RowScanner is a function which reads the current row of a query against the
+// tracking table into an AppliedMigration. Custom RowScanners can be provided
+// with the WithRowScanner() option to read additional columns.
+type RowScanner func(rows pgx.Rows) (*AppliedMigration, error)
+
+// selectColumns returns the list of columns to select when reading
+// AppliedMigrations from the tracking table
+func (m Migrator) selectColumns() string {
+	if len(m.scanColumns) > 0 {
+		return strings.Join(m.scanColumns, ", ")
+	}
+	return strings.Join(append([]string{AppliedMigrationColumns}, m.optionalSelectColumns()...), ", ")
+}
+
+// optionalSelectColumns returns the expressions which select the columns
+// added to the tracking table by options, following AppliedMigrationColumns
+func (m Migrator) optionalSelectColumns() []string {
+	columns := []string{}
+	if m.ordinalColumn {
+		columns = append(columns, "COALESCE(ordinal, 0)")
+	}
+	if m.checksumSigner != nil {
+		columns = append(columns, "COALESCE(checksum_signature, '')")
+	}
+	return columns
+}
+
+// scan reads the current row into an AppliedMigration with scanRow, and
+// fills in the parts of its ID
+func (m Migrator) scan(rows pgx.Rows) (*AppliedMigration, error) {
+	migration, err := m.scanRow(rows)
+	if err == nil && migration != nil {
+		migration.IDVersion, migration.IDName, _ = m.ParseID(migration.ID)
+	}
+	return migration, err
+}
+
+// scanRow reads the current row into an AppliedMigration with the configured
+// RowScanner, or the default one if none was provided
+func (m Migrator) scanRow(rows pgx.Rows) (*AppliedMigration, error) {
+	if m.rowScanner != nil {
+		return m.rowScanner(rows)
+	}
+	if len(m.scanColumns) > 0 {
+		return scanAppliedMigration(rows)
+	}
+	migration := AppliedMigration{}
+	dest := migration.scanDest()
+	if m.ordinalColumn {
+		dest = append(dest, &migration.Ordinal)
+	}
+	if m.checksumSigner != nil {
+		dest = append(dest, &migration.ChecksumSignature)
+	}
+	err := rows.Scan(dest...)
+	return &migration, err
+}
+
+// AppliedMigrationColumns is the list of tracking table columns which are
+// selected when reading AppliedMigrations. Rows selected with these columns,
+// in this order, can be read with ScanFrom.
+const AppliedMigrationColumns = "id, checksum, execution_time_in_millis, applied_at, checksum_algorithm, version, commit, rolled_back_at"
+
+// ScanFrom reads the current row into the AppliedMigration. The row must have
+// been selected with AppliedMigrationColumns, e.g.
+//
+//	rows, err := db.Query(ctx, "SELECT "+pgxschema.AppliedMigrationColumns+" FROM schema_migrations")
+func (migration *AppliedMigration) ScanFrom(rows pgx.Rows) error {
+	return rows.Scan(migration.scanDest()...)
+}
+
+// scanDest returns the destinations for scanning AppliedMigrationColumns into
+// the AppliedMigration
+func (migration *AppliedMigration) scanDest() []interface{} {
+	return []interface{}{
+		&migration.ID,
+		&migration.Checksum,
+		&migration.ExecutionTimeInMillis,
+		&migration.AppliedAt,
+		&migration.ChecksumAlgorithm,
+		&migration.BuildVersion,
+		&migration.BuildCommit,
+		&migration.RolledBackAt,
+	}
+}
+
+// scanAppliedMigration reads the current row, which must have been selected
+// with AppliedMigrationColumns, into a new AppliedMigration.
+func scanAppliedMigration(rows pgx.Rows) (*AppliedMigration, error) {
+	migration := AppliedMigration{}
+	err := migration.ScanFrom(rows)
+	return &migration, err
+}
@@ -1,9 +1,15 @@
 package pgxschema
 
 import (
+	"context"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/pashagolub/pgxmock"
 )
 
 func TestGetAppliedMigrationsErrorsWhenNoneExist(t *testing.T) {
@@ -19,3 +25,158 @@ func TestGetAppliedMigrationsErrorsWhenNoneExist(t *testing.T) {
 		}
 	})
 }
+
+func TestSlowMigrations(t *testing.T) {
+	withLatestDB(t, func(db *pgxpool.Pool) {
+		migrator := makeTestMigrator()
+		err := migrator.Apply(db, []*Migration{
+			{ID: "2022-01-01 Fast", Script: "SELECT 1"},
+			{ID: "2022-01-02 Slow", Script: "SELECT pg_sleep(0.2)"},
+			{ID: "2022-01-03 Slower", Script: "SELECT pg_sleep(0.3)"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		slow, err := migrator.SlowMigrations(db, 100*time.Millisecond)
+		if err != nil {
+			t.Error(err)
+		}
+		if len(slow) != 2 {
+			t.Fatalf("Expected 2 slow migrations. Got %d", len(slow))
+		}
+		expectID(t, &slow[0].Migration, "2022-01-03 Slower")
+		expectID(t, &slow[1].Migration, "2022-01-02 Slow")
+
+		err = migrator.RemoveApplied(db, "2022-01-03 Slower")
+		if err != nil {
+			t.Fatal(err)
+		}
+		slow, err = migrator.SlowMigrations(db, 100*time.Millisecond)
+		if err != nil {
+			t.Error(err)
+		}
+		if len(slow) != 1 {
+			t.Fatalf("Expected the rolled back migration to be left out. Got %d slow migrations", len(slow))
+		}
+		expectID(t, &slow[0].Migration, "2022-01-02 Slow")
+	})
+}
+
+func TestGetAppliedMigrationsWithRowScanner(t *testing.T) {
+	withLatestDB(t, func(db *pgxpool.Pool) {
+		scanned := make(map[string]string)
+		scanner := func(rows pgx.Rows) (*AppliedMigration, error) {
+			migration := AppliedMigration{}
+			var deployedBy string
+			err := rows.Scan(&migration.ID, &migration.Checksum, &deployedBy)
+			scanned[migration.ID] = deployedBy
+			return &migration, err
+		}
+		migrator := makeTestMigrator()
+		err := migrator.Apply(db, testMigrations(t, "useless-ansi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(context.Background(), fmt.Sprintf(
+			"ALTER TABLE %s ADD COLUMN deployed_by VARCHAR(255) NOT NULL DEFAULT 'ci'",
+			migrator.QuotedTableName(),
+		))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		custom := NewMigrator(
+			WithTableName(migrator.tableName),
+			WithRowScanner(scanner, "id", "checksum", "deployed_by"),
+		)
+		applied, err := custom.GetAppliedMigrations(db)
+		if err != nil {
+			t.Error(err)
+		}
+		if len(applied) != 2 {
+			t.Errorf("Expected 2 applied migrations. Got %d", len(applied))
+		}
+		if scanned["0000-00-00 001 Select 1"] != "ci" {
+			t.Errorf("Expected the custom column to be scanned. Got '%s'", scanned["0000-00-00 001 Select 1"])
+		}
+	})
+}
+
+func TestAppliedMigrationScanFrom(t *testing.T) {
+	withLatestDB(t, func(db *pgxpool.Pool) {
+		migrator := makeTestMigrator()
+		err := migrator.Apply(db, testMigrations(t, "useless-ansi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rows, err := db.Query(context.Background(), fmt.Sprintf(
+			"SELECT %s FROM %s ORDER BY id",
+			AppliedMigrationColumns, migrator.QuotedTableName(),
+		))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+
+		var ids []string
+		for rows.Next() {
+			migration := AppliedMigration{}
+			if err = migration.ScanFrom(rows); err != nil {
+				t.Fatal(err)
+			}
+			if migration.Checksum == "" || migration.AppliedAt.IsZero() {
+				t.Errorf("Expected ScanFrom to populate every field. Got %+v", migration)
+			}
+			ids = append(ids, migration.ID)
+		}
+		if len(ids) != 2 || ids[0] != "0000-00-00 001 Select 1" {
+			t.Errorf("Expected both migrations to be scanned. Got %v", ids)
+		}
+	})
+}
+
+func TestGetAppliedMigrationsWithOrdinalColumn(t *testing.T) {
+	withEachDB(t, func(db *pgxpool.Pool) {
+		migrator := NewMigrator(
+			WithTableName(time.Now().Format(time.RFC3339Nano)),
+			WithOrdinalColumn(),
+		)
+		err := migrator.Apply(db, testMigrations(t, "useless-ansi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		applied, err := migrator.GetAppliedMigrations(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if applied["0000-00-00 001 Select 1"].Ordinal != 1 || applied["0000-00-00 002 Select 2"].Ordinal != 2 {
+			t.Errorf("Expected ordinals 1 and 2. Got %+v", applied)
+		}
+	})
+}
+
+func TestGetAppliedMigrationsParsesIDs(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT id, checksum").WillReturnRows(
+		pgxmock.NewRows(strings.Split(AppliedMigrationColumns, ", ")).
+			AddRow("v0001_create users", "abc", 0, time.Now(), ChecksumAlgorithmMD5, "", "", nil).
+			AddRow("unversioned", "def", 0, time.Now(), ChecksumAlgorithmMD5, "", "", nil),
+	)
+
+	applied, err := NewMigrator().GetAppliedMigrations(mock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := applied["v0001_create users"]; m.IDVersion != "v0001" || m.IDName != "create users" {
+		t.Errorf("Expected the ID to be parsed. Got '%s' and '%s'", m.IDVersion, m.IDName)
+	}
+	if m := applied["unversioned"]; m.IDVersion != "" || m.IDName != "" {
+		t.Errorf("Expected an unparseable ID to leave the parts blank. Got '%s' and '%s'", m.IDVersion, m.IDName)
+	}
+}
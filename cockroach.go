@@ -0,0 +1,56 @@
+package pgxschema
+
+import "fmt"
+
+// CockroachLockTableName is the name of the single-row table which the
+// CockroachDB dialect locks while migrations are running.
+const CockroachLockTableName = "schema_migrations_lock"
+
+// CockroachDB is a Dialect for CockroachDB, which speaks the PostgreSQL wire
+// protocol but does not support session-level advisory locks. Instead, it
+// locks a row in the CockroachLockTableName table (found via the search_path)
+// with SELECT ... FOR UPDATE at the start of the migration transaction.
+// Concurrent migrators block on that row until the transaction ends.
+var CockroachDB = cockroachDialect{}
+
+type cockroachDialect struct {
+	postgresDialect
+}
+
+// LockSQL returns an empty string because CockroachDB's lock is obtained
+// inside the migration transaction by CreateSQL.
+func (c cockroachDialect) LockSQL(schemaName, tableName string) string {
+	return ""
+}
+
+// UnlockSQL returns an empty string because CockroachDB's row lock is
+// released when the migration transaction commits or rolls back.
+func (c cockroachDialect) UnlockSQL(schemaName, tableName string) string {
+	return ""
+}
+
+// CreateSQL generates the statements which create the migrations tracking
+// table and the lock table, and then lock the row in the lock table for the
+// duration of the transaction.
+func (c cockroachDialect) CreateSQL(schemaName, tableName string) string {
+	return c.CreateInTablespaceSQL(schemaName, tableName, "")
+}
+
+// CreateInTablespaceSQL generates the same statements as CreateSQL, creating
+// the tracking table in the provided tablespace (unless it's blank)
+func (c cockroachDialect) CreateInTablespaceSQL(schemaName, tableName, tablespace string) string {
+	return c.postgresDialect.CreateInTablespaceSQL(schemaName, tableName, tablespace) + ";" + c.lockRowSQL()
+}
+
+// lockRowSQL generates the statements which create the lock table and lock
+// its row for the duration of the transaction
+func (c cockroachDialect) lockRowSQL() string {
+	lockTable := QuotedIdent(CockroachLockTableName)
+	return fmt.Sprintf(`
+				CREATE TABLE IF NOT EXISTS %s (
+					id INTEGER NOT NULL PRIMARY KEY
+				);
+				INSERT INTO %s (id) VALUES (1) ON CONFLICT (id) DO NOTHING;
+				SELECT id FROM %s WHERE id = 1 FOR UPDATE
+			`, lockTable, lockTable, lockTable)
+}
@@ -0,0 +1,69 @@
+package pgxschema
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/pashagolub/pgxmock"
+)
+
+func TestCockroachDBSkipsSessionLocks(t *testing.T) {
+	if sql := CockroachDB.LockSQL("", DefaultTableName); sql != "" {
+		t.Errorf("Expected no LockSQL for CockroachDB. Got '%s'", sql)
+	}
+	if sql := CockroachDB.UnlockSQL("", DefaultTableName); sql != "" {
+		t.Errorf("Expected no UnlockSQL for CockroachDB. Got '%s'", sql)
+	}
+}
+
+func TestCockroachDBCreateSQLLocksRow(t *testing.T) {
+	sql := CockroachDB.CreateSQL("", "schema_migrations")
+	if !strings.Contains(sql, `CREATE TABLE IF NOT EXISTS "schema_migrations"`) {
+		t.Errorf("Expected CreateSQL to create the tracking table. Got:\n%s", sql)
+	}
+	if !strings.Contains(sql, `SELECT id FROM "schema_migrations_lock" WHERE id = 1 FOR UPDATE`) {
+		t.Errorf("Expected CreateSQL to lock a row in the lock table. Got:\n%s", sql)
+	}
+}
+
+func TestApplyWithCockroachDBDoesNotUseAdvisoryLocks(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Error(err)
+	}
+	mock.ExpectBegin()
+	mock.ExpectExec("^\\s*CREATE TABLE").WillReturnError(fmt.Errorf("Create Failed"))
+	mock.ExpectRollback()
+	err = NewMigrator(WithDialect(CockroachDB)).Apply(mock, testMigrations(t, "useless-ansi"))
+	expectErrorContains(t, err, "Create Failed")
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestApplyWithBootstrapWithCockroachDB(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Error(err)
+	}
+	migrator := NewMigrator(WithDialect(CockroachDB))
+	err = migrator.ApplyWithBootstrap(mock, testMigrations(t, "useless-ansi"), nil)
+	if !errors.Is(err, ErrBootstrapUnsupported) {
+		t.Errorf("Expected %v, got %v", ErrBootstrapUnsupported, err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCockroachDBSingleVersionModeLocksRow(t *testing.T) {
+	ddl := NewMigrator(WithDialect(CockroachDB), WithSingleVersionMode()).TrackingTableDDL()
+	if !strings.Contains(ddl, "version VARCHAR(255) NOT NULL") {
+		t.Errorf("Expected the single version table to be created. Got:\n%s", ddl)
+	}
+	if !strings.Contains(ddl, `SELECT id FROM "schema_migrations_lock" WHERE id = 1 FOR UPDATE`) {
+		t.Errorf("Expected a row in the lock table to be locked. Got:\n%s", ddl)
+	}
+}
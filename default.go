@@ -0,0 +1,34 @@
+package pgxschema
+
+import "sync"
+
+var (
+	defaultMigratorMutex sync.Mutex
+	defaultMigrator      *Migrator
+)
+
+// SetDefaultOptions replaces the default Migrator used by the package-level
+// functions (such as Apply) with one created from the supplied options.
+func SetDefaultOptions(options ...Option) {
+	defaultMigratorMutex.Lock()
+	defer defaultMigratorMutex.Unlock()
+	defaultMigrator = NewMigrator(options...)
+}
+
+// DefaultMigrator returns the Migrator used by the package-level functions.
+// Unless SetDefaultOptions has been called, it has the default options.
+func DefaultMigrator() *Migrator {
+	defaultMigratorMutex.Lock()
+	defer defaultMigratorMutex.Unlock()
+	if defaultMigrator == nil {
+		defaultMigrator = NewMigrator()
+	}
+	return defaultMigrator
+}
+
+// Apply applies any of the supplied migrations which have not yet been
+// applied, using the default Migrator. It is a shortcut for programs which
+// only need a single Migrator.
+func Apply(db Connection, migrations []*Migration) error {
+	return DefaultMigrator().Apply(db, migrations)
+}
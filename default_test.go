@@ -0,0 +1,48 @@
+package pgxschema
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+func TestDefaultMigrator(t *testing.T) {
+	defer SetDefaultOptions()
+
+	if tn := DefaultMigrator().QuotedTableName(); tn != `"schema_migrations"` {
+		t.Errorf("Expected the default table name. Got %s", tn)
+	}
+
+	SetDefaultOptions(WithTableName("special", "migrations"))
+	if tn := DefaultMigrator().QuotedTableName(); tn != `"special"."migrations"` {
+		t.Errorf("Expected SetDefaultOptions to customize the table name. Got %s", tn)
+	}
+}
+
+func TestApplyWithDefaultMigratorAndNilDB(t *testing.T) {
+	err := Apply(nil, testMigrations(t, "useless-ansi"))
+	if !errors.Is(err, ErrNilDB) {
+		t.Errorf("Expected %v, got %v", ErrNilDB, err)
+	}
+}
+
+func TestApplyWithDefaultMigrator(t *testing.T) {
+	withEachDB(t, func(db *pgxpool.Pool) {
+		migrator := makeTestMigrator()
+		SetDefaultOptions(WithTableName(migrator.tableName))
+		defer SetDefaultOptions()
+
+		err := Apply(db, testMigrations(t, "useless-ansi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		applied, err := migrator.GetAppliedMigrations(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(applied) != 2 {
+			t.Errorf("Expected 2 applied migrations. Got %d", len(applied))
+		}
+	})
+}
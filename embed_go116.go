@@ -6,6 +6,8 @@ package pgxschema
 import (
 	"fmt"
 	"io/fs"
+	"os"
+	"path"
 )
 
 // FSMigrations receives a filesystem (such as an embed.FS) and extracts all
@@ -37,3 +39,39 @@ func FSMigrations(filesystem fs.FS, glob string) (migrations []*Migration, err e
 	}
 	return migrations, nil
 }
+
+// VerifyAgainstFS loads the migrations in the provided directory of a
+// filesystem (such as an embed.FS), as FSMigrations does for "*.sql" files,
+// and runs Validate against them. This makes checking the database for drift
+// a single call, e.g. in CI:
+//
+//     err := migrator.VerifyAgainstFS(db, embeddedFS, "migrations")
+//
+func (m *Migrator) VerifyAgainstFS(db Queryer, fsys fs.FS, dir string) error {
+	migrations, err := FSMigrations(fsys, path.Join(dir, "*.sql"))
+	if err != nil {
+		return err
+	}
+	return m.Validate(db, migrations)
+}
+
+// ApplyFromDir loads the "*.sql" files in a directory on disk, as FSMigrations
+// does, and applies them in the order of their IDs. This is a convenience for
+// CLIs which read their migrations from disk rather than embedding them:
+//
+//     err := migrator.ApplyFromDir(db, "./migrations")
+//
+// Failures to read the migrations wrap ErrLoadingMigrations, so that they can
+// be told apart from failures to apply them with errors.Is.
+//
+func (m *Migrator) ApplyFromDir(db Connection, dir string) error {
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("%w: %s", ErrLoadingMigrations, err)
+	}
+	migrations, err := FSMigrations(os.DirFS(dir), "*.sql")
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrLoadingMigrations, err)
+	}
+	SortMigrations(migrations)
+	return m.Apply(db, migrations)
+}
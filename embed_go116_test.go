@@ -5,9 +5,14 @@ package pgxschema
 
 import (
 	"embed"
+	"errors"
+	"fmt"
 	"io/fs"
 	"testing"
 	"testing/fstest"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/pashagolub/pgxmock"
 )
 
 //go:embed test-migrations
@@ -49,3 +54,78 @@ func TestFSMigrationsWithInvalidFiles(t *testing.T) {
 	_, err := FSMigrations(testfs, "invalid-migrations/*.sql")
 	expectErrorContains(t, err, "fake.sql")
 }
+
+// TestVerifyAgainstFS ensures that migrations applied from a filesystem verify
+// cleanly against it, and that edits made afterwards are reported as drift.
+func TestVerifyAgainstFS(t *testing.T) {
+	withEachDB(t, func(db *pgxpool.Pool) {
+		migrator := makeTestMigrator()
+		err := migrator.Apply(db, testMigrations(t, "useless-ansi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = migrator.VerifyAgainstFS(db, exampleMigrations, "test-migrations/useless-ansi")
+		if err != nil {
+			t.Errorf("Expected no drift. Got %s", err)
+		}
+
+		edited := fstest.MapFS{
+			"migrations/0000-00-00 001 Select 1.sql": {Data: []byte("SELECT 1;")},
+			"migrations/0000-00-00 002 Select 2.sql": {Data: []byte("SELECT 2; -- edited")},
+		}
+		err = migrator.VerifyAgainstFS(db, edited, "migrations")
+		if !errors.Is(err, ErrDrift) {
+			t.Errorf("Expected %v, got %v", ErrDrift, err)
+		}
+		expectErrorContains(t, err, "0000-00-00 002 Select 2")
+	})
+}
+
+func TestVerifyAgainstFSWithInvalidDir(t *testing.T) {
+	err := NewMigrator().VerifyAgainstFS(BadQueryer{}, exampleMigrations, "bad[dir")
+	expectErrorContains(t, err, "bad[dir")
+}
+
+func TestApplyFromDirWithMissingDirectory(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = makeTestMigrator().ApplyFromDir(mock, "test-migrations/does-not-exist")
+	if !errors.Is(err, ErrLoadingMigrations) {
+		t.Errorf("Expected ErrLoadingMigrations. Got %v", err)
+	}
+}
+
+func TestApplyFromDirReportsApplyErrorsDistinctly(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnError(fmt.Errorf("FAIL: lock"))
+	err = makeTestMigrator().ApplyFromDir(mock, "test-migrations/saas")
+	if err == nil || errors.Is(err, ErrLoadingMigrations) {
+		t.Errorf("Expected an error applying the migrations, not loading them. Got %v", err)
+	}
+}
+
+func TestApplyFromDirLoadsSortedMigrations(t *testing.T) {
+	withLatestDB(t, func(db *pgxpool.Pool) {
+		migrator := makeTestMigrator()
+		err := migrator.ApplyFromDir(db, "test-migrations/saas")
+		if err != nil {
+			t.Fatal(err)
+		}
+		applied, err := migrator.GetAppliedMigrations(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(applied) != 2 {
+			t.Errorf("Expected 2 applied migrations. Got %d", len(applied))
+		}
+		if _, ok := applied["2019-01-01 0900 Create Users"]; !ok {
+			t.Error("Expected the Create Users migration to have been applied")
+		}
+	})
+}
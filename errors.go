@@ -5,5 +5,148 @@ import "fmt"
 // ErrNilDB is thrown when the database pointer is nil
 var ErrNilDB = fmt.Errorf("Database connection is nil")
 
-// ErrNilTx is thrown when a command is run against a nil transaction
+// ErrNilTx is thrown when a command is run against a nil transaction. It is
+// wrapped with the name of the tracking table, so check for it with
+// errors.Is.
 var ErrNilTx = fmt.Errorf("Database transaction is nil")
+
+// ErrBlankTableName is returned by NewMigratorE when the tracking table's
+// name is empty after it has been quoted
+var ErrBlankTableName = fmt.Errorf("Table name is blank after quoting")
+
+// ErrBlankSchemaName is returned by NewMigratorE when a schema name was
+// provided, but it is empty after it has been quoted
+var ErrBlankSchemaName = fmt.Errorf("Schema name is blank after quoting")
+
+// ErrCopyFromUnsupported is returned when a Migration with Data is run against
+// a connection which can't perform a CopyFrom
+var ErrCopyFromUnsupported = fmt.Errorf("Database transaction does not support CopyFrom")
+
+// ErrFuncUnsupported is returned when a Migration with a Func is run against
+// a connection which isn't a transaction (e.g. as a bootstrap migration)
+var ErrFuncUnsupported = fmt.Errorf("Go migrations must be run in a transaction")
+
+// ErrConflictingMigrations is returned by MergeMigrations when two migrations
+// share an ID but have different Scripts
+var ErrConflictingMigrations = fmt.Errorf("Migrations with the same ID have different Scripts")
+
+// ErrInvalidIndexes is returned by RepairConcurrentIndexes when invalid
+// indexes are found, but the Migrator isn't configured to drop them
+var ErrInvalidIndexes = fmt.Errorf("Invalid indexes found")
+
+// ErrServerVersionTooOld is returned by Apply when the server is older than
+// the version required via WithMinServerVersion
+var ErrServerVersionTooOld = fmt.Errorf("Database server version is too old")
+
+// ErrVerificationFailed is returned when a migration's Verify query returns
+// no rows or a falsy value
+var ErrVerificationFailed = fmt.Errorf("Verification query did not return a true value")
+
+// ErrHealthCheckFailed is returned when the query provided via WithHealthCheck
+// returns no rows or a falsy value after a migration
+var ErrHealthCheckFailed = fmt.Errorf("Health check query did not return a true value")
+
+// ErrExtensionPermissionDenied is returned by Apply when the database role
+// isn't permitted to install an extension required via WithRequiredExtensions
+var ErrExtensionPermissionDenied = fmt.Errorf("Permission denied to install extension")
+
+// ErrTransactionControl is returned by Apply when a migration's Script
+// contains a statement (e.g. BEGIN or COMMIT) which would interfere with the
+// transaction the migrations run in
+var ErrTransactionControl = fmt.Errorf("Migration contains a transaction control statement")
+
+// ErrLockNotHeld is returned when releasing the migration lock reports that
+// the lock wasn't held by the session releasing it
+var ErrLockNotHeld = fmt.Errorf("Migration lock was not held when unlocking")
+
+// ErrLintFailed is returned by Apply when LintMigrations finds problems at or
+// above the severity provided via WithLintFailOn
+var ErrLintFailed = fmt.Errorf("Migrations failed linting")
+
+// ErrDrift is returned by Validate when applied migrations no longer match
+// the migrations provided (e.g. because a Script was edited after it was
+// applied)
+var ErrDrift = fmt.Errorf("Applied migrations have drifted from the provided migrations")
+
+// ErrChecksumColumnTooNarrow is returned by Apply when the tracking table's
+// checksum column is too short to hold the checksums the Migrator computes
+var ErrChecksumColumnTooNarrow = fmt.Errorf("Checksum column is too narrow for the checksum algorithm")
+
+// ErrOutOfOrder is returned by VerifyOrder when migrations were applied in an
+// order which differs from the lexical order of their IDs
+var ErrOutOfOrder = fmt.Errorf("Migrations were applied out of order")
+
+// ErrSyntaxCheckFailed is returned by Apply when a migration fails the dry run
+// performed because of the WithSyntaxCheck option
+var ErrSyntaxCheckFailed = fmt.Errorf("Migration failed the syntax check")
+
+// ErrUnknownTarget is returned by PlanToTarget when the target ID isn't among
+// the provided migrations
+var ErrUnknownTarget = fmt.Errorf("Target migration was not found")
+
+// ErrLeaseHeld is returned by RunOnce when another runner holds an unexpired
+// lease on the same key
+var ErrLeaseHeld = fmt.Errorf("Migration lease is held by another runner")
+
+// ErrApplyCancelled is returned by Apply when it fails because its context was
+// cancelled or its deadline passed. The error also matches the context's error
+// (context.Canceled or context.DeadlineExceeded) with errors.Is.
+var ErrApplyCancelled = fmt.Errorf("Apply was cancelled")
+
+// ErrNilBaseline is returned by Squash when the new baseline migration is nil
+var ErrNilBaseline = fmt.Errorf("Baseline migration is nil")
+
+// ErrDuplicateIDs is returned by ValidateMigrations, and by Apply before any
+// migrations are run, when two of the migrations share an ID (or, with
+// WithCaseInsensitiveIDs, have IDs which differ only by case)
+var ErrDuplicateIDs = fmt.Errorf("Migrations have duplicate IDs")
+
+// ErrLoadingMigrations is returned by ApplyFromDir when the migrations can't
+// be read from the directory, as opposed to failing to apply them
+var ErrLoadingMigrations = fmt.Errorf("Failed to load migrations")
+
+// ErrLockfileMismatch is returned by VerifyLockfile when the migrations don't
+// match the checksums recorded in the lockfile
+var ErrLockfileMismatch = fmt.Errorf("Migrations do not match the lockfile")
+
+// ErrSplitGroup is returned by Resume when the migrations in a Group aren't
+// consecutive, so they can't be applied in a single transaction
+var ErrSplitGroup = fmt.Errorf("Migrations in a Group must be consecutive")
+
+// ErrDuplicateMigrationID is an alias of ErrDuplicateIDs
+var ErrDuplicateMigrationID = ErrDuplicateIDs
+
+// ErrTableOutsideTxUnsupported is returned by NewMigratorE and Apply when
+// WithTableOutsideTransaction is combined with the CockroachDB dialect, whose
+// lock is taken by the statements which create the tracking table and would
+// be released at once if they ran outside the migration transaction
+var ErrTableOutsideTxUnsupported = fmt.Errorf("WithTableOutsideTransaction is not supported by the CockroachDB dialect")
+
+// ErrBootstrapUnsupported is returned by ApplyWithBootstrap when bootstrap
+// migrations are provided to a Migrator using the CockroachDB dialect, since
+// its lock can only be held inside a transaction
+var ErrBootstrapUnsupported = fmt.Errorf("Bootstrap migrations are not supported by the CockroachDB dialect")
+
+// ErrUnsupportedWithStore is returned by methods which work on the tracking
+// table's records directly (Squash and TrackingInfo) when a custom Store was
+// provided via WithStore, since the tracking table doesn't hold its records
+var ErrUnsupportedWithStore = fmt.Errorf("Not supported with a custom Store")
+
+// ErrSetRole is returned by Apply when the migration transaction can't switch
+// to the role provided via WithRole (e.g. because the connecting role isn't a
+// member of it)
+var ErrSetRole = fmt.Errorf("Failed to switch to the migration role")
+
+// ErrReadOnlyMigrator is returned by Apply (and the other methods which change
+// the database or take the migration lock) when the Migrator was created with
+// WithReadOnly
+var ErrReadOnlyMigrator = fmt.Errorf("Migrator is read-only")
+
+// ErrUnexpectedDatabase is returned by Apply when the connection's current
+// database isn't the one expected via WithExpectedDatabase
+var ErrUnexpectedDatabase = fmt.Errorf("Connected to an unexpected database")
+
+// ErrChecksumUnavailable is returned by WriteLockfile, VerifyLockfile and
+// FingerprintMigrations for Data and ScriptReader migrations, whose content is
+// only read when they are applied
+var ErrChecksumUnavailable = fmt.Errorf("Migration can't be checksummed until it is applied")
@@ -4,8 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"os"
+	"runtime"
 	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
@@ -34,6 +38,532 @@ func TestApplyWithNilDBProvidesHelpfulError(t *testing.T) {
 	}
 }
 
+func TestApplyWithBootstrapWithNilDB(t *testing.T) {
+	err := NewMigrator().ApplyWithBootstrap(nil, testMigrations(t, "useless-ansi"), nil)
+	if !errors.Is(err, ErrNilDB) {
+		t.Errorf("Expected %v, got %v", ErrNilDB, err)
+	}
+}
+
+func TestTrialApplyWithNilDB(t *testing.T) {
+	err := NewMigrator().TrialApply(nil, testMigrations(t, "useless-ansi"))
+	if !errors.Is(err, ErrNilDB) {
+		t.Errorf("Expected %v, got %v", ErrNilDB, err)
+	}
+}
+
+func TestApplyThenRollsBackWhenCallbackFails(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectBegin()
+	mock.ExpectExec("^\\s*CREATE TABLE").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectQuery("^\\s*SELECT COALESCE\\(character_maximum_length").WillReturnRows(pgxmock.NewRows([]string{"character_maximum_length"}).AddRow(int32(32)))
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^SELECT 1").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^SELECT 2").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^INSERT INTO seeds").WillReturnError(fmt.Errorf("Seed Failed"))
+	mock.ExpectRollback()
+	mock.ExpectQuery("^SELECT pg_advisory_unlock").WillReturnRows(pgxmock.NewRows([]string{"pg_advisory_unlock"}).AddRow(true))
+
+	err = NewMigrator().ApplyThen(mock, testMigrations(t, "useless-ansi"), func(ctx context.Context, tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, "INSERT INTO seeds (id) VALUES (1)")
+		return err
+	})
+	expectErrorContains(t, err, "Seed Failed")
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCheckChecksumColumnTooNarrow(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT COALESCE\\(character_maximum_length").
+		WithArgs("", "schema_migrations").
+		WillReturnRows(pgxmock.NewRows([]string{"character_maximum_length"}).AddRow(int32(16)))
+
+	err = NewMigrator().checkChecksumColumn(mock)
+	if !errors.Is(err, ErrChecksumColumnTooNarrow) {
+		t.Errorf("Expected %v, got %v", ErrChecksumColumnTooNarrow, err)
+	}
+	expectErrorContains(t, err, `ALTER TABLE "schema_migrations" ALTER COLUMN checksum TYPE VARCHAR(32)`)
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCheckChecksumColumnUnlimited(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT COALESCE\\(character_maximum_length").
+		WillReturnRows(pgxmock.NewRows([]string{"character_maximum_length"}).AddRow(int32(0)))
+
+	err = NewMigrator().checkChecksumColumn(mock)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCheckChecksumColumnFailure(t *testing.T) {
+	err := NewMigrator().checkChecksumColumn(BadQueryer{})
+	expectErrorContains(t, err, "FAIL")
+}
+
+func TestApplyTimeoutWhileWaitingForLock(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^SELECT pg_advisory_lock").WillDelayFor(time.Second).WillReturnResult(pgconn.CommandTag{})
+
+	migrator := NewMigrator(WithApplyTimeout(10 * time.Millisecond))
+	err = migrator.Apply(mock, testMigrations(t, "useless-ansi"))
+	if !errors.Is(err, pgxmock.ErrCancelled) {
+		t.Errorf("Expected the lock wait to be cancelled. Got %v", err)
+	}
+	if migrator.ctx.Err() != nil {
+		t.Error("Expected the Migrator's own context to be unaffected")
+	}
+}
+
+func TestApplyCancelledIsDistinguishable(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^SELECT pg_advisory_lock").WillDelayFor(time.Second).WillReturnResult(pgconn.CommandTag{})
+
+	err = NewMigrator(WithApplyTimeout(10*time.Millisecond)).Apply(mock, testMigrations(t, "useless-ansi"))
+	if !errors.Is(err, ErrApplyCancelled) {
+		t.Errorf("Expected %v, got %v", ErrApplyCancelled, err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a deadline rather than a cancellation. Got %v", err)
+	}
+}
+
+func TestApplyContext(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^SELECT pg_advisory_lock").WillDelayFor(time.Second).WillReturnResult(pgconn.CommandTag{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	migrator := NewMigrator()
+	err = migrator.ApplyContext(ctx, mock, testMigrations(t, "useless-ansi"))
+	if !errors.Is(err, ErrApplyCancelled) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected %v wrapping %v, got %v", ErrApplyCancelled, context.DeadlineExceeded, err)
+	}
+	if migrator.ctx.Err() != nil {
+		t.Error("Expected the Migrator's own context to be unaffected")
+	}
+}
+
+func TestApplyWithSignalHandling(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Sending os.Interrupt to a process isn't implemented on Windows")
+	}
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^SELECT pg_advisory_lock").WillDelayFor(time.Second).WillReturnResult(pgconn.CommandTag{})
+
+	process, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		_ = process.Signal(os.Interrupt)
+	}()
+	err = NewMigrator().ApplyWithSignalHandling(mock, testMigrations(t, "useless-ansi"), os.Interrupt)
+	if !errors.Is(err, ErrApplyCancelled) || !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected %v wrapping %v, got %v", ErrApplyCancelled, context.Canceled, err)
+	}
+}
+
+func TestApplyCancelledBetweenMigrations(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectBegin()
+	mock.ExpectExec("^\\s*CREATE TABLE").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectQuery("^\\s*SELECT COALESCE\\(character_maximum_length").
+		WillReturnRows(pgxmock.NewRows([]string{"width"}).AddRow(int32(32)))
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^\\s*INSERT INTO").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectRollback()
+	mock.ExpectQuery("^SELECT pg_advisory_unlock").WillReturnRows(pgxmock.NewRows([]string{"pg_advisory_unlock"}).AddRow(true))
+
+	migrations := []*Migration{
+		{
+			ID:          "2021-01-01 001 Cancel",
+			FuncVersion: "v1",
+			Func: func(ctx context.Context, tx pgx.Tx) error {
+				cancel()
+				return nil
+			},
+		},
+		{ID: "2021-01-01 002 Never Run", Script: "SELECT 2"},
+	}
+	err = NewMigrator(WithContext(ctx)).Apply(mock, migrations)
+	if !errors.Is(err, ErrApplyCancelled) || !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected %v wrapping %v, got %v", ErrApplyCancelled, context.Canceled, err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCancelledError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	migrator := NewMigrator(WithContext(ctx))
+	if err := migrator.cancelled(fmt.Errorf("SQL Failed")); errors.Is(err, ErrApplyCancelled) {
+		t.Errorf("Expected errors before cancellation to be left alone. Got %v", err)
+	}
+
+	cancel()
+	sqlErr := fmt.Errorf("SQL Failed")
+	err := migrator.cancelled(sqlErr)
+	if !errors.Is(err, ErrApplyCancelled) || !errors.Is(err, context.Canceled) || !errors.Is(err, sqlErr) {
+		t.Errorf("Expected the error to match %v, %v and the SQL error. Got %v", ErrApplyCancelled, context.Canceled, err)
+	}
+	if err.Error() != "Apply was cancelled (context canceled): SQL Failed" {
+		t.Errorf("Unexpected message '%s'", err)
+	}
+	if migrator.cancelled(err) != err {
+		t.Error("Expected an already-cancelled error not to be wrapped again")
+	}
+	if migrator.cancelled(nil) != nil {
+		t.Error("Expected nil to stay nil")
+	}
+	if err = migrator.cancelled(context.Canceled); err.Error() != "Apply was cancelled: context canceled" {
+		t.Errorf("Unexpected message '%s'", err)
+	}
+}
+
+func TestApplyTimeoutReleasesLockAfterDeadline(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectBegin()
+	mock.ExpectExec("^\\s*CREATE TABLE").WillDelayFor(time.Second).WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectRollback()
+	mock.ExpectQuery("^SELECT pg_advisory_unlock").WillReturnRows(pgxmock.NewRows([]string{"pg_advisory_unlock"}).AddRow(true))
+
+	err = NewMigrator(WithApplyTimeout(10*time.Millisecond)).Apply(mock, testMigrations(t, "useless-ansi"))
+	if !errors.Is(err, pgxmock.ErrCancelled) {
+		t.Errorf("Expected table creation to be cancelled. Got %v", err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunFuncMigration(t *testing.T) {
+	migration := &Migration{
+		ID:          "2021-01-01 Backfill",
+		FuncVersion: "v1",
+		Func: func(ctx context.Context, tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, "UPDATE users SET name = lower(name)")
+			return err
+		},
+	}
+
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^UPDATE users").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO").
+		WithArgs(migration.ID, migration.MD5(), pgxmock.AnyArg(), pgxmock.AnyArg(), ChecksumAlgorithmMD5, "", "").
+		WillReturnResult(pgconn.CommandTag{})
+
+	_, err = NewMigrator().run(mock, []*Migration{migration}, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExecuteFuncMigrationWithoutTransaction(t *testing.T) {
+	migration := &Migration{
+		ID:   "2021-01-01 Backfill",
+		Func: func(ctx context.Context, tx pgx.Tx) error { return nil },
+	}
+	_, err := NewMigrator().execute(BadQueryer{}, migration)
+	if !errors.Is(err, ErrFuncUnsupported) {
+		t.Errorf("Expected %v, got %v", ErrFuncUnsupported, err)
+	}
+}
+
+func TestApplyWithServerSideQuoting(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT quote_ident").
+		WithArgs("special", "my migrations").
+		WillReturnRows(pgxmock.NewRows([]string{"quote_ident", "quote_ident"}).AddRow("special", `"my migrations"`))
+	mock.ExpectExec(`^\s*CREATE TABLE IF NOT EXISTS special."my migrations"`).WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectQuery("^\\s*SELECT COALESCE\\(character_maximum_length").WillReturnRows(pgxmock.NewRows([]string{"character_maximum_length"}).AddRow(int32(32)))
+	mock.ExpectQuery(`^\s*SELECT DISTINCT id\s*FROM special."my migrations"`).WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^SELECT 1").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec(`^\s*INSERT INTO special."my migrations"`).WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectCommit()
+	mock.ExpectQuery("^SELECT pg_advisory_unlock").WillReturnRows(pgxmock.NewRows([]string{"pg_advisory_unlock"}).AddRow(true))
+
+	migrator := NewMigrator(WithTableName("special", "my migrations"), WithServerSideQuoting())
+	err = migrator.Apply(mock, []*Migration{{ID: "2021-01-01 001", Script: "SELECT 1"}})
+	if err != nil {
+		t.Error(err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+	if tn := migrator.QuotedTableName(); tn != `special."my migrations"` {
+		t.Errorf("Expected the server's quoting to be cached. Got %s", tn)
+	}
+}
+
+func TestServerSideQuotingFailure(t *testing.T) {
+	_, err := NewMigrator(WithServerSideQuoting()).GetAppliedMigrations(BadQueryer{})
+	expectErrorContains(t, err, "quote_ident")
+}
+
+func TestUpgradeTrackingTableWithNilDB(t *testing.T) {
+	err := NewMigrator().UpgradeTrackingTable(nil)
+	if !errors.Is(err, ErrNilDB) {
+		t.Errorf("Expected %v, got %v", ErrNilDB, err)
+	}
+}
+
+func TestUpgradeTrackingTableAddsMissingColumns(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectBegin()
+	mock.ExpectQuery("^\\s*SELECT column_name").
+		WithArgs("", "schema_migrations").
+		WillReturnRows(pgxmock.NewRows([]string{"column_name"}).
+			AddRow("id").AddRow("checksum").AddRow("execution_time_in_millis").AddRow("applied_at").AddRow("checksum_algorithm"))
+	mock.ExpectExec(`^ALTER TABLE "schema_migrations" ADD COLUMN IF NOT EXISTS version .*, ADD COLUMN IF NOT EXISTS commit .*, ADD COLUMN IF NOT EXISTS rolled_back_at`).
+		WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectCommit()
+	mock.ExpectQuery("^SELECT pg_advisory_unlock").WillReturnRows(pgxmock.NewRows([]string{"pg_advisory_unlock"}).AddRow(true))
+
+	err = NewMigrator().UpgradeTrackingTable(mock)
+	if err != nil {
+		t.Error(err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUpgradeTrackingTableFailure(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectBegin()
+	mock.ExpectQuery("^\\s*SELECT column_name").WillReturnError(fmt.Errorf("Columns Failed"))
+	mock.ExpectRollback()
+	mock.ExpectQuery("^SELECT pg_advisory_unlock").WillReturnRows(pgxmock.NewRows([]string{"pg_advisory_unlock"}).AddRow(true))
+
+	err = NewMigrator().UpgradeTrackingTable(mock)
+	expectErrorContains(t, err, "Columns Failed")
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLockWithOnLockWait(t *testing.T) {
+	for _, contended := range []bool{false, true} {
+		mock, err := pgxmock.NewConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mock.ExpectQuery("^SELECT pg_try_advisory_lock").WillReturnRows(pgxmock.NewRows([]string{"pg_try_advisory_lock"}).AddRow(!contended))
+		if contended {
+			mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnResult(pgconn.CommandTag{})
+		}
+
+		waited := 0
+		err = NewMigrator(WithOnLockWait(func() { waited++ })).lock(mock)
+		if err != nil {
+			t.Error(err)
+		}
+		if contended && waited != 1 {
+			t.Errorf("Expected the callback to be called once when the lock is contended. Got %d", waited)
+		}
+		if !contended && waited != 0 {
+			t.Errorf("Expected the callback not to be called when the lock is free. Got %d", waited)
+		}
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestLockWithOnLockWaitFailure(t *testing.T) {
+	err := NewMigrator(WithOnLockWait(func() {})).lock(BadQueryer{})
+	expectErrorContains(t, err, "pg_try_advisory_lock")
+}
+
+func TestSingleVersionModeFailure(t *testing.T) {
+	_, err := NewMigrator(WithSingleVersionMode()).PendingCount(BadQueryer{}, testMigrations(t, "useless-ansi"))
+	expectErrorContains(t, err, "SELECT version")
+}
+
+func TestWithinReadTxFailures(t *testing.T) {
+	err := NewMigrator().WithinReadTx(nil, func(tx Queryer) error { return nil })
+	if !errors.Is(err, ErrNilDB) {
+		t.Errorf("Expected %v, got %v", ErrNilDB, err)
+	}
+
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectBegin().WillReturnError(fmt.Errorf("Begin Failed"))
+	err = NewMigrator().WithinReadTx(mock, func(tx Queryer) error { return nil })
+	expectErrorContains(t, err, "Begin Failed")
+
+	mock.ExpectBegin()
+	mock.ExpectExec("^SET TRANSACTION").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectRollback()
+	err = NewMigrator().WithinReadTx(mock, func(tx Queryer) error { return fmt.Errorf("Read Failed") })
+	expectErrorContains(t, err, "Read Failed")
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunWithSyntaxCheck(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^SAVEPOINT pgxschema_syntax_check").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^CREATE TABLE widgets").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectQuery("^EXPLAIN \\(FORMAT JSON\\) INSERT INTO widgets").WillReturnRows(pgxmock.NewRows([]string{"QUERY PLAN"}).AddRow("[]"))
+	mock.ExpectExec("^ROLLBACK TO SAVEPOINT pgxschema_syntax_check").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^RELEASE SAVEPOINT pgxschema_syntax_check").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^CREATE TABLE widgets").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO").WillReturnResult(pgconn.CommandTag{})
+
+	migrations := []*Migration{
+		{ID: "2021-01-01 001", Script: "CREATE TABLE widgets (id INTEGER); INSERT INTO widgets (id) VALUES (1)"},
+	}
+	_, err = NewMigrator(WithSyntaxCheck()).run(mock, migrations, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunWithSyntaxCheckFailure(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^SAVEPOINT pgxschema_syntax_check").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^CREATE TABEL").WillReturnError(fmt.Errorf("syntax error at or near \"TABEL\""))
+	mock.ExpectExec("^ROLLBACK TO SAVEPOINT pgxschema_syntax_check").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^RELEASE SAVEPOINT pgxschema_syntax_check").WillReturnResult(pgconn.CommandTag{})
+
+	migrations := []*Migration{
+		{ID: "2021-01-01 001", Script: "CREATE TABEL widgets (id INTEGER)"},
+		{ID: "2021-01-01 002", Script: "SELECT 2"},
+	}
+	_, err = NewMigrator(WithSyntaxCheck()).run(mock, migrations, nil)
+	if !errors.Is(err, ErrSyntaxCheckFailed) {
+		t.Errorf("Expected %v, got %v", ErrSyntaxCheckFailed, err)
+	}
+	expectErrorContains(t, err, "2021-01-01 001")
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUnlockAfterContextCancelled(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^SELECT pg_advisory_unlock").
+		WillDelayFor(10 * time.Millisecond).
+		WillReturnRows(pgxmock.NewRows([]string{"pg_advisory_unlock"}).AddRow(true))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = NewMigrator(WithContext(ctx)).unlock(mock)
+	if err != nil {
+		t.Errorf("Expected the lock to be released despite the cancelled context. Got %v", err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidateWithNilDB(t *testing.T) {
+	err := NewMigrator().Validate(nil, testMigrations(t, "useless-ansi"))
+	if !errors.Is(err, ErrNilDB) {
+		t.Errorf("Expected %v, got %v", ErrNilDB, err)
+	}
+}
+
+func TestValidateFailure(t *testing.T) {
+	err := NewMigrator().Validate(BadQueryer{}, testMigrations(t, "useless-ansi"))
+	expectErrorContains(t, err, "FAIL: SELECT id, checksum")
+}
+
+func TestApplyToAllWithNilDBs(t *testing.T) {
+	migrator := NewMigrator()
+	errs := migrator.ApplyToAll([]Connection{nil, nil, nil}, testMigrations(t, "useless-ansi"), 0)
+	if len(errs) != 3 {
+		t.Fatalf("Expected 3 errors. Got %d", len(errs))
+	}
+	for i, err := range errs {
+		if !errors.Is(err, ErrNilDB) {
+			t.Errorf("Expected %v at index %d, got %v", ErrNilDB, i, err)
+		}
+	}
+}
+
 func TestApplyWithNoMigrations(t *testing.T) {
 	withEachDB(t, func(db *pgxpool.Pool) {
 		migrator := NewMigrator()
@@ -42,76 +572,517 @@ func TestApplyWithNoMigrations(t *testing.T) {
 			t.Errorf("Expected no error when running no migrations, got %s", err)
 		}
 
-	})
+	})
+}
+
+func TestApplyBeginFailure(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Error(err)
+	}
+	mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectBegin().WillReturnError(fmt.Errorf("Begin Failed"))
+	migrator := NewMigrator()
+	err = migrator.Apply(mock, testMigrations(t, "useless-ansi"))
+	expectErrorContains(t, err, "Begin Failed")
+}
+
+func TestApplyRequiredExtensionPermissionDenied(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Error(err)
+	}
+	mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectBegin()
+	mock.ExpectExec("^\\s*CREATE TABLE").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectQuery("^\\s*SELECT COALESCE\\(character_maximum_length").WillReturnRows(pgxmock.NewRows([]string{"character_maximum_length"}).AddRow(int32(32)))
+	mock.ExpectExec(`^CREATE EXTENSION IF NOT EXISTS "pgcrypto"`).WillReturnError(&pgconn.PgError{
+		Code:    "42501",
+		Message: "permission denied to create extension \"pgcrypto\"",
+	})
+	mock.ExpectRollback()
+	mock.ExpectQuery("^SELECT pg_advisory_unlock").WillReturnRows(pgxmock.NewRows([]string{"pg_advisory_unlock"}).AddRow(true))
+
+	err = NewMigrator(WithRequiredExtensions("pgcrypto")).Apply(mock, testMigrations(t, "useless-ansi"))
+	if !errors.Is(err, ErrExtensionPermissionDenied) {
+		t.Errorf("Expected %v, got %v", ErrExtensionPermissionDenied, err)
+	}
+	expectErrorContains(t, err, "'pgcrypto'")
+}
+
+func TestApplyRequiredExtensionFailure(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Error(err)
+	}
+	mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectBegin()
+	mock.ExpectExec("^\\s*CREATE TABLE").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectQuery("^\\s*SELECT COALESCE\\(character_maximum_length").WillReturnRows(pgxmock.NewRows([]string{"character_maximum_length"}).AddRow(int32(32)))
+	mock.ExpectExec("^CREATE EXTENSION").WillReturnError(fmt.Errorf("Create Extension Failed"))
+	mock.ExpectRollback()
+	mock.ExpectQuery("^SELECT pg_advisory_unlock").WillReturnRows(pgxmock.NewRows([]string{"pg_advisory_unlock"}).AddRow(true))
+
+	err = NewMigrator(WithRequiredExtensions("nonexistent")).Apply(mock, testMigrations(t, "useless-ansi"))
+	expectErrorContains(t, err, "Create Extension Failed")
+	if errors.Is(err, ErrExtensionPermissionDenied) {
+		t.Errorf("Expected a failure other than %v", ErrExtensionPermissionDenied)
+	}
+}
+
+func TestApplyLockFailure(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Error(err)
+	}
+	mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnError(fmt.Errorf("Lock Failed"))
+	err = NewMigrator().Apply(mock, testMigrations(t, "useless-ansi"))
+	expectErrorContains(t, err, "Lock Failed")
+}
+
+func TestApplyCreateMigrationsTableFailure(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Error(err)
+	}
+	mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectBegin()
+	mock.ExpectQuery("^CREATE TABLE").WillReturnError(fmt.Errorf("Create Migrations Table Failed"))
+	err = NewMigrator().Apply(mock, testMigrations(t, "useless-ansi"))
+	expectErrorContains(t, err, "Create Migrations Table Failed")
+}
+
+func TestApplyCreateMigrationsTableOutsideTransactionFailure(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Error(err)
+	}
+	mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*CREATE TABLE").WillReturnError(fmt.Errorf("Create Migrations Table Failed"))
+	mock.ExpectQuery("^SELECT pg_advisory_unlock").WillReturnRows(pgxmock.NewRows([]string{"pg_advisory_unlock"}).AddRow(true))
+	err = NewMigrator(WithTableOutsideTransaction()).Apply(mock, testMigrations(t, "useless-ansi"))
+	expectErrorContains(t, err, "Create Migrations Table Failed")
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRepairConcurrentIndexesWithNilDB(t *testing.T) {
+	err := NewMigrator().RepairConcurrentIndexes(nil)
+	if !errors.Is(err, ErrNilDB) {
+		t.Errorf("Expected %v, got %v", ErrNilDB, err)
+	}
+}
+
+func TestRepairConcurrentIndexesQueryFailure(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Error(err)
+	}
+	mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectQuery("pg_index").WillReturnError(fmt.Errorf("Index Query Failed"))
+	mock.ExpectQuery("^SELECT pg_advisory_unlock").WillReturnRows(pgxmock.NewRows([]string{"pg_advisory_unlock"}).AddRow(true))
+	err = NewMigrator().RepairConcurrentIndexes(mock)
+	expectErrorContains(t, err, "Index Query Failed")
+}
+
+func TestApplyReportingChangesWithNilDB(t *testing.T) {
+	changed, err := NewMigrator().ApplyReportingChanges(nil, testMigrations(t, "useless-ansi"))
+	if !errors.Is(err, ErrNilDB) {
+		t.Errorf("Expected %v, got %v", ErrNilDB, err)
+	}
+	if changed {
+		t.Error("Expected no changes to be reported when Apply fails")
+	}
+}
+
+func TestApplyWithServerVersionTooOld(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Error(err)
+	}
+	mock.ExpectQuery("^SHOW server_version_num").WillReturnRows(
+		pgxmock.NewRows([]string{"server_version_num"}).AddRow("110012"),
+	)
+	err = NewMigrator(WithMinServerVersion(12)).Apply(mock, testMigrations(t, "useless-ansi"))
+	if !errors.Is(err, ErrServerVersionTooOld) {
+		t.Errorf("Expected %v, got %v", ErrServerVersionTooOld, err)
+	}
+	expectErrorContains(t, err, "server is version 11, but version 12 or newer is required")
+}
+
+func TestApplyWithServerVersionQueryFailure(t *testing.T) {
+	bq := BadQueryer{}
+	err := NewMigrator(WithMinServerVersion(12)).checkServerVersion(bq)
+	expectErrorContains(t, err, "FAIL: SHOW server_version_num")
+}
+
+func TestApplyWithUnexpectedDatabase(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^SELECT current_database\\(\\)").WillReturnRows(
+		pgxmock.NewRows([]string{"current_database"}).AddRow("orders_staging"),
+	)
+	err = NewMigrator(WithExpectedDatabase("orders")).Apply(mock, testMigrations(t, "useless-ansi"))
+	if !errors.Is(err, ErrUnexpectedDatabase) {
+		t.Errorf("Expected %v, got %v", ErrUnexpectedDatabase, err)
+	}
+	expectErrorContains(t, err, "connected to 'orders_staging', but expected 'orders'")
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCheckDatabase(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^SELECT current_database\\(\\)").WillReturnRows(
+		pgxmock.NewRows([]string{"current_database"}).AddRow("orders"),
+	)
+	err = NewMigrator(WithExpectedDatabase("orders")).checkDatabase(mock)
+	if err != nil {
+		t.Error(err)
+	}
+	err = NewMigrator(WithExpectedDatabase("orders")).checkDatabase(BadQueryer{})
+	expectErrorContains(t, err, "FAIL: SELECT current_database()")
+}
+
+func TestLockFailure(t *testing.T) {
+	bq := BadQueryer{}
+	migrator := NewMigrator()
+	err := migrator.lock(bq)
+	expectErrorContains(t, err, "SELECT pg_advisory_lock")
+}
+
+func TestUnlockFailure(t *testing.T) {
+	bq := BadQueryer{}
+	migrator := NewMigrator()
+	err := migrator.unlock(bq)
+	expectErrorContains(t, err, "SELECT pg_advisory_unlock")
+}
+
+func TestUnlockWhenLockNotHeld(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^SELECT pg_advisory_unlock").WillReturnRows(pgxmock.NewRows([]string{"pg_advisory_unlock"}).AddRow(false))
+	var logged sliceLog
+	err = NewMigrator(WithLogger(&logged)).unlock(mock)
+	if !errors.Is(err, ErrLockNotHeld) {
+		t.Errorf("Expected %v, got %v", ErrLockNotHeld, err)
+	}
+	if len(logged.msgs) != 1 || !strings.HasPrefix(logged.msgs[0], "WARNING") {
+		t.Errorf("Expected a warning to be logged. Got %v", logged.msgs)
+	}
+}
+
+func TestComputeMigrationPlanFailure(t *testing.T) {
+	bq := BadQueryer{}
+	migrator := NewMigrator()
+	_, err := migrator.computeMigrationPlan(bq, []*Migration{})
+	expectErrorContains(t, err, "FAIL: SELECT DISTINCT id")
+}
+
+func TestSlowMigrationsFailure(t *testing.T) {
+	bq := BadQueryer{}
+	_, err := NewMigrator().SlowMigrations(bq, time.Second)
+	expectErrorContains(t, err, "FAIL: SELECT id, checksum, execution_time_in_millis, applied_at")
+}
+
+func TestRunWithNilTransactionHasHelpfulError(t *testing.T) {
+	migrator := NewMigrator()
+	_, err := migrator.run(nil, testMigrations(t, "useless-ansi"), nil)
+	if !errors.Is(err, ErrNilTx) {
+		t.Errorf("Expected %v, got %v", ErrNilTx, err)
+	}
+	expectErrorContains(t, err, `"schema_migrations"`)
+	expectErrorContains(t, err, "did Begin fail?")
+}
+
+func TestRunWithComputePlanFailHasHelpfulError(t *testing.T) {
+	bq := BadQueryer{}
+	_, err := NewMigrator().run(bq, testMigrations(t, "useless-ansi"), nil)
+	expectErrorContains(t, err, "SELECT DISTINCT id")
+}
+
+func TestRunWithRejectedPlan(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(
+		pgxmock.NewRows([]string{"id"}).AddRow("0000-00-00 001 Select 1"),
+	)
+
+	tooMany := fmt.Errorf("Too many migrations")
+	var validated []*Migration
+	migrator := NewMigrator(WithPlanValidator(func(plan []*Migration) error {
+		validated = plan
+		return tooMany
+	}))
+	_, err = migrator.run(mock, testMigrations(t, "useless-ansi"), nil)
+	if !errors.Is(err, tooMany) {
+		t.Errorf("Expected %v, got %v", tooMany, err)
+	}
+	if len(validated) != 1 || validated[0].ID != "0000-00-00 002 Select 2" {
+		t.Errorf("Expected the validator to receive the pending migration. Got %v", validated)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
 }
 
-func TestApplyBeginFailure(t *testing.T) {
+func TestPendingCountWithNilDB(t *testing.T) {
+	_, err := NewMigrator().PendingCount(nil, testMigrations(t, "useless-ansi"))
+	if !errors.Is(err, ErrNilDB) {
+		t.Errorf("Expected %v, got %v", ErrNilDB, err)
+	}
+}
+
+func TestPendingCountFailure(t *testing.T) {
+	_, err := NewMigrator().PendingCount(BadQueryer{}, testMigrations(t, "useless-ansi"))
+	expectErrorContains(t, err, "FAIL: SELECT DISTINCT id")
+}
+
+func TestPendingCountWithoutTrackingTable(t *testing.T) {
 	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnError(&pgconn.PgError{Code: "42P01"})
+	count, err := NewMigrator().PendingCount(mock, testMigrations(t, "useless-ansi"))
 	if err != nil {
 		t.Error(err)
 	}
-	mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnResult(pgconn.CommandTag{})
-	mock.ExpectBegin().WillReturnError(fmt.Errorf("Begin Failed"))
-	migrator := NewMigrator()
-	err = migrator.Apply(mock, testMigrations(t, "useless-ansi"))
-	expectErrorContains(t, err, "Begin Failed")
+	if count != 2 {
+		t.Errorf("Expected all 2 migrations to be pending. Got %d", count)
+	}
 }
 
-func TestApplyLockFailure(t *testing.T) {
+func TestRunRejectsTransactionControl(t *testing.T) {
 	mock, err := pgxmock.NewConn()
 	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+
+	_, err = NewMigrator().run(mock, []*Migration{
+		{ID: "2021-01-01 Explicit Commit", Script: "CREATE TABLE t (id INTEGER); COMMIT;"},
+	}, nil)
+	if !errors.Is(err, ErrTransactionControl) {
+		t.Errorf("Expected %v, got %v", ErrTransactionControl, err)
+	}
+	expectErrorContains(t, err, "2021-01-01 Explicit Commit")
+	if err = mock.ExpectationsWereMet(); err != nil {
 		t.Error(err)
 	}
-	mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnError(fmt.Errorf("Lock Failed"))
-	err = NewMigrator().Apply(mock, testMigrations(t, "useless-ansi"))
-	expectErrorContains(t, err, "Lock Failed")
 }
 
-func TestApplyCreateMigrationsTableFailure(t *testing.T) {
+func TestRunWithAllowTransactionControl(t *testing.T) {
 	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^SELECT 1; COMMIT; BEGIN;").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO").WillReturnResult(pgconn.CommandTag{})
+
+	_, err = NewMigrator(WithAllowTransactionControl()).run(mock, []*Migration{
+		{ID: "2021-01-01 Explicit Commit", Script: "SELECT 1; COMMIT; BEGIN;"},
+	}, nil)
 	if err != nil {
 		t.Error(err)
 	}
-	mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnResult(pgconn.CommandTag{})
-	mock.ExpectBegin()
-	mock.ExpectQuery("^CREATE TABLE").WillReturnError(fmt.Errorf("Create Migrations Table Failed"))
-	err = NewMigrator().Apply(mock, testMigrations(t, "useless-ansi"))
-	expectErrorContains(t, err, "Create Migrations Table Failed")
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
 }
 
-func TestLockFailure(t *testing.T) {
-	bq := BadQueryer{}
-	migrator := NewMigrator()
-	err := migrator.lock(bq)
-	expectErrorContains(t, err, "SELECT pg_advisory_lock")
+func TestRunWithBaselineVersion(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^\\s*INSERT INTO").
+		WithArgs("0000-00-00 001 Select 1", pgxmock.AnyArg(), int64(0), pgxmock.AnyArg(), ChecksumAlgorithmMD5, "", "").
+		WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^SELECT 2").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO").WillReturnResult(pgconn.CommandTag{})
+
+	migrator := NewMigrator(WithBaselineVersion("0000-00-00 001 Select 1"))
+	count, err := migrator.run(mock, testMigrations(t, "useless-ansi"), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if count != 1 {
+		t.Errorf("Expected 1 migration to be run. Got %d", count)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
 }
 
-func TestUnlockFailure(t *testing.T) {
-	bq := BadQueryer{}
+func TestRunInSavepointRetryAndSkip(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^SAVEPOINT").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^SELECT 1").WillReturnError(fmt.Errorf("Transient Failure"))
+	mock.ExpectExec("^ROLLBACK TO SAVEPOINT").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^SAVEPOINT").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^SELECT 1").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^RELEASE SAVEPOINT").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^SAVEPOINT").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^SELECT 2").WillReturnError(fmt.Errorf("Permanent Failure"))
+	mock.ExpectExec("^ROLLBACK TO SAVEPOINT").WillReturnResult(pgconn.CommandTag{})
+
 	migrator := NewMigrator()
-	err := migrator.unlock(bq)
-	expectErrorContains(t, err, "SELECT pg_advisory_unlock")
+	migrator.onError = func(m *Migration, err error) Decision {
+		if strings.Contains(err.Error(), "Transient") {
+			return Retry
+		}
+		return Skip
+	}
+	count, err := migrator.run(mock, testMigrations(t, "useless-ansi"), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if count != 1 {
+		t.Errorf("Expected 1 migration to be applied. Got %d", count)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
 }
 
-func TestComputeMigrationPlanFailure(t *testing.T) {
-	bq := BadQueryer{}
+func TestRunInSavepointAbort(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^SAVEPOINT").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^SELECT 1").WillReturnError(fmt.Errorf("Permanent Failure"))
+	mock.ExpectExec("^ROLLBACK TO SAVEPOINT").WillReturnResult(pgconn.CommandTag{})
+
 	migrator := NewMigrator()
-	_, err := migrator.computeMigrationPlan(bq, []*Migration{})
-	expectErrorContains(t, err, "FAIL: SELECT id, checksum, execution_time_in_millis, applied_at")
+	var failed *Migration
+	migrator.onError = func(m *Migration, err error) Decision {
+		failed = m
+		return Abort
+	}
+	_, err = migrator.run(mock, testMigrations(t, "useless-ansi"), nil)
+	expectErrorContains(t, err, "Permanent Failure")
+	if failed == nil || failed.ID != "0000-00-00 001 Select 1" {
+		t.Errorf("Expected onError to receive the failed migration. Got %v", failed)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
 }
 
-func TestRunWithNilTransactionHasHelpfulError(t *testing.T) {
-	migrator := NewMigrator()
-	err := migrator.run(nil, testMigrations(t, "useless-ansi"))
-	if err != ErrNilTx {
-		t.Errorf("Expected %v, got %v", ErrNilTx, err)
+func TestRunWithChecksumIncludesID(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	migration := &Migration{ID: "2021-01-01 001", Script: "SELECT 1"}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^SELECT 1").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO").
+		WithArgs(migration.ID, migration.MD5WithID(), pgxmock.AnyArg(), pgxmock.AnyArg(), ChecksumAlgorithmMD5WithID, "", "").
+		WillReturnResult(pgconn.CommandTag{})
+
+	_, err = NewMigrator(WithChecksumIncludesID()).run(mock, []*Migration{migration}, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
 	}
 }
 
-func TestRunWithComputePlanFailHasHelpfulError(t *testing.T) {
+func TestRunWithAppliedAtSource(t *testing.T) {
+	serverTime := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	table := map[AppliedAtSource]string{
+		AppliedAtStatementTimestamp: "^SELECT statement_timestamp\\(\\)",
+		AppliedAtClockTimestamp:     "^SELECT clock_timestamp\\(\\)",
+	}
+	for source, query := range table {
+		mock, err := pgxmock.NewConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+		mock.ExpectQuery(query).WillReturnRows(pgxmock.NewRows([]string{"now"}).AddRow(serverTime))
+		mock.ExpectExec("^SELECT 1").WillReturnResult(pgconn.CommandTag{})
+		mock.ExpectExec("^\\s*INSERT INTO").
+			WithArgs("2021-01-01 001", pgxmock.AnyArg(), pgxmock.AnyArg(), serverTime, ChecksumAlgorithmMD5, "", "").
+			WillReturnResult(pgconn.CommandTag{})
+
+		_, err = NewMigrator(WithAppliedAtSource(source)).run(mock, []*Migration{{ID: "2021-01-01 001", Script: "SELECT 1"}}, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestRunWithAppliedAtSourceFailure(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectQuery("^SELECT clock_timestamp").WillReturnError(fmt.Errorf("Clock Failed"))
+
+	_, err = NewMigrator(WithAppliedAtSource(AppliedAtClockTimestamp)).run(mock, []*Migration{{ID: "2021-01-01 001", Script: "SELECT 1"}}, nil)
+	expectErrorContains(t, err, "Clock Failed")
+}
+
+func TestRunDataMigrationWithoutCopyFromFails(t *testing.T) {
+	bq := BadQueryer{}
+	migration := &Migration{
+		ID: "2022-01-01 Seed Colors",
+		Data: &DataMigration{
+			TableName: pgx.Identifier{"colors"},
+			Columns:   []string{"name"},
+			Source:    pgx.CopyFromRows([][]interface{}{{"red"}}),
+		},
+	}
+	err := NewMigrator().runMigration(bq, migration)
+	if !errors.Is(err, ErrCopyFromUnsupported) {
+		t.Errorf("Expected %v, got %v", ErrCopyFromUnsupported, err)
+	}
+}
+
+func TestExplainFailure(t *testing.T) {
 	bq := BadQueryer{}
-	err := NewMigrator().run(bq, testMigrations(t, "useless-ansi"))
-	expectErrorContains(t, err, "SELECT id, checksum")
+	migrator := NewMigrator(WithExplainCallback(func(id, sql, planJSON string) {}))
+	err := migrator.runMigration(bq, &Migration{ID: "2022-01-01 Insert", Script: "INSERT INTO users (id) VALUES (1)"})
+	expectErrorContains(t, err, "FAIL: EXPLAIN (FORMAT JSON) INSERT INTO users")
+}
+
+func TestVerifyQueryFailure(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Error(err)
+	}
+	mock.ExpectExec("^SELECT 1").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectQuery("^SELECT verified").WillReturnError(fmt.Errorf("Verify Failed"))
+	err = NewMigrator().runMigration(mock, &Migration{ID: "2022-01-01", Script: "SELECT 1", Verify: "SELECT verified"})
+	expectErrorContains(t, err, "Verify Failed")
 }
 
 func expectErrorContains(t *testing.T, err error, contains string) {
@@ -122,3 +1093,276 @@ func expectErrorContains(t *testing.T, err error, contains string) {
 		t.Errorf("Expected an error string containing '%s', got '%s' instead", contains, err.Error())
 	}
 }
+
+func TestRunWithNotifyChannelFailure(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^SELECT 1").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^SELECT pg_notify").WillReturnError(fmt.Errorf("channel name too long"))
+
+	_, err = NewMigrator(WithNotifyChannel("schema_changed")).run(mock, []*Migration{{ID: "2021-01-01 001", Script: "SELECT 1"}}, nil)
+	expectErrorContains(t, err, "channel name too long")
+}
+
+func TestRunWithChecksumSigner(t *testing.T) {
+	migration := &Migration{ID: "2021-01-01 001", Script: "SELECT 1"}
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^SELECT 1").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*UPDATE \"schema_migrations\"\\s+SET checksum_signature").
+		WithArgs(migration.ID, migration.MD5(), "signed:"+migration.MD5()).
+		WillReturnResult(pgconn.CommandTag{})
+
+	signer := func(checksum string) string { return "signed:" + checksum }
+	_, err = NewMigrator(WithChecksumSigner(signer)).run(mock, []*Migration{migration}, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunWithSettingsFailure(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectQuery("^SELECT COALESCE\\(current_setting").
+		WillReturnError(fmt.Errorf("unrecognized configuration parameter \"not_a_setting\""))
+
+	_, err = NewMigrator().run(mock, []*Migration{{
+		ID:       "2021-01-01 001",
+		Script:   "SELECT 1",
+		Settings: map[string]string{"not_a_setting": "1"},
+	}}, nil)
+	expectErrorContains(t, err, "Failed to apply its Settings: setting 'not_a_setting'")
+}
+
+func TestCreateMigrationsTableWithTablespace(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^\\s*CREATE TABLE IF NOT EXISTS \"schema_migrations\" \\([^;]*\\) TABLESPACE \"metadata\";").WillReturnResult(pgconn.CommandTag{})
+
+	err = NewMigrator(WithTablespace("metadata")).createMigrationsTable(mock)
+	if err != nil {
+		t.Error(err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCreateMigrationsTableWithTablespaceFailure(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^\\s*CREATE TABLE IF NOT EXISTS").WillReturnError(fmt.Errorf("tablespace \"metadata\" does not exist"))
+
+	err = NewMigrator(WithTablespace("metadata")).createMigrationsTable(mock)
+	expectErrorContains(t, err, "does not exist")
+}
+
+func TestSquashRollsBackOnFailure(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectBegin()
+	mock.ExpectExec("^\\s*CREATE TABLE").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^DELETE FROM \"schema_migrations\"$").WillReturnResult(pgconn.CommandTag("DELETE 2"))
+	mock.ExpectExec("^\\s*INSERT INTO").WillReturnError(fmt.Errorf("Insert Failed"))
+	mock.ExpectRollback()
+	mock.ExpectQuery("^SELECT pg_advisory_unlock").WillReturnRows(pgxmock.NewRows([]string{"pg_advisory_unlock"}).AddRow(true))
+
+	err = NewMigrator().Squash(mock, &Migration{ID: "2022-01-01 Baseline", Script: "SELECT 1"})
+	expectErrorContains(t, err, "Insert Failed")
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSquashWithNilArguments(t *testing.T) {
+	err := NewMigrator().Squash(nil, &Migration{ID: "2022-01-01 Baseline"})
+	if !errors.Is(err, ErrNilDB) {
+		t.Errorf("Expected %v, got %v", ErrNilDB, err)
+	}
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = NewMigrator().Squash(mock, nil)
+	if !errors.Is(err, ErrNilBaseline) {
+		t.Errorf("Expected %v, got %v", ErrNilBaseline, err)
+	}
+}
+
+func TestRunStreamedMigrationWithTrimmedChecksum(t *testing.T) {
+	script := "SELECT 1;\n\n"
+	expected := &Migration{ID: "2021-01-01 001", Script: "SELECT 1;"}
+
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^SELECT 1$").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO").
+		WithArgs(expected.ID, expected.MD5(), pgxmock.AnyArg(), pgxmock.AnyArg(), ChecksumAlgorithmMD5Trimmed, "", "").
+		WillReturnResult(pgconn.CommandTag{})
+
+	_, err = NewMigrator(WithTrimScriptForChecksum()).run(mock, []*Migration{{ID: expected.ID, ScriptReader: strings.NewReader(script)}}, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunStreamedMigrationFailure(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^SELECT 1$").WillReturnError(fmt.Errorf("Statement Failed"))
+
+	migration := &Migration{ID: "2021-01-01 001", ScriptReader: strings.NewReader("SELECT 1; SELECT 2;")}
+	_, err = NewMigrator().run(mock, []*Migration{migration}, nil)
+	expectErrorContains(t, err, "Statement Failed")
+
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	migration = &Migration{ID: "2021-01-01 001", ScriptReader: iotest.ErrReader(fmt.Errorf("Read Failed"))}
+	_, err = NewMigrator().run(mock, []*Migration{migration}, nil)
+	expectErrorContains(t, err, "Read Failed")
+}
+
+func TestRunWithMigrationLockRetry(t *testing.T) {
+	lockErr := &pgconn.PgError{Code: lockNotAvailable, Message: "canceling statement due to lock timeout"}
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^SAVEPOINT pgxschema_lock_retry$").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^SET LOCAL lock_timeout").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^RELEASE SAVEPOINT pgxschema_lock_retry$").WillReturnResult(pgconn.CommandTag{})
+	for i := 0; i < 2; i++ {
+		mock.ExpectExec("^SAVEPOINT pgxschema_lock_retry$").WillReturnResult(pgconn.CommandTag{})
+		mock.ExpectExec("^ALTER TABLE users").WillReturnError(lockErr)
+		mock.ExpectExec("^ROLLBACK TO SAVEPOINT pgxschema_lock_retry$").WillReturnResult(pgconn.CommandTag{})
+	}
+	mock.ExpectExec("^SAVEPOINT pgxschema_lock_retry$").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^ALTER TABLE users").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^RELEASE SAVEPOINT pgxschema_lock_retry$").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO").WillReturnResult(pgconn.CommandTag{})
+
+	migrator := NewMigrator(WithMigrationLockRetry(3, time.Millisecond))
+	_, err = migrator.run(mock, []*Migration{{
+		ID:     "2021-01-01 001",
+		Script: "SET LOCAL lock_timeout = '1s'; ALTER TABLE users ADD COLUMN email TEXT;",
+	}}, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunWithMigrationLockRetryGivesUp(t *testing.T) {
+	lockErr := &pgconn.PgError{Code: lockNotAvailable, Message: "canceling statement due to lock timeout"}
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^SAVEPOINT").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^ALTER TABLE users").WillReturnError(lockErr)
+	mock.ExpectExec("^ROLLBACK TO SAVEPOINT").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^SAVEPOINT").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^ALTER TABLE users").WillReturnError(lockErr)
+
+	migrator := NewMigrator(WithMigrationLockRetry(2, time.Millisecond))
+	_, err = migrator.run(mock, []*Migration{{ID: "2021-01-01 001", Script: "ALTER TABLE users ADD COLUMN email TEXT"}}, nil)
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != lockNotAvailable {
+		t.Errorf("Expected the lock_not_available error after the last attempt. Got %v", err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExecStatementDoesNotRetryOtherErrors(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^SAVEPOINT").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^ALTER TABLE users").WillReturnError(&pgconn.PgError{Code: undefinedTable})
+
+	err = NewMigrator(WithMigrationLockRetry(3, time.Millisecond)).execStatement(mock, "ALTER TABLE users ADD COLUMN email TEXT")
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != undefinedTable {
+		t.Errorf("Expected the error to be returned without retrying. Got %v", err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunWithFailingScriptTransform(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+
+	transformErr := fmt.Errorf("unknown placeholder")
+	migrator := NewMigrator(WithScriptTransform(func(m *Migration, script string) (string, error) {
+		return "", transformErr
+	}))
+	_, err = migrator.run(mock, []*Migration{{ID: "2021-01-01 001", Script: "CREATE TABLE {{nope}}.users ()"}}, nil)
+	if !errors.Is(err, transformErr) {
+		t.Errorf("Expected the transform's error. Got %v", err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestApplyWithRoleFailure(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectBegin()
+	mock.ExpectExec(`^SET LOCAL ROLE "app_owner"$`).WillReturnError(&pgconn.PgError{Code: "42501", Message: `permission denied to set role "app_owner"`})
+	mock.ExpectRollback()
+	mock.ExpectQuery("^SELECT pg_advisory_unlock").WillReturnRows(pgxmock.NewRows([]string{"pg_advisory_unlock"}).AddRow(true))
+
+	err = NewMigrator(WithRole("app_owner")).Apply(mock, testMigrations(t, "useless-ansi"))
+	if !errors.Is(err, ErrSetRole) {
+		t.Errorf("Expected ErrSetRole, got %v", err)
+	}
+	expectErrorContains(t, err, "permission denied")
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,68 @@
+package pgxschema
+
+import "time"
+
+// MigrationEventType identifies what a MigrationEvent reports
+type MigrationEventType int
+
+const (
+	// EventStarted is sent before a migration is run
+	EventStarted MigrationEventType = iota
+
+	// EventApplied is sent after a migration has run and been recorded. It
+	// isn't durable until the migration transaction commits, which is
+	// reported by an EventCompleted without an Err.
+	EventApplied
+
+	// EventFailed is sent when a migration fails. Its Err is the failure.
+	EventFailed
+
+	// EventCompleted is sent when Apply finishes. Its Err is set if Apply
+	// failed, in which case no migrations were committed.
+	EventCompleted
+)
+
+// String returns the name of the event type
+func (t MigrationEventType) String() string {
+	switch t {
+	case EventStarted:
+		return "Started"
+	case EventApplied:
+		return "Applied"
+	case EventFailed:
+		return "Failed"
+	case EventCompleted:
+		return "Completed"
+	}
+	return "Unknown"
+}
+
+// MigrationEvent reports the progress of Apply to the channel provided via
+// the WithEventChannel option
+type MigrationEvent struct {
+	Type MigrationEventType
+
+	// MigrationID is the ID of the migration the event is about. It is blank
+	// for EventCompleted.
+	MigrationID string
+
+	// Duration is how long the migration took to run (or to fail). For
+	// EventCompleted, it is how long the whole Apply took.
+	Duration time.Duration
+
+	// Err is the failure reported by EventFailed and EventCompleted
+	Err error
+}
+
+// emit sends the event to the channel provided via WithEventChannel. Sends
+// never block, so if the channel isn't ready the event is dropped rather than
+// stalling the migrations.
+func (m *Migrator) emit(event MigrationEvent) {
+	if m.events == nil {
+		return
+	}
+	select {
+	case m.events <- event:
+	default:
+	}
+}
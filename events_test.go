@@ -0,0 +1,84 @@
+package pgxschema
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/pashagolub/pgxmock"
+)
+
+func TestApplyWithEventChannel(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectBegin()
+	mock.ExpectExec("^\\s*CREATE TABLE").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectQuery("^\\s*SELECT COALESCE\\(character_maximum_length").
+		WillReturnRows(pgxmock.NewRows([]string{"width"}).AddRow(int32(32)))
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^SELECT 1").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^SELECT 2").WillReturnError(fmt.Errorf("Migration Failed"))
+	mock.ExpectRollback()
+	mock.ExpectQuery("^SELECT pg_advisory_unlock").WillReturnRows(pgxmock.NewRows([]string{"pg_advisory_unlock"}).AddRow(true))
+
+	events := make(chan MigrationEvent, 10)
+	err = NewMigrator(WithEventChannel(events)).Apply(mock, testMigrations(t, "useless-ansi"))
+	expectErrorContains(t, err, "Migration Failed")
+	close(events)
+
+	expected := []struct {
+		Type MigrationEventType
+		ID   string
+	}{
+		{EventStarted, "0000-00-00 001 Select 1"},
+		{EventApplied, "0000-00-00 001 Select 1"},
+		{EventStarted, "0000-00-00 002 Select 2"},
+		{EventFailed, "0000-00-00 002 Select 2"},
+		{EventCompleted, ""},
+	}
+	i := 0
+	for event := range events {
+		if i >= len(expected) {
+			t.Fatalf("Unexpected event %+v", event)
+		}
+		if event.Type != expected[i].Type || event.MigrationID != expected[i].ID {
+			t.Errorf("Expected event %d to be %s '%s'. Got %s '%s'", i, expected[i].Type, expected[i].ID, event.Type, event.MigrationID)
+		}
+		if (event.Type == EventFailed || event.Type == EventCompleted) && event.Err == nil {
+			t.Errorf("Expected %s event to carry the error", event.Type)
+		}
+		i++
+	}
+	if i != len(expected) {
+		t.Errorf("Expected %d events. Got %d", len(expected), i)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEmitDoesNotBlock(t *testing.T) {
+	events := make(chan MigrationEvent)
+	migrator := NewMigrator(WithEventChannel(events))
+	migrator.emit(MigrationEvent{Type: EventStarted, MigrationID: "2021-01-01 001"})
+	NewMigrator().emit(MigrationEvent{Type: EventStarted})
+}
+
+func TestMigrationEventTypeString(t *testing.T) {
+	table := map[MigrationEventType]string{
+		EventStarted:           "Started",
+		EventApplied:           "Applied",
+		EventFailed:            "Failed",
+		EventCompleted:         "Completed",
+		MigrationEventType(99): "Unknown",
+	}
+	for eventType, expected := range table {
+		if eventType.String() != expected {
+			t.Errorf("Expected %d to be '%s'. Got '%s'", eventType, expected, eventType.String())
+		}
+	}
+}
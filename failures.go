@@ -0,0 +1,69 @@
+package pgxschema
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgconn"
+)
+
+// FailuresTableName returns the dialect-quoted fully-qualified name of the
+// table in which the WithRecordFailures option records failed migrations. It's
+// named after the tracking table, with a "_failures" suffix, so that Migrators
+// with different tracking tables don't share it.
+func (m *Migrator) FailuresTableName() string {
+	return QuotedTableName(m.schemaName, m.tableName+"_failures")
+}
+
+// PruneFailures deletes the failures recorded by the WithRecordFailures option
+// more than olderThan ago, so that the failures table doesn't grow without
+// bound. It returns the number of failures which were deleted. If the table
+// doesn't exist yet, there is nothing to prune.
+func (m *Migrator) PruneFailures(db Connection, olderThan time.Duration) (int, error) {
+	if db == nil {
+		return 0, ErrNilDB
+	}
+	if m.readOnly {
+		return 0, ErrReadOnlyMigrator
+	}
+
+	tag, err := db.Exec(m.ctx, failuresPruneSQL(m.FailuresTableName()), olderThan.Milliseconds())
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == undefinedTable {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	m.log(fmt.Sprintf("Pruned %d failures from %s\n", tag.RowsAffected(), m.FailuresTableName()))
+	return int(tag.RowsAffected()), nil
+}
+
+// recordFailure records the migration which caused err in the failures table,
+// if WithRecordFailures is used and err came from a migration. It must be
+// called after the migration transaction has been rolled back, on the
+// connection which ran it.
+func (m *Migrator) recordFailure(db Queryer, err error) {
+	var failure migrationFailure
+	if !m.recordFailures || !errors.As(err, &failure) {
+		return
+	}
+
+	// As with unlock, a fresh context is used so that failures caused by the
+	// Migrator's context being cancelled are recorded too
+	ctx, cancel := context.WithTimeout(context.Background(), unlockTimeout)
+	defer cancel()
+
+	tn := m.FailuresTableName()
+	_, recordErr := db.Exec(ctx, failuresCreateSQL(tn))
+	if recordErr == nil {
+		_, recordErr = db.Exec(ctx, failuresInsertSQL(tn), failure.id, failure.err.Error())
+	}
+	if recordErr != nil {
+		m.log(fmt.Sprintf("Recording the failure of migration '%s' failed: %s\n", failure.id, recordErr))
+		return
+	}
+	m.log(fmt.Sprintf("Failure of migration '%s' recorded in %s\n", failure.id, tn))
+}
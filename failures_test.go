@@ -0,0 +1,154 @@
+package pgxschema
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/pashagolub/pgxmock"
+)
+
+func TestFailuresTableName(t *testing.T) {
+	m := NewMigrator(WithTableName("special", "migrations"))
+	expected := `"special"."migrations_failures"`
+	if actual := m.FailuresTableName(); actual != expected {
+		t.Errorf("Expected %s. Got %s", expected, actual)
+	}
+}
+
+func TestRecordFailures(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectBegin()
+	mock.ExpectExec("^\\s*CREATE TABLE IF NOT EXISTS \"schema_migrations\"").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectQuery("^\\s*SELECT COALESCE\\(character_maximum_length").
+		WillReturnRows(pgxmock.NewRows([]string{"width"}).AddRow(int32(32)))
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^SELECT 1").WillReturnError(fmt.Errorf("FAIL: SELECT 1"))
+	mock.ExpectRollback()
+	mock.ExpectExec("^\\s*CREATE TABLE IF NOT EXISTS \"schema_migrations_failures\"").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^INSERT INTO \"schema_migrations_failures\"").
+		WithArgs("2021-01-01 001", pgxmock.AnyArg()).
+		WillReturnResult(pgconn.CommandTag("INSERT 0 1"))
+	mock.ExpectQuery("^SELECT pg_advisory_unlock").WillReturnRows(pgxmock.NewRows([]string{"pg_advisory_unlock"}).AddRow(true))
+
+	err = NewMigrator(WithRecordFailures()).Apply(mock, []*Migration{{ID: "2021-01-01 001", Script: "SELECT 1"}})
+	expectErrorContains(t, err, "FAIL: SELECT 1")
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRecordFailuresLogsRecordingErrors(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectBegin()
+	mock.ExpectExec("^\\s*CREATE TABLE IF NOT EXISTS \"schema_migrations\"").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectQuery("^\\s*SELECT COALESCE\\(character_maximum_length").
+		WillReturnRows(pgxmock.NewRows([]string{"width"}).AddRow(int32(32)))
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^SELECT 1").WillReturnError(fmt.Errorf("FAIL: SELECT 1"))
+	mock.ExpectRollback()
+	mock.ExpectExec("^\\s*CREATE TABLE IF NOT EXISTS \"schema_migrations_failures\"").WillReturnError(fmt.Errorf("FAIL: CREATE TABLE"))
+	mock.ExpectQuery("^SELECT pg_advisory_unlock").WillReturnRows(pgxmock.NewRows([]string{"pg_advisory_unlock"}).AddRow(true))
+
+	log := &sliceLog{}
+	err = NewMigrator(WithRecordFailures(), WithLogger(log)).Apply(mock, []*Migration{{ID: "2021-01-01 001", Script: "SELECT 1"}})
+	expectErrorContains(t, err, "FAIL: SELECT 1")
+	if strings.Contains(err.Error(), "CREATE TABLE") {
+		t.Errorf("Expected the migration's error to be returned, not the recording error. Got %v", err)
+	}
+	if !strings.Contains(fmt.Sprint(log.msgs), "FAIL: CREATE TABLE") {
+		t.Errorf("Expected the recording error to be logged. Got %v", log.msgs)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRecordFailuresInDatabase(t *testing.T) {
+	withLatestDB(t, func(db *pgxpool.Pool) {
+		migrator := NewMigrator(WithTableName(time.Now().Format(time.RFC3339Nano)), WithRecordFailures())
+		migrations := []*Migration{
+			{ID: "2021-01-01 001", Script: "CREATE TABLE record_failures_ok (id INTEGER)"},
+			{ID: "2021-01-01 002", Script: "SELECT * FROM record_failures_missing"},
+		}
+		err := migrator.Apply(db, migrations)
+		expectErrorContains(t, err, "record_failures_missing")
+
+		var id, message string
+		err = db.QueryRow(migrator.ctx, "SELECT id, error FROM "+migrator.FailuresTableName()).Scan(&id, &message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != "2021-01-01 002" {
+			t.Errorf("Expected the failure of '2021-01-01 002' to be recorded. Got '%s'", id)
+		}
+		if !strings.Contains(message, "record_failures_missing") {
+			t.Errorf("Expected the recorded error to mention the missing table. Got '%s'", message)
+		}
+
+		count, err := migrator.PruneFailures(db, time.Hour)
+		if err != nil || count != 0 {
+			t.Errorf("Expected the recent failure to be kept. Got %d, %v", count, err)
+		}
+		count, err = migrator.PruneFailures(db, 0)
+		if err != nil || count != 1 {
+			t.Errorf("Expected the failure to be pruned. Got %d, %v", count, err)
+		}
+	})
+}
+
+func TestPruneFailures(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^DELETE FROM \"schema_migrations_failures\" WHERE failed_at < now\\(\\)").
+		WithArgs(int64(3600000)).
+		WillReturnResult(pgconn.CommandTag("DELETE 3"))
+	mock.ExpectExec("^DELETE FROM \"schema_migrations_failures\"").
+		WithArgs(int64(3600000)).
+		WillReturnError(&pgconn.PgError{Code: undefinedTable})
+	mock.ExpectExec("^DELETE FROM \"schema_migrations_failures\"").
+		WithArgs(int64(3600000)).
+		WillReturnError(fmt.Errorf("FAIL: DELETE"))
+
+	migrator := NewMigrator()
+	count, err := migrator.PruneFailures(mock, time.Hour)
+	if err != nil {
+		t.Error(err)
+	}
+	if count != 3 {
+		t.Errorf("Expected 3 failures to be pruned. Got %d", count)
+	}
+
+	count, err = migrator.PruneFailures(mock, time.Hour)
+	if err != nil || count != 0 {
+		t.Errorf("Expected nothing to be pruned without a failures table. Got %d, %v", count, err)
+	}
+
+	_, err = migrator.PruneFailures(mock, time.Hour)
+	expectErrorContains(t, err, "FAIL: DELETE")
+
+	_, err = migrator.PruneFailures(nil, time.Hour)
+	if err != ErrNilDB {
+		t.Errorf("Expected %v, got %v", ErrNilDB, err)
+	}
+	_, err = NewMigrator(WithReadOnly()).PruneFailures(mock, time.Hour)
+	if err != ErrReadOnlyMigrator {
+		t.Errorf("Expected %v, got %v", ErrReadOnlyMigrator, err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
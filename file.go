@@ -1,11 +1,14 @@
 package pgxschema
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
 	"strings"
 )
 
@@ -75,3 +78,59 @@ func MigrationFromFile(file File) (migration *Migration, err error) {
 	migration.Script = string(content)
 	return migration, err
 }
+
+// migrationMarker matches the "-- migrate: <id>" lines which separate the
+// migrations in a stream read by MigrationsFromReader
+var migrationMarker = regexp.MustCompile(`^\s*--\s*migrate:\s*(.*?)\s*$`)
+
+// MigrationsFromReader splits a stream containing several migrations into a
+// slice of Migrations. Each migration begins with a marker line of the form:
+//
+//     -- migrate: 2019-01-01 0900 Create Users
+//
+// The marker text becomes the migration's ID, and the lines which follow it
+// (up to the next marker) become its Script. Any SQL before the first marker
+// is an error, as are blank or repeated IDs.
+//
+func MigrationsFromReader(r io.Reader) (migrations []*Migration, err error) {
+	migrations = make([]*Migration, 0)
+	seen := make(map[string]bool)
+	reader := bufio.NewReader(r)
+
+	var current *Migration
+	var script strings.Builder
+	finish := func() {
+		if current != nil {
+			current.Script = strings.TrimSpace(script.String())
+			migrations = append(migrations, current)
+		}
+		script.Reset()
+	}
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return migrations, fmt.Errorf("failed to read migrations: %w", err)
+		}
+
+		if match := migrationMarker.FindStringSubmatch(line); match != nil {
+			finish()
+			id := match[1]
+			if id == "" || seen[id] {
+				return migrations, fmt.Errorf("invalid or duplicate migration ID '%s'", id)
+			}
+			seen[id] = true
+			current = &Migration{ID: id}
+		} else if current != nil {
+			script.WriteString(line)
+		} else if strings.TrimSpace(line) != "" {
+			return migrations, fmt.Errorf("SQL found before the first '-- migrate: <id>' marker: %s", strings.TrimSpace(line))
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+	finish()
+	return migrations, nil
+}
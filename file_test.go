@@ -3,6 +3,7 @@ package pgxschema
 import (
 	"errors"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -100,3 +101,51 @@ func TestMigrationFromFileWithUnreadableFile(t *testing.T) {
 		t.Error("Expected MigrationFromFile to fail when given erroneous file")
 	}
 }
+
+func TestMigrationsFromReader(t *testing.T) {
+	r := strings.NewReader(`
+-- migrate: 2019-01-01 0900 Create Users
+CREATE TABLE users (id INTEGER NOT NULL PRIMARY KEY);
+
+--migrate:2019-01-03 1000 Create Affiliates
+CREATE TABLE affiliates (
+	id INTEGER NOT NULL PRIMARY KEY
+);
+-- A regular comment stays in the Script
+CREATE INDEX idx_affiliates ON affiliates (id);
+`)
+	migrations, err := MigrationsFromReader(r)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(migrations) != 2 {
+		t.Fatalf("Expected 2 migrations, got %d", len(migrations))
+	}
+	expectID(t, migrations[0], "2019-01-01 0900 Create Users")
+	if migrations[0].Script != "CREATE TABLE users (id INTEGER NOT NULL PRIMARY KEY);" {
+		t.Errorf("Incorrect Script: %s", migrations[0].Script)
+	}
+	expectID(t, migrations[1], "2019-01-03 1000 Create Affiliates")
+	expectScriptMatch(t, migrations[1], `^CREATE TABLE affiliates`)
+	expectScriptMatch(t, migrations[1], `CREATE INDEX idx_affiliates ON affiliates \(id\);$`)
+}
+
+func TestMigrationsFromReaderWithInvalidInput(t *testing.T) {
+	inputs := map[string]string{
+		"SQL before marker": "CREATE TABLE users (id INTEGER);\n-- migrate: 001\nSELECT 1;",
+		"Blank ID":          "-- migrate: \nSELECT 1;",
+		"Duplicate ID":      "-- migrate: 001\nSELECT 1;\n-- migrate: 001\nSELECT 2;",
+	}
+	for name, input := range inputs {
+		_, err := MigrationsFromReader(strings.NewReader(input))
+		if err == nil {
+			t.Errorf("%s: Expected an error", name)
+		}
+	}
+}
+
+func TestMigrationsFromReaderWithUnreadableReader(t *testing.T) {
+	var fr failedReader
+	_, err := MigrationsFromReader(fr)
+	expectErrorContains(t, err, "this reader always fails")
+}
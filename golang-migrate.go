@@ -0,0 +1,67 @@
+//go:build go1.16
+// +build go1.16
+
+package pgxschema
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// golangMigrateFilename matches the filenames used by golang-migrate, e.g.
+// 000001_create_users.up.sql. The submatches are the ID (the version and
+// name) and the direction.
+var golangMigrateFilename = regexp.MustCompile(`^(\d{6,}_.+)\.(up|down)\.sql$`)
+
+// MigrationsFromGolangMigrateDir loads the migrations in a directory laid out
+// for golang-migrate, where each migration is a pair of files named like
+// 000001_create_users.up.sql and 000001_create_users.down.sql. Each migration's
+// ID is its filename without the direction and extension (e.g.
+// "000001_create_users"), so the versions must be zero-padded to the same
+// width to sort correctly. The .up.sql file is the Script. Migrations can't
+// be rolled back, so .down.sql files are ignored, but a .down.sql file without
+// a matching .up.sql file is an error. Files without a .sql extension are
+// ignored.
+func MigrationsFromGolangMigrateDir(fsys fs.FS, dir string) (migrations []*Migration, err error) {
+	migrations = make([]*Migration, 0)
+
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return migrations, fmt.Errorf("failed to read golang-migrate directory '%s': %w", dir, err)
+	}
+
+	ups := make(map[string]bool)
+	downs := make([]string, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".sql") {
+			continue
+		}
+		matches := golangMigrateFilename.FindStringSubmatch(name)
+		if matches == nil {
+			return migrations, fmt.Errorf("'%s' is not named like a golang-migrate migration (e.g. 000001_name.up.sql)", name)
+		}
+		id, direction := matches[1], matches[2]
+		if direction == "down" {
+			downs = append(downs, id)
+			continue
+		}
+
+		data, err := fs.ReadFile(fsys, path.Join(dir, name))
+		if err != nil {
+			return migrations, err
+		}
+		ups[id] = true
+		migrations = append(migrations, &Migration{ID: id, Script: string(data)})
+	}
+
+	for _, id := range downs {
+		if !ups[id] {
+			return migrations, fmt.Errorf("migration '%s' has a .down.sql file, but no .up.sql file", id)
+		}
+	}
+	return migrations, nil
+}
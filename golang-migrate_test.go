@@ -0,0 +1,49 @@
+//go:build go1.16
+// +build go1.16
+
+package pgxschema
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+func TestMigrationsFromGolangMigrateDir(t *testing.T) {
+	fsys := fstest.MapFS{
+		"migrations/000001_create_users.up.sql":    {Data: []byte("CREATE TABLE users (id INTEGER)")},
+		"migrations/000001_create_users.down.sql":  {Data: []byte("DROP TABLE users")},
+		"migrations/000002_add_email.up.sql":       {Data: []byte("ALTER TABLE users ADD COLUMN email TEXT")},
+		"migrations/README.md":                     {Data: []byte("# Migrations")},
+		"migrations/archive/000000_ignored.up.sql": {Data: []byte("SELECT 1")},
+	}
+	migrations, err := MigrationsFromGolangMigrateDir(fsys, "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) != 2 {
+		t.Fatalf("Expected 2 migrations. Got %d", len(migrations))
+	}
+	expectID(t, migrations[0], "000001_create_users")
+	expectID(t, migrations[1], "000002_add_email")
+	if migrations[0].Script != "CREATE TABLE users (id INTEGER)" {
+		t.Errorf("Expected the .up.sql file to be the Script. Got '%s'", migrations[0].Script)
+	}
+}
+
+func TestMigrationsFromGolangMigrateDirErrors(t *testing.T) {
+	table := map[string]fstest.MapFS{
+		"is not named like a golang-migrate migration": {
+			"migrations/1_too_short.up.sql": {Data: []byte("SELECT 1")},
+		},
+		"has a .down.sql file, but no .up.sql file": {
+			"migrations/000001_orphan.down.sql": {Data: []byte("SELECT 1")},
+		},
+		"failed to read golang-migrate directory": {
+			"elsewhere/000001_create_users.up.sql": {Data: []byte("SELECT 1")},
+		},
+	}
+	for expected, fsys := range table {
+		_, err := MigrationsFromGolangMigrateDir(fsys, "migrations")
+		expectErrorContains(t, err, expected)
+	}
+}
@@ -0,0 +1,132 @@
+package pgxschema
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Heartbeat describes the most recent migration run recorded in the
+// coordination table maintained by the WithHeartbeat option
+type Heartbeat struct {
+	// Owner identifies the process which ran the migrations, as
+	// "hostname:pid"
+	Owner string
+
+	// StartedAt is when the run obtained the migration lock
+	StartedAt time.Time
+
+	// HeartbeatAt is when the run last reported that it was still alive
+	HeartbeatAt time.Time
+
+	// FinishedAt is when the run released the lock, or nil if it is still in
+	// progress (or died without finishing)
+	FinishedAt *time.Time
+}
+
+// InProgress reports whether the run appears to still be alive: it hasn't
+// finished, and its last heartbeat is more recent than staleAfter ago. A
+// staleAfter of a few heartbeat intervals is recommended.
+func (h *Heartbeat) InProgress(staleAfter time.Duration) bool {
+	return h.FinishedAt == nil && time.Since(h.HeartbeatAt) < staleAfter
+}
+
+// HeartbeatTableName returns the dialect-quoted fully-qualified name of the
+// coordination table maintained by the WithHeartbeat option
+func (m *Migrator) HeartbeatTableName() string {
+	return QuotedTableName(m.schemaName, m.tableName+"_heartbeat")
+}
+
+// LastHeartbeat reads the most recent migration run from the coordination
+// table maintained by the WithHeartbeat option. It returns nil if no run has
+// been recorded. Processes waiting to migrate can use it to see whether
+// another is migrating, and give up rather than block on the lock
+// indefinitely:
+//
+//	hb, err := migrator.LastHeartbeat(db)
+//	if err == nil && hb != nil && hb.InProgress(3*interval) {
+//		// another process is migrating
+//	}
+func (m *Migrator) LastHeartbeat(db Queryer) (*Heartbeat, error) {
+	rows, err := db.Query(m.ctx, heartbeatSelectSQL(m.HeartbeatTableName()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	hb := Heartbeat{}
+	err = rows.Scan(&hb.Owner, &hb.StartedAt, &hb.HeartbeatAt, &hb.FinishedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &hb, rows.Err()
+}
+
+// startHeartbeat records the start of a migration run in the coordination
+// table, and then updates it every heartbeatInterval until the returned
+// function is called. The updates are made through db outside of the
+// migration transaction, so db must be able to provide another connection
+// (i.e. be a pool). Heartbeat failures are logged rather than returned, since
+// they don't affect the migrations themselves.
+func (m *Migrator) startHeartbeat(db Queryer) (stop func()) {
+	if m.heartbeatInterval <= 0 {
+		return func() {}
+	}
+	if db == nil {
+		m.log("Heartbeat skipped: it requires a connection pool\n")
+		return func() {}
+	}
+
+	tn := m.HeartbeatTableName()
+	_, err := db.Exec(m.ctx, heartbeatCreateSQL(tn))
+	if err == nil {
+		_, err = db.Exec(m.ctx, heartbeatStartSQL(tn), heartbeatOwner())
+	}
+	if err != nil {
+		m.log(fmt.Sprintf("Heartbeat failed to start: %s\n", err))
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(m.heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := db.Exec(m.ctx, heartbeatBeatSQL(tn)); err != nil {
+					m.log(fmt.Sprintf("Heartbeat failed: %s\n", err))
+				}
+			case <-done:
+				// As with unlock, the finish is recorded with a fresh context so
+				// that it is recorded even after the Migrator's has been cancelled
+				ctx, cancel := context.WithTimeout(context.Background(), unlockTimeout)
+				defer cancel()
+				if _, err := db.Exec(ctx, heartbeatFinishSQL(tn)); err != nil {
+					m.log(fmt.Sprintf("Heartbeat failed to finish: %s\n", err))
+				}
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// heartbeatOwner identifies this process in the coordination table
+func heartbeatOwner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
@@ -0,0 +1,116 @@
+package pgxschema
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/pashagolub/pgxmock"
+)
+
+func TestHeartbeatInProgress(t *testing.T) {
+	finishedAt := time.Now()
+	table := map[*Heartbeat]bool{
+		{HeartbeatAt: time.Now()}:                          true,
+		{HeartbeatAt: time.Now().Add(-time.Hour)}:          false,
+		{HeartbeatAt: time.Now(), FinishedAt: &finishedAt}: false,
+	}
+	for hb, expected := range table {
+		if actual := hb.InProgress(time.Minute); actual != expected {
+			t.Errorf("Expected InProgress() to be %t for %+v. Got %t", expected, hb, actual)
+		}
+	}
+}
+
+func TestHeartbeatTableName(t *testing.T) {
+	m := NewMigrator(WithTableName("special", "migrations"))
+	expected := `"special"."migrations_heartbeat"`
+	if actual := m.HeartbeatTableName(); actual != expected {
+		t.Errorf("Expected %s. Got %s", expected, actual)
+	}
+}
+
+func TestStartHeartbeatWithoutPool(t *testing.T) {
+	var logged sliceLog
+	m := NewMigrator(WithLogger(&logged), WithHeartbeat(time.Millisecond))
+	m.startHeartbeat(nil)()
+	if len(logged.msgs) != 1 {
+		t.Errorf("Expected the skipped heartbeat to be logged. Got %v", logged.msgs)
+	}
+}
+
+func TestStartHeartbeat(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^\\s*CREATE TABLE IF NOT EXISTS \"schema_migrations_heartbeat\"").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO \"schema_migrations_heartbeat\"").WithArgs(heartbeatOwner()).WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^UPDATE \"schema_migrations_heartbeat\" SET heartbeat_at = now\\(\\), finished_at = now\\(\\)").WillReturnResult(pgconn.CommandTag{})
+
+	// An interval longer than the test ensures only the start and finish are
+	// recorded
+	m := NewMigrator(WithHeartbeat(time.Hour))
+	m.startHeartbeat(mock)()
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStartHeartbeatFinishesAfterCancel(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^\\s*CREATE TABLE IF NOT EXISTS \"schema_migrations_heartbeat\"").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO \"schema_migrations_heartbeat\"").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^UPDATE \"schema_migrations_heartbeat\" SET heartbeat_at = now\\(\\), finished_at = now\\(\\)").
+		WillDelayFor(50 * time.Millisecond).
+		WillReturnResult(pgconn.CommandTag{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var logged sliceLog
+	m := NewMigrator(WithContext(ctx), WithLogger(&logged), WithHeartbeat(time.Hour))
+	stop := m.startHeartbeat(mock)
+	cancel()
+	stop()
+	if len(logged.msgs) != 0 {
+		t.Errorf("Expected the finish to be recorded despite the cancelled context. Got %v", logged.msgs)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestApplyWithHeartbeat ensures that the coordination table is updated while
+// migrations run, and records when they finished.
+func TestApplyWithHeartbeat(t *testing.T) {
+	withLatestDB(t, func(db *pgxpool.Pool) {
+		migrator := NewMigrator(WithTableName(time.Now().Format(time.RFC3339Nano)), WithHeartbeat(20*time.Millisecond))
+		err := migrator.Apply(db, []*Migration{
+			{ID: "2021-01-01 Slow", Script: "SELECT pg_sleep(0.2)"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hb, err := migrator.LastHeartbeat(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hb == nil {
+			t.Fatal("Expected a heartbeat to be recorded")
+		}
+		if hb.Owner != heartbeatOwner() {
+			t.Errorf("Expected owner %s. Got %s", heartbeatOwner(), hb.Owner)
+		}
+		if hb.FinishedAt == nil || hb.InProgress(time.Hour) {
+			t.Error("Expected the run to be recorded as finished")
+		}
+		if !hb.HeartbeatAt.After(hb.StartedAt) {
+			t.Errorf("Expected heartbeats after the start at %s. Last was %s", hb.StartedAt, hb.HeartbeatAt)
+		}
+	})
+}
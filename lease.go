@@ -0,0 +1,62 @@
+package pgxschema
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// LeaseTableName returns the dialect-quoted fully-qualified name of the
+// coordination table used by RunOnce
+func (m *Migrator) LeaseTableName() string {
+	return QuotedTableName(m.schemaName, m.tableName+"_lease")
+}
+
+// RunOnce applies the migrations after taking a lease on leaseKey, instead of
+// the advisory lock which Apply uses. The lease is a row in a coordination
+// table (see LeaseTableName), so unlike the advisory lock it doesn't belong to
+// a connection. This suits environments like serverless functions and cron
+// jobs, whose connections may be too short-lived to reliably hold a lock.
+//
+// If another runner holds an unexpired lease on the key, ErrLeaseHeld is
+// returned without running anything. The lease is released when the
+// migrations finish, and expires after leaseTTL if its runner dies first, so
+// leaseTTL must be longer than the migrations take to run.
+func (m *Migrator) RunOnce(db Connection, migrations []*Migration, leaseKey string, leaseTTL time.Duration) (err error) {
+	if db == nil {
+		return ErrNilDB
+	}
+	if m.readOnly {
+		return ErrReadOnlyMigrator
+	}
+
+	tn := m.LeaseTableName()
+	_, err = db.Exec(m.ctx, leaseCreateSQL(tn))
+	if err != nil {
+		return err
+	}
+
+	owner := fmt.Sprintf("%s:%d", heartbeatOwner(), time.Now().UnixNano())
+	tag, err := db.Exec(m.ctx, leaseAcquireSQL(tn), leaseKey, owner, leaseTTL.Milliseconds())
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() != 1 {
+		return fmt.Errorf("%w: '%s'", ErrLeaseHeld, leaseKey)
+	}
+	m.log(fmt.Sprintf("Leased '%s' as %s\n", leaseKey, owner))
+
+	defer func() {
+		// As with unlock, the lease is released with a fresh context so that
+		// it is released even after the Migrator's has been cancelled
+		ctx, cancel := context.WithTimeout(context.Background(), unlockTimeout)
+		defer cancel()
+		_, releaseErr := db.Exec(ctx, leaseReleaseSQL(tn), leaseKey, owner)
+		err = joinErrs(err, releaseErr)
+	}()
+
+	mc := *m
+	mc.skipLock = true
+	_, err = mc.apply(db, migrations)
+	return err
+}
@@ -0,0 +1,152 @@
+package pgxschema
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/pashagolub/pgxmock"
+)
+
+func TestRunOnce(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^\\s*CREATE TABLE IF NOT EXISTS \"schema_migrations_lease\"").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO \"schema_migrations_lease\"").
+		WithArgs("deploy", pgxmock.AnyArg(), int64(60000)).
+		WillReturnResult(pgconn.CommandTag("INSERT 0 1"))
+	mock.ExpectBegin()
+	mock.ExpectExec("^\\s*CREATE TABLE IF NOT EXISTS \"schema_migrations\"").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectQuery("^\\s*SELECT COALESCE\\(character_maximum_length").
+		WillReturnRows(pgxmock.NewRows([]string{"width"}).AddRow(int32(32)))
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^SELECT 1").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO \"schema_migrations\"").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectCommit()
+	mock.ExpectExec("^DELETE FROM \"schema_migrations_lease\"").
+		WithArgs("deploy", pgxmock.AnyArg()).
+		WillReturnResult(pgconn.CommandTag("DELETE 1"))
+
+	err = NewMigrator().RunOnce(mock, []*Migration{{ID: "2021-01-01 001", Script: "SELECT 1"}}, "deploy", time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunOnceUsesDialectExtensions(t *testing.T) {
+	// The Dialect's CreateInTablespaceSQL should be used, rather than moving
+	// the table with ALTER TABLE
+	matcher := pgxmock.QueryMatcherFunc(func(expectedSQL, actualSQL string) error {
+		if strings.Contains(actualSQL, "SET TABLESPACE") {
+			return fmt.Errorf("Expected the table to be created in the tablespace. Got:\n%s", actualSQL)
+		}
+		return pgxmock.QueryMatcherRegexp.Match(expectedSQL, actualSQL)
+	})
+	mock, err := pgxmock.NewConn(pgxmock.QueryMatcherOption(matcher))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^\\s*CREATE TABLE IF NOT EXISTS \"schema_migrations_lease\"").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO \"schema_migrations_lease\"").WillReturnResult(pgconn.CommandTag("INSERT 0 1"))
+	mock.ExpectBegin()
+	mock.ExpectExec("TABLESPACE \"metadata\"").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectQuery("^\\s*SELECT COALESCE\\(character_maximum_length").
+		WillReturnRows(pgxmock.NewRows([]string{"width"}).AddRow(int32(32)))
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^SELECT 1").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO \"schema_migrations\"").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectCommit()
+	mock.ExpectExec("^DELETE FROM \"schema_migrations_lease\"").WillReturnResult(pgconn.CommandTag("DELETE 1"))
+
+	migrator := NewMigrator(WithTablespace("metadata"))
+	err = migrator.RunOnce(mock, []*Migration{{ID: "2021-01-01 001", Script: "SELECT 1"}}, "deploy", time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunOnceWhenLeaseHeld(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^\\s*CREATE TABLE IF NOT EXISTS").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO \"schema_migrations_lease\"").WillReturnResult(pgconn.CommandTag("INSERT 0 0"))
+
+	err = NewMigrator().RunOnce(mock, []*Migration{{ID: "2021-01-01 001", Script: "SELECT 1"}}, "deploy", time.Minute)
+	if !errors.Is(err, ErrLeaseHeld) {
+		t.Errorf("Expected %v, got %v", ErrLeaseHeld, err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunOnceReportsReleaseErrors(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^\\s*CREATE TABLE IF NOT EXISTS").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO \"schema_migrations_lease\"").WillReturnResult(pgconn.CommandTag("INSERT 0 1"))
+	mock.ExpectBegin()
+	mock.ExpectExec("^\\s*CREATE TABLE IF NOT EXISTS").WillReturnError(fmt.Errorf("Create Failed"))
+	mock.ExpectRollback()
+	mock.ExpectExec("^DELETE FROM").WillReturnError(fmt.Errorf("Release Failed"))
+
+	err = NewMigrator().RunOnce(mock, []*Migration{{ID: "2021-01-01 001", Script: "SELECT 1"}}, "deploy", time.Minute)
+	expectErrorContains(t, err, "Create Failed")
+	expectErrorContains(t, err, "Release Failed")
+}
+
+func TestRunOnceFailure(t *testing.T) {
+	err := NewMigrator().RunOnce(nil, nil, "deploy", time.Minute)
+	if !errors.Is(err, ErrNilDB) {
+		t.Errorf("Expected %v, got %v", ErrNilDB, err)
+	}
+
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^\\s*CREATE TABLE IF NOT EXISTS").WillReturnError(fmt.Errorf("Create Failed"))
+	err = NewMigrator().RunOnce(mock, nil, "deploy", time.Minute)
+	expectErrorContains(t, err, "Create Failed")
+}
+
+// TestRunOnceReleasesLease ensures that the lease is released after the
+// migrations are applied, so the next runner can take it
+func TestRunOnceReleasesLease(t *testing.T) {
+	withEachDB(t, func(db *pgxpool.Pool) {
+		migrator := makeTestMigrator()
+		migrations := testMigrations(t, "useless-ansi")
+		for i := 0; i < 2; i++ {
+			err := migrator.RunOnce(db, migrations, "deploy", time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var count int
+		err := db.QueryRow(context.Background(), fmt.Sprintf("SELECT COUNT(*) FROM %s", migrator.LeaseTableName())).Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 0 {
+			t.Errorf("Expected the lease to be released. Got %d rows", count)
+		}
+	})
+}
@@ -0,0 +1,178 @@
+package pgxschema
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// LintSeverity ranks how dangerous a LintWarning's finding is
+type LintSeverity int
+
+const (
+	// LintLow findings are worth reviewing, but rarely cause problems
+	LintLow LintSeverity = iota + 1
+
+	// LintMedium findings take locks which can block writes while they run
+	LintMedium
+
+	// LintHigh findings can lose data, rewrite whole tables, or fail on
+	// tables which already have rows
+	LintHigh
+)
+
+// String returns the name of the severity
+func (s LintSeverity) String() string {
+	switch s {
+	case LintLow:
+		return "low"
+	case LintMedium:
+		return "medium"
+	case LintHigh:
+		return "high"
+	}
+	return fmt.Sprintf("LintSeverity(%d)", int(s))
+}
+
+// LintWarning describes a potentially dangerous statement found in a
+// migration by LintMigrations
+type LintWarning struct {
+	MigrationID string
+	Severity    LintSeverity
+	Message     string
+	Statement   string
+}
+
+// String formats the warning for logging
+func (w LintWarning) String() string {
+	return fmt.Sprintf("Migration '%s' [%s]: %s", w.MigrationID, w.Severity, w.Message)
+}
+
+// lintRule flags statements for which matches returns true
+type lintRule struct {
+	severity LintSeverity
+	message  string
+	matches  func(stmt string) bool
+}
+
+var (
+	lintAddColumn        = regexp.MustCompile(`\bADD\s+(COLUMN\s+)?(IF\s+NOT\s+EXISTS\s+)?[^,]*`)
+	lintAddConstraint    = regexp.MustCompile(`^ADD\s+(CONSTRAINT|PRIMARY|UNIQUE|CHECK|FOREIGN|EXCLUDE)\b`)
+	lintNotNull          = regexp.MustCompile(`\bNOT\s+NULL\b`)
+	lintDefault          = regexp.MustCompile(`\bDEFAULT\b`)
+	lintDrop             = regexp.MustCompile(`\bDROP\s+(\S+)`)
+	lintAlterColumnType  = regexp.MustCompile(`\bALTER\s+(COLUMN\s+)?\S+\s+(SET\s+DATA\s+)?TYPE\b`)
+	lintDropTable        = regexp.MustCompile(`^DROP\s+TABLE\b`)
+	lintRewrite          = regexp.MustCompile(`^(VACUUM\s+(\(\s*)?FULL\b|CLUSTER\b)`)
+	lintCreateIndex      = regexp.MustCompile(`^CREATE\s+(UNIQUE\s+)?INDEX\b`)
+	lintConcurrently     = regexp.MustCompile(`\bCONCURRENTLY\b`)
+	lintSetNotNull       = regexp.MustCompile(`\bALTER\s+(COLUMN\s+)?\S+\s+SET\s+NOT\s+NULL\b`)
+	lintRenameIdentifier = regexp.MustCompile(`\bRENAME\s+(COLUMN\s+)?\S+\s+TO\b`)
+)
+
+// lintRules are the heuristics LintMigrations applies to each statement.
+// Statements are upper-cased with their whitespace collapsed before they are
+// matched.
+var lintRules = []lintRule{
+	{
+		severity: LintHigh,
+		message:  "adds a NOT NULL column without a DEFAULT, which fails if the table has rows",
+		matches: func(stmt string) bool {
+			if !strings.HasPrefix(stmt, "ALTER TABLE") {
+				return false
+			}
+			for _, clause := range lintAddColumn.FindAllString(stmt, -1) {
+				if !lintAddConstraint.MatchString(clause) && lintNotNull.MatchString(clause) && !lintDefault.MatchString(clause) {
+					return true
+				}
+			}
+			return false
+		},
+	},
+	{
+		severity: LintHigh,
+		message:  "drops a column, which loses its data and breaks code still reading it",
+		matches: func(stmt string) bool {
+			if !strings.HasPrefix(stmt, "ALTER TABLE") {
+				return false
+			}
+			for _, match := range lintDrop.FindAllStringSubmatch(stmt, -1) {
+				switch match[1] {
+				case "CONSTRAINT", "DEFAULT", "NOT", "IDENTITY", "EXPRESSION":
+					// These drop a property of a table or column rather than
+					// a column itself
+				default:
+					return true
+				}
+			}
+			return false
+		},
+	},
+	{
+		severity: LintHigh,
+		message:  "changes a column's type, which may rewrite the whole table while holding an exclusive lock",
+		matches:  lintAlterColumnType.MatchString,
+	},
+	{
+		severity: LintHigh,
+		message:  "rewrites the whole table while holding an exclusive lock",
+		matches:  lintRewrite.MatchString,
+	},
+	{
+		severity: LintHigh,
+		message:  "drops a table, which loses its data",
+		matches:  lintDropTable.MatchString,
+	},
+	{
+		severity: LintMedium,
+		message:  "creates an index without CONCURRENTLY, which blocks writes to the table while it builds",
+		matches: func(stmt string) bool {
+			return lintCreateIndex.MatchString(stmt) && !lintConcurrently.MatchString(stmt)
+		},
+	},
+	{
+		severity: LintMedium,
+		message:  "sets a column NOT NULL, which scans the whole table while holding an exclusive lock",
+		matches:  lintSetNotNull.MatchString,
+	},
+	{
+		severity: LintLow,
+		message:  "renames a table or column, which breaks code still using the old name",
+		matches: func(stmt string) bool {
+			return strings.HasPrefix(stmt, "ALTER TABLE") && lintRenameIdentifier.MatchString(stmt)
+		},
+	},
+}
+
+// LintMigrations uses heuristics to find potentially dangerous statements in
+// the migrations' Scripts, such as adding a NOT NULL column without a default,
+// dropping a column or rewriting a table. It doesn't need a database
+// connection, so it can be used in unit tests or CI. The warnings can also be
+// enforced during Apply with the WithLintFailOn() option.
+func LintMigrations(migrations []*Migration) []LintWarning {
+	warnings := make([]LintWarning, 0)
+	for _, migration := range migrations {
+		for _, stmt := range splitStatements(migration.Script) {
+			normalized := normalizeForLint(stmt)
+			for _, rule := range lintRules {
+				if rule.matches(normalized) {
+					warnings = append(warnings, LintWarning{
+						MigrationID: migration.ID,
+						Severity:    rule.severity,
+						Message:     rule.message,
+						Statement:   stmt,
+					})
+				}
+			}
+		}
+	}
+	return warnings
+}
+
+// normalizeForLint upper-cases a statement and collapses its whitespace so
+// that lint rules can match it with simple patterns. Leading comments are
+// removed.
+func normalizeForLint(stmt string) string {
+	keyword, rest := nextKeyword(stmt)
+	return strings.Join(strings.Fields(strings.ToUpper(keyword+rest)), " ")
+}
@@ -0,0 +1,93 @@
+package pgxschema
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/pashagolub/pgxmock"
+)
+
+func TestLintMigrations(t *testing.T) {
+	type lintTest struct {
+		script   string
+		expected []LintSeverity
+	}
+	tests := []lintTest{
+		{"CREATE TABLE users (id INTEGER NOT NULL)", nil},
+		{"ALTER TABLE users ADD COLUMN email TEXT NOT NULL", []LintSeverity{LintHigh}},
+		{"alter table users add email text not null", []LintSeverity{LintHigh}},
+		{"ALTER TABLE users ADD COLUMN email TEXT NOT NULL DEFAULT ''", nil},
+		{"ALTER TABLE users ADD COLUMN email TEXT, ADD COLUMN name TEXT NOT NULL", []LintSeverity{LintHigh}},
+		{"ALTER TABLE users ADD CONSTRAINT email_present CHECK (email IS NOT NULL)", nil},
+		{"ALTER TABLE users DROP COLUMN email", []LintSeverity{LintHigh}},
+		{"ALTER TABLE users DROP email", []LintSeverity{LintHigh}},
+		{"ALTER TABLE users DROP CONSTRAINT email_present", nil},
+		{"ALTER TABLE users ALTER COLUMN email DROP DEFAULT", nil},
+		{"ALTER TABLE users ALTER COLUMN email DROP NOT NULL", nil},
+		{"ALTER TABLE users ALTER COLUMN id TYPE BIGINT", []LintSeverity{LintHigh}},
+		{"ALTER TABLE users ALTER id SET DATA TYPE BIGINT", []LintSeverity{LintHigh}},
+		{"ALTER TABLE users ALTER COLUMN email SET NOT NULL", []LintSeverity{LintMedium}},
+		{"VACUUM FULL users", []LintSeverity{LintHigh}},
+		{"CLUSTER users USING users_pkey", []LintSeverity{LintHigh}},
+		{"DROP TABLE users", []LintSeverity{LintHigh}},
+		{"CREATE INDEX users_email ON users (email)", []LintSeverity{LintMedium}},
+		{"CREATE UNIQUE INDEX CONCURRENTLY users_email ON users (email)", nil},
+		{"ALTER TABLE users RENAME COLUMN email TO email_address", []LintSeverity{LintLow}},
+		{"-- DROP TABLE users\nSELECT 1", nil},
+		{"SELECT 'ALTER TABLE users DROP COLUMN email'", nil},
+	}
+	for _, test := range tests {
+		warnings := LintMigrations([]*Migration{{ID: "2021-01-01 Lint", Script: test.script}})
+		if len(warnings) != len(test.expected) {
+			t.Errorf("Expected %d warnings for %q. Got %v", len(test.expected), test.script, warnings)
+			continue
+		}
+		for i, warning := range warnings {
+			if warning.Severity != test.expected[i] {
+				t.Errorf("Expected a %s warning for %q. Got %s", test.expected[i], test.script, warning)
+			}
+			if warning.MigrationID != "2021-01-01 Lint" {
+				t.Errorf("Expected the warning to name the migration. Got '%s'", warning.MigrationID)
+			}
+		}
+	}
+}
+
+func TestLintSeverityString(t *testing.T) {
+	table := map[LintSeverity]string{
+		LintLow:          "low",
+		LintMedium:       "medium",
+		LintHigh:         "high",
+		LintSeverity(42): "LintSeverity(42)",
+	}
+	for severity, expected := range table {
+		if actual := severity.String(); actual != expected {
+			t.Errorf("Expected '%s'. Got '%s'", expected, actual)
+		}
+	}
+}
+
+func TestRunWithLintFailOn(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+
+	var logged sliceLog
+	migrator := NewMigrator(WithLogger(&logged), WithLintFailOn(LintHigh))
+	_, err = migrator.run(mock, []*Migration{
+		{ID: "2021-01-01 Index", Script: "CREATE INDEX users_email ON users (email)"},
+		{ID: "2021-01-02 Drop", Script: "ALTER TABLE users DROP COLUMN email"},
+	}, nil)
+	if !errors.Is(err, ErrLintFailed) {
+		t.Errorf("Expected %v, got %v", ErrLintFailed, err)
+	}
+	expectErrorContains(t, err, "2021-01-02 Drop")
+	if len(logged.msgs) != 1 {
+		t.Errorf("Expected the medium severity finding to be logged. Got %v", logged.msgs)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
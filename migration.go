@@ -1,22 +1,248 @@
 package pgxschema
 
 import (
+	"bufio"
+	"context"
 	"crypto/md5" // #nosec MD5 only being used to fingerprint script contents, not for encryption
 	"fmt"
+	"hash"
+	"io"
+	"regexp"
 	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// ChecksumAlgorithmMD5 is the name recorded in the tracking table's
+// checksum_algorithm column for checksums produced by Migration.MD5.
+const ChecksumAlgorithmMD5 = "md5"
+
+// ChecksumAlgorithmMD5WithID is the name recorded in the tracking table's
+// checksum_algorithm column for checksums produced by Migration.MD5WithID,
+// which are used when the Migrator was created with WithChecksumIncludesID().
+const ChecksumAlgorithmMD5WithID = "md5-id"
+
+// ChecksumAlgorithmMD5Trimmed and ChecksumAlgorithmMD5WithIDTrimmed are the
+// names recorded in the tracking table's checksum_algorithm column for the
+// checksums used when the Migrator was created with
+// WithTrimScriptForChecksum(). They hash the Script without its trailing
+// newlines and spaces.
+const (
+	ChecksumAlgorithmMD5Trimmed       = "md5-trim"
+	ChecksumAlgorithmMD5WithIDTrimmed = "md5-id-trim"
 )
 
+// checksumTrimCutset is the set of trailing characters which are ignored by
+// the trimmed checksum algorithms
+const checksumTrimCutset = "\n\r "
+
+// DefaultIDPattern is used by ParseID to split a migration ID into its version
+// and name. The version is a prefix starting with a digit (optionally after a
+// "v"), and the name is whatever follows the first underscore or space after
+// it, e.g. "v0001" and "create users" for "v0001_create users".
+var DefaultIDPattern = regexp.MustCompile(`^(?P<version>v?[0-9][^_ ]*)[_ ]+(?P<name>.+)$`)
+
+// ParseID splits a migration ID into its version and name with
+// DefaultIDPattern. It returns false if the ID doesn't match the pattern.
+func ParseID(id string) (version string, name string, ok bool) {
+	return parseID(DefaultIDPattern, id)
+}
+
+// parseID splits a migration ID with the "version" and "name" subexpressions
+// of the pattern
+func parseID(pattern *regexp.Regexp, id string) (version string, name string, ok bool) {
+	match := pattern.FindStringSubmatch(id)
+	if match == nil {
+		return "", "", false
+	}
+	if i := pattern.SubexpIndex("version"); i >= 0 {
+		version = match[i]
+	}
+	if i := pattern.SubexpIndex("name"); i >= 0 {
+		name = match[i]
+	}
+	return version, name, true
+}
+
 // Migration is a yet-to-be-run change to the schema. This is the type which
 // is provided to Migrator.Apply to request a schema change.
 type Migration struct {
 	ID     string
 	Script string
+
+	// Data is an optional set of rows to bulk-load via the COPY protocol. When
+	// it is provided, it is applied instead of the Script.
+	Data *DataMigration
+
+	// Verify is an optional SQL query which asserts that the migration achieved
+	// its goal. It is run in the same transaction after the Script, and must
+	// return a row whose first column is truthy (e.g. true or a non-zero
+	// number), otherwise the migration fails.
+	Verify string
+
+	// Func is an optional Go function which performs the migration. When it is
+	// provided and the Script is empty, it is called with the migration
+	// transaction instead of a Script being executed. Since a function's code
+	// can't be hashed, the checksum is computed from FuncVersion instead,
+	// which should be changed whenever the function's behavior is.
+	Func        func(ctx context.Context, tx pgx.Tx) error
+	FuncVersion string
+
+	// Settings are optional run-time parameters (e.g. maintenance_work_mem)
+	// which are set while the migration runs, as with SET LOCAL. Their
+	// previous values are restored afterwards, so they don't affect the
+	// migrations which follow.
+	Settings map[string]string
+
+	// ScriptReader is an optional stream of SQL which is run when the Script
+	// is empty, for scripts too large to hold in memory (e.g. data loads). It
+	// is split into statements which are executed one at a time as they are
+	// read. The checksum is computed while it is read, so it is the same as if
+	// the SQL had been provided as the Script. A reader can only be read once,
+	// so such migrations can't be checked by Validate, and must be provided
+	// with a fresh reader each time Apply is called.
+	ScriptReader io.Reader
+
+	// Group optionally names a set of migrations which Resume applies in a
+	// single transaction, so that either all of them are applied or none
+	// are. Apply runs every migration in one transaction, so it is already
+	// atomic and ignores Group.
+	Group string
+}
+
+// DataMigration is a data-seeding variant of a Migration which copies rows
+// into a table with pgx's CopyFrom rather than executing INSERT statements.
+// This is much faster for seeding large reference tables.
+type DataMigration struct {
+	TableName pgx.Identifier
+	Columns   []string
+	Source    pgx.CopyFromSource
+}
+
+// checksumSource wraps a pgx.CopyFromSource, hashing a serialization of each
+// row as it is read so that a checksum of the copied data can be recorded.
+type checksumSource struct {
+	pgx.CopyFromSource
+	hash hash.Hash
+}
+
+func newChecksumSource(src pgx.CopyFromSource) *checksumSource {
+	return &checksumSource{CopyFromSource: src, hash: md5.New()} // #nosec not using MD5 cryptographically
+}
+
+func (cs *checksumSource) Values() ([]interface{}, error) {
+	values, err := cs.CopyFromSource.Values()
+	if err == nil {
+		fmt.Fprintf(cs.hash, "%v\n", values)
+	}
+	return values, err
+}
+
+// MD5 returns the hex-encoded hash of all rows read so far
+func (cs *checksumSource) MD5() string {
+	return fmt.Sprintf("%x", cs.hash.Sum(nil))
 }
 
 // MD5 computes the MD5 hash of the Script for this migration so that it
 // can be uniquely identified later.
 func (m *Migration) MD5() string {
-	return fmt.Sprintf("%x", md5.Sum([]byte(m.Script))) // #nosec not using MD5 cryptographically
+	return fmt.Sprintf("%x", md5.Sum([]byte(m.checksumContent()))) // #nosec not using MD5 cryptographically
+}
+
+// MD5WithID computes the MD5 hash of the ID and Script for this migration.
+// Unlike MD5, it differs between migrations whose Scripts are identical.
+func (m *Migration) MD5WithID() string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(m.ID+"\n"+m.checksumContent()))) // #nosec not using MD5 cryptographically
+}
+
+// duplicates reports whether other is an exact duplicate of the migration,
+// which MergeMigrations can safely drop. Funcs and ScriptReaders can't be
+// compared, so a migration with either is only a duplicate of itself.
+func (m *Migration) duplicates(other *Migration) bool {
+	if m == other {
+		return true
+	}
+	if m.Func != nil || other.Func != nil || m.ScriptReader != nil || other.ScriptReader != nil {
+		return false
+	}
+	return m.MD5() == other.MD5() && m.Data == other.Data
+}
+
+// isFunc reports whether the migration is performed by its Func rather than
+// its Script
+func (m *Migration) isFunc() bool {
+	return m.Func != nil && m.Script == ""
+}
+
+// isStreamed reports whether the migration's SQL is read from its
+// ScriptReader rather than its Script
+func (m *Migration) isStreamed() bool {
+	return m.ScriptReader != nil && m.Script == "" && m.Data == nil && !m.isFunc()
+}
+
+// checksumContent returns the content which is hashed to compute the
+// migration's checksum: its FuncVersion for Go migrations, otherwise its
+// Script
+func (m *Migration) checksumContent() string {
+	if m.isFunc() {
+		return m.FuncVersion
+	}
+	return m.Script
+}
+
+// checksum computes this migration's checksum with the named algorithm (as
+// recorded in the tracking table's checksum_algorithm column). It returns
+// false if the algorithm is not known.
+func (m *Migration) checksum(algorithm string) (string, bool) {
+	switch algorithm {
+	case ChecksumAlgorithmMD5:
+		return m.MD5(), true
+	case ChecksumAlgorithmMD5WithID:
+		return m.MD5WithID(), true
+	case ChecksumAlgorithmMD5Trimmed:
+		return fmt.Sprintf("%x", md5.Sum([]byte(m.trimmedChecksumContent()))), true // #nosec not using MD5 cryptographically
+	case ChecksumAlgorithmMD5WithIDTrimmed:
+		return fmt.Sprintf("%x", md5.Sum([]byte(m.ID+"\n"+m.trimmedChecksumContent()))), true // #nosec not using MD5 cryptographically
+	}
+	return "", false
+}
+
+// trimmedChecksumContent returns the checksumContent without its trailing
+// newlines and spaces, so that editors adding or removing a final newline
+// don't change the checksum
+func (m *Migration) trimmedChecksumContent() string {
+	return strings.TrimRight(m.checksumContent(), checksumTrimCutset)
+}
+
+// trimRightWriter writes everything written to it to w, except for any
+// trailing characters in its cutset, which are held back until a character
+// outside the cutset follows them. It computes the trimmed checksum of a
+// ScriptReader while it's read.
+type trimRightWriter struct {
+	w       io.Writer
+	cutset  string
+	pending []byte
+}
+
+func (t *trimRightWriter) Write(p []byte) (int, error) {
+	end := len(p)
+	for end > 0 && strings.IndexByte(t.cutset, p[end-1]) >= 0 {
+		end--
+	}
+	if end > 0 {
+		if len(t.pending) > 0 {
+			if _, err := t.w.Write(t.pending); err != nil {
+				return 0, err
+			}
+			t.pending = t.pending[:0]
+		}
+		if _, err := t.w.Write(p[:end]); err != nil {
+			return 0, err
+		}
+	}
+	t.pending = append(t.pending, p[end:]...)
+	return len(p), nil
 }
 
 // SortMigrations sorts a slice of migrations by their IDs
@@ -26,3 +252,167 @@ func SortMigrations(migrations []*Migration) {
 		return migrations[i].ID < migrations[j].ID
 	})
 }
+
+// MergeMigrations concatenates several sets of migrations (for example, ones
+// loaded from multiple embed.FS sources) into a single slice sorted by ID.
+// Exact duplicates are only included once, but an error is returned if two
+// migrations share an ID and differ in their Script (or FuncVersion, or
+// Data). Func and ScriptReader migrations can't be compared, so two different
+// ones sharing an ID are a conflict too.
+func MergeMigrations(sets ...[]*Migration) (merged []*Migration, err error) {
+	merged = make([]*Migration, 0)
+	byID := make(map[string]*Migration)
+	for _, set := range sets {
+		for _, migration := range set {
+			existing, exists := byID[migration.ID]
+			if !exists {
+				byID[migration.ID] = migration
+				merged = append(merged, migration)
+				continue
+			}
+			if !existing.duplicates(migration) {
+				return merged, fmt.Errorf("%w: '%s'", ErrConflictingMigrations, migration.ID)
+			}
+		}
+	}
+	SortMigrations(merged)
+	return merged, nil
+}
+
+// ChecksumsEqual reports whether two sets of migrations have the same IDs and
+// the same checksum for each ID. If they don't, the sorted IDs which are
+// missing from either set or whose checksums differ are returned. This is
+// useful for verifying that a change to how migrations are generated did not
+// change the migrations themselves. Data migrations are compared by their
+// Script only, since their rows aren't known until they are copied.
+func ChecksumsEqual(a, b []*Migration) (bool, []string) {
+	checksumsA := checksumsByID(a)
+	checksumsB := checksumsByID(b)
+
+	differing := make([]string, 0)
+	for id, checksum := range checksumsA {
+		if other, exists := checksumsB[id]; !exists || other != checksum {
+			differing = append(differing, id)
+		}
+	}
+	for id := range checksumsB {
+		if _, exists := checksumsA[id]; !exists {
+			differing = append(differing, id)
+		}
+	}
+	sort.Strings(differing)
+	return len(differing) == 0, differing
+}
+
+// checksumsByID maps each migration's ID to its checksum
+func checksumsByID(migrations []*Migration) map[string]string {
+	checksums := make(map[string]string, len(migrations))
+	for _, migration := range migrations {
+		checksums[migration.ID] = migration.MD5()
+	}
+	return checksums
+}
+
+// lockfileChecksums maps each migration's ID to its checksum, as
+// checksumsByID does, but returns an error wrapping ErrChecksumUnavailable
+// for Data and ScriptReader migrations, whose content isn't read until they
+// are applied
+func lockfileChecksums(migrations []*Migration) (map[string]string, error) {
+	for _, migration := range migrations {
+		if !migration.isFunc() && (migration.Data != nil || migration.isStreamed()) {
+			return nil, fmt.Errorf("%w: '%s'", ErrChecksumUnavailable, migration.ID)
+		}
+	}
+	return checksumsByID(migrations), nil
+}
+
+// WriteLockfile writes the checksum of each migration to w, one line per
+// migration sorted by ID, in the form "<checksum>  <id>". Committing the
+// result (e.g. as migrations.lock) alongside the migrations lets
+// VerifyLockfile detect a migration which was changed without the lockfile
+// being updated. Data and ScriptReader migrations can't be included, so an
+// error wrapping ErrChecksumUnavailable is returned if there are any.
+func WriteLockfile(migrations []*Migration, w io.Writer) error {
+	checksums, err := lockfileChecksums(migrations)
+	if err != nil {
+		return err
+	}
+	ids := make([]string, 0, len(checksums))
+	for id := range checksums {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		_, err := fmt.Fprintf(w, "%s  %s\n", checksums[id], id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FingerprintMigrations returns a hash of the IDs and checksums of all the
+// migrations, which changes whenever a migration is added, removed, renamed or
+// edited. It doesn't depend on the order of the migrations, so CI or a deploy
+// can compare it to a previous value to detect any change to the set. It's the
+// MD5 of the migrations' lockfile (see WriteLockfile), so as with the lockfile
+// an error wrapping ErrChecksumUnavailable is returned for Data and
+// ScriptReader migrations.
+func FingerprintMigrations(migrations []*Migration) (string, error) {
+	hash := md5.New() // #nosec not using MD5 cryptographically
+	err := WriteLockfile(migrations, hash)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// VerifyLockfile reads a lockfile written by WriteLockfile from r and checks
+// that the migrations match it. If any migration's checksum differs from the
+// one recorded, or a migration is missing from either side, an error wrapping
+// ErrLockfileMismatch which lists every problem is returned. As with
+// WriteLockfile, Data and ScriptReader migrations aren't supported.
+func VerifyLockfile(migrations []*Migration, r io.Reader) error {
+	locked := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		parts := strings.SplitN(text, "  ", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return fmt.Errorf("invalid lockfile line %d: %s", line, text)
+		}
+		locked[parts[1]] = parts[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read lockfile: %w", err)
+	}
+
+	checksums, err := lockfileChecksums(migrations)
+	if err != nil {
+		return err
+	}
+	problems := make([]string, 0)
+	for id, checksum := range checksums {
+		expected, exists := locked[id]
+		if !exists {
+			problems = append(problems, fmt.Sprintf("migration '%s' is not in the lockfile", id))
+		} else if expected != checksum {
+			problems = append(problems, fmt.Sprintf("migration '%s' has checksum %s, but the lockfile has %s", id, checksum, expected))
+		}
+	}
+	for id := range locked {
+		if _, exists := checksums[id]; !exists {
+			problems = append(problems, fmt.Sprintf("migration '%s' is in the lockfile, but is missing", id))
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("%w: %s", ErrLockfileMismatch, strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -1,8 +1,18 @@
 package pgxschema
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5" // #nosec MD5 only being used to fingerprint script contents, not for encryption
+	"errors"
+	"fmt"
+	"io"
 	"regexp"
+	"strings"
 	"testing"
+	"testing/iotest"
+
+	"github.com/jackc/pgx/v4"
 )
 
 func TestMD5(t *testing.T) {
@@ -16,6 +26,70 @@ func TestMD5(t *testing.T) {
 	}
 }
 
+func TestMD5WithID(t *testing.T) {
+	a := Migration{ID: "2021-01-01 Seed A", Script: "SELECT 1"}
+	b := Migration{ID: "2021-01-01 Seed B", Script: "SELECT 1"}
+	expected := fmt.Sprintf("%x", md5.Sum([]byte("2021-01-01 Seed A\nSELECT 1"))) // #nosec not using MD5 cryptographically
+	if a.MD5WithID() != expected {
+		t.Errorf("Expected hash '%s', got '%s'", expected, a.MD5WithID())
+	}
+	if a.MD5WithID() == b.MD5WithID() {
+		t.Error("Expected migrations with different IDs to have different checksums")
+	}
+}
+
+func TestTrimmedChecksumsIgnoreTrailingNewlines(t *testing.T) {
+	a := Migration{ID: "2021-01-01 001", Script: "SELECT 1;\n"}
+	b := Migration{ID: "2021-01-01 001", Script: "SELECT 1;\r\n\n  "}
+	c := Migration{ID: "2021-01-01 001", Script: "SELECT  1;"}
+	if a.MD5() == b.MD5() {
+		t.Error("Expected the untrimmed checksums to differ")
+	}
+	for _, algorithm := range []string{ChecksumAlgorithmMD5Trimmed, ChecksumAlgorithmMD5WithIDTrimmed} {
+		checksumA, knownA := a.checksum(algorithm)
+		checksumB, knownB := b.checksum(algorithm)
+		checksumC, _ := c.checksum(algorithm)
+		if !knownA || !knownB || checksumA != checksumB {
+			t.Errorf("Expected %s checksums of scripts differing only by trailing newlines to match. Got '%s' and '%s'", algorithm, checksumA, checksumB)
+		}
+		if checksumA == checksumC {
+			t.Errorf("Expected %s checksums of scripts differing by other whitespace to differ", algorithm)
+		}
+	}
+	trimmed, _ := a.checksum(ChecksumAlgorithmMD5Trimmed)
+	if expected := fmt.Sprintf("%x", md5.Sum([]byte("SELECT 1;"))); trimmed != expected { // #nosec not using MD5 cryptographically
+		t.Errorf("Expected hash '%s', got '%s'", expected, trimmed)
+	}
+}
+
+func TestTrimRightWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := &trimRightWriter{w: &out, cutset: checksumTrimCutset}
+	for _, chunk := range []string{"SELECT 1;\n", "\n", "SELECT 2; ", "\r\n", "\n"} {
+		n, err := w.Write([]byte(chunk))
+		if err != nil || n != len(chunk) {
+			t.Fatalf("Expected to write %d bytes. Got %d, %v", len(chunk), n, err)
+		}
+	}
+	if out.String() != "SELECT 1;\n\nSELECT 2;" {
+		t.Errorf("Expected only the trailing whitespace to be held back. Got %q", out.String())
+	}
+}
+
+func TestMD5WithFunc(t *testing.T) {
+	fn := func(ctx context.Context, tx pgx.Tx) error { return nil }
+	m := Migration{ID: "2021-01-01 Backfill", Func: fn, FuncVersion: "v1"}
+	expected := fmt.Sprintf("%x", md5.Sum([]byte("v1"))) // #nosec not using MD5 cryptographically
+	if m.MD5() != expected {
+		t.Errorf("Expected the FuncVersion to be hashed. Expected '%s', got '%s'", expected, m.MD5())
+	}
+
+	m.Script = "SELECT 1"
+	if m.MD5() != fmt.Sprintf("%x", md5.Sum([]byte("SELECT 1"))) { // #nosec not using MD5 cryptographically
+		t.Error("Expected the Script to be hashed when it is provided")
+	}
+}
+
 func TestSortMigrations(t *testing.T) {
 	migrations := []*Migration{
 		{ID: "2020-01-01"},
@@ -31,6 +105,110 @@ func TestSortMigrations(t *testing.T) {
 	}
 }
 
+func TestChecksumSource(t *testing.T) {
+	src := newChecksumSource(pgx.CopyFromRows([][]interface{}{
+		{1, "Alpha"},
+		{2, "Beta"},
+	}))
+	for src.Next() {
+		if _, err := src.Values(); err != nil {
+			t.Error(err)
+		}
+	}
+	expected := fmt.Sprintf("%x", md5.Sum([]byte("[1 Alpha]\n[2 Beta]\n"))) // #nosec not using MD5 cryptographically
+	if src.MD5() != expected {
+		t.Errorf("Expected checksum '%s', got '%s'", expected, src.MD5())
+	}
+}
+
+func TestMergeMigrations(t *testing.T) {
+	library := []*Migration{
+		{ID: "2021-01-01 Library", Script: "CREATE TABLE library (id INTEGER)"},
+		{ID: "2020-01-01 Shared", Script: "CREATE TABLE shared (id INTEGER)"},
+	}
+	app := []*Migration{
+		{ID: "2020-01-01 Shared", Script: "CREATE TABLE shared (id INTEGER)"},
+		{ID: "2022-01-01 App", Script: "CREATE TABLE app (id INTEGER)"},
+	}
+	merged, err := MergeMigrations(library, app)
+	if err != nil {
+		t.Error(err)
+	}
+	expectedOrder := []string{"2020-01-01 Shared", "2021-01-01 Library", "2022-01-01 App"}
+	if len(merged) != len(expectedOrder) {
+		t.Fatalf("Expected %d merged migrations, got %d", len(expectedOrder), len(merged))
+	}
+	for i, migration := range merged {
+		expectID(t, migration, expectedOrder[i])
+	}
+}
+
+func TestMergeMigrationsWithConflictingScripts(t *testing.T) {
+	_, err := MergeMigrations(
+		[]*Migration{{ID: "2020-01-01 Shared", Script: "CREATE TABLE shared (id INTEGER)"}},
+		[]*Migration{{ID: "2020-01-01 Shared", Script: "CREATE TABLE shared (id BIGINT)"}},
+	)
+	if !errors.Is(err, ErrConflictingMigrations) {
+		t.Errorf("Expected %v, got %v", ErrConflictingMigrations, err)
+	}
+	expectErrorContains(t, err, "2020-01-01 Shared")
+}
+
+func TestMergeMigrationsWithConflictingFuncsAndReaders(t *testing.T) {
+	fn := func(ctx context.Context, tx pgx.Tx) error { return nil }
+	for name, pair := range map[string][2]*Migration{
+		"FuncVersion": {
+			{ID: "2020-01-01 Shared", Func: fn, FuncVersion: "1"},
+			{ID: "2020-01-01 Shared", Func: fn, FuncVersion: "2"},
+		},
+		"Func": {
+			{ID: "2020-01-01 Shared", Func: fn, FuncVersion: "1"},
+			{ID: "2020-01-01 Shared", Func: fn, FuncVersion: "1"},
+		},
+		"ScriptReader": {
+			{ID: "2020-01-01 Shared", ScriptReader: strings.NewReader("SELECT 1")},
+			{ID: "2020-01-01 Shared", ScriptReader: strings.NewReader("SELECT 2")},
+		},
+	} {
+		_, err := MergeMigrations([]*Migration{pair[0]}, []*Migration{pair[1]})
+		if !errors.Is(err, ErrConflictingMigrations) {
+			t.Errorf("Expected different %s migrations to conflict. Got %v", name, err)
+		}
+	}
+
+	shared := &Migration{ID: "2020-01-01 Shared", Func: fn, FuncVersion: "1"}
+	merged, err := MergeMigrations([]*Migration{shared}, []*Migration{shared})
+	if err != nil || len(merged) != 1 {
+		t.Errorf("Expected the same Func migration to be merged once. Got %d, %v", len(merged), err)
+	}
+}
+
+func TestChecksumsEqual(t *testing.T) {
+	equal, differing := ChecksumsEqual(unorderedMigrations(), unorderedMigrations())
+	if !equal || len(differing) != 0 {
+		t.Errorf("Expected identical sets to be equal. Got differing IDs %v", differing)
+	}
+
+	a := []*Migration{
+		{ID: "2021-01-01 001", Script: "SELECT 1"},
+		{ID: "2021-01-01 002", Script: "SELECT 2"},
+		{ID: "2021-01-01 003", Script: "SELECT 3"},
+	}
+	b := []*Migration{
+		{ID: "2021-01-01 004", Script: "SELECT 4"},
+		{ID: "2021-01-01 002", Script: "SELECT 2 -- changed"},
+		{ID: "2021-01-01 001", Script: "SELECT 1"},
+	}
+	equal, differing = ChecksumsEqual(a, b)
+	if equal {
+		t.Error("Expected differing sets not to be equal")
+	}
+	expected := fmt.Sprint([]string{"2021-01-01 002", "2021-01-01 003", "2021-01-01 004"})
+	if fmt.Sprint(differing) != expected {
+		t.Errorf("Expected differing IDs %s. Got %v", expected, differing)
+	}
+}
+
 func unorderedMigrations() []*Migration {
 	return []*Migration{
 		{
@@ -69,3 +247,127 @@ func expectScriptMatch(t *testing.T, migration *Migration, regexpString string)
 		t.Errorf("Expected migration Script to match '%s', but it did not. Script was:\n%s", regexpString, migration.Script)
 	}
 }
+
+func TestWriteAndVerifyLockfile(t *testing.T) {
+	migrations := []*Migration{
+		{ID: "2021-01-01 002 Second", Script: "SELECT 2"},
+		{ID: "2021-01-01 001 First", Script: "SELECT 1"},
+	}
+	var lockfile bytes.Buffer
+	err := WriteLockfile(migrations, &lockfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf("%s  2021-01-01 001 First\n%s  2021-01-01 002 Second\n", migrations[1].MD5(), migrations[0].MD5())
+	if lockfile.String() != expected {
+		t.Errorf("Expected lockfile:\n%s\nGot:\n%s", expected, lockfile.String())
+	}
+
+	err = VerifyLockfile(migrations, strings.NewReader(lockfile.String()))
+	if err != nil {
+		t.Errorf("Expected the migrations to match their own lockfile. Got %v", err)
+	}
+
+	changed := []*Migration{
+		{ID: "2021-01-01 002 Second", Script: "SELECT 2 -- changed"},
+		{ID: "2021-01-01 003 Third", Script: "SELECT 3"},
+	}
+	err = VerifyLockfile(changed, strings.NewReader(lockfile.String()))
+	if !errors.Is(err, ErrLockfileMismatch) {
+		t.Errorf("Expected %v, got %v", ErrLockfileMismatch, err)
+	}
+	expectErrorContains(t, err, "'2021-01-01 001 First' is in the lockfile, but is missing")
+	expectErrorContains(t, err, "'2021-01-01 002 Second' has checksum")
+	expectErrorContains(t, err, "'2021-01-01 003 Third' is not in the lockfile")
+}
+
+func TestFingerprintMigrations(t *testing.T) {
+	fingerprint, err := FingerprintMigrations(unorderedMigrations())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fingerprint) != 32 {
+		t.Errorf("Expected a 32 character fingerprint. Got '%s'", fingerprint)
+	}
+
+	reversed := unorderedMigrations()
+	for i, j := 0, len(reversed)-1; i < j; i, j = i+1, j-1 {
+		reversed[i], reversed[j] = reversed[j], reversed[i]
+	}
+	if other, _ := FingerprintMigrations(reversed); other != fingerprint {
+		t.Error("Expected the fingerprint not to depend on the order of the migrations")
+	}
+
+	edited := unorderedMigrations()
+	edited[0].Script += " -- edited"
+	renamed := unorderedMigrations()
+	renamed[0].ID += " renamed"
+	for name, migrations := range map[string][]*Migration{
+		"edited":  edited,
+		"renamed": renamed,
+		"removed": unorderedMigrations()[1:],
+		"added":   append(unorderedMigrations(), &Migration{ID: "2021-01-01 999", Script: "SELECT 1"}),
+	} {
+		if other, _ := FingerprintMigrations(migrations); other == fingerprint {
+			t.Errorf("Expected the fingerprint to change when a migration is %s", name)
+		}
+	}
+}
+
+func TestLockfileWithUnchecksummableMigrations(t *testing.T) {
+	for name, migration := range map[string]*Migration{
+		"data":     {ID: "2021-01-01 001", Data: &DataMigration{TableName: pgx.Identifier{"users"}}},
+		"streamed": {ID: "2021-01-01 001", ScriptReader: strings.NewReader("SELECT 1")},
+	} {
+		err := WriteLockfile([]*Migration{migration}, io.Discard)
+		if !errors.Is(err, ErrChecksumUnavailable) {
+			t.Errorf("Expected %v writing the lockfile for a %s migration, got %v", ErrChecksumUnavailable, name, err)
+		}
+		err = VerifyLockfile([]*Migration{migration}, strings.NewReader(""))
+		if !errors.Is(err, ErrChecksumUnavailable) {
+			t.Errorf("Expected %v verifying a %s migration, got %v", ErrChecksumUnavailable, name, err)
+		}
+		_, err = FingerprintMigrations([]*Migration{migration})
+		if !errors.Is(err, ErrChecksumUnavailable) {
+			t.Errorf("Expected %v fingerprinting a %s migration, got %v", ErrChecksumUnavailable, name, err)
+		}
+	}
+}
+
+func TestVerifyLockfileWithInvalidLockfile(t *testing.T) {
+	err := VerifyLockfile(nil, strings.NewReader("not-a-lockfile-line\n"))
+	expectErrorContains(t, err, "invalid lockfile line 1")
+
+	err = VerifyLockfile(nil, iotest.ErrReader(fmt.Errorf("FAIL: read")))
+	expectErrorContains(t, err, "FAIL: read")
+}
+
+func TestParseID(t *testing.T) {
+	table := []struct {
+		id, version, name string
+		ok                bool
+	}{
+		{"v0001_create users", "v0001", "create users", true},
+		{"0001_create_users", "0001", "create_users", true},
+		{"2019-01-01 0900 Create Users", "2019-01-01", "0900 Create Users", true},
+		{"create_users", "", "", false},
+		{"0001", "", "", false},
+	}
+	for _, tc := range table {
+		version, name, ok := ParseID(tc.id)
+		if version != tc.version || name != tc.name || ok != tc.ok {
+			t.Errorf("Expected '%s' to parse as ('%s', '%s', %t). Got ('%s', '%s', %t)", tc.id, tc.version, tc.name, tc.ok, version, name, ok)
+		}
+	}
+}
+
+func TestMigratorParseIDWithIDPattern(t *testing.T) {
+	migrator := NewMigrator(WithIDPattern(regexp.MustCompile(`^(?P<version>\d{14})-(?P<name>.+)$`)))
+	version, name, ok := migrator.ParseID("20220101090000-create-users")
+	if !ok || version != "20220101090000" || name != "create-users" {
+		t.Errorf("Expected the custom pattern to be used. Got ('%s', '%s', %t)", version, name, ok)
+	}
+	if _, _, ok = migrator.ParseID("0001_create_users"); ok {
+		t.Error("Expected an ID not matching the custom pattern not to parse")
+	}
+}
@@ -1,9 +1,25 @@
 package pgxschema
 
 import (
-	"context" // #nosec MD5 not being used cryptographically
+	"context"
+	"crypto/md5" // #nosec MD5 not being used cryptographically
+	"crypto/subtle"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
 )
 
 // DefaultTableName defines the name of the database table which will
@@ -29,9 +45,191 @@ type Migrator struct {
 	// option, the DefaultTableName (schema_migrations) will be used instead.
 	tableName string
 
-	// lockID is the identifier for the Postgres global advisory lock
-	// this value is computed from the TableName when the migrator is created
-	lockID int64
+	// buildVersion and buildCommit are recorded with each applied migration.
+	// See WithBuildInfo.
+	buildVersion string
+	buildCommit  string
+
+	// rowScanner and scanColumns customize how AppliedMigrations are read
+	// from the tracking table. See WithRowScanner.
+	rowScanner  RowScanner
+	scanColumns []string
+
+	// dialect generates the locking and table creation SQL. It is the
+	// Postgres dialect unless customized via the WithDialect() option.
+	dialect Dialect
+
+	// notices routes NOTICE and WARNING messages raised while a migration is
+	// running to the Logger. It is nil unless WithCaptureNotices is used.
+	notices *noticeRouter
+
+	// explainCallback receives the EXPLAIN (FORMAT JSON) plan of each DML
+	// statement in a migration before it runs. See WithExplainCallback.
+	explainCallback func(id, sql, planJSON string)
+
+	// dropInvalidIndexes causes RepairConcurrentIndexes to drop the invalid
+	// indexes it finds rather than just reporting them.
+	dropInvalidIndexes bool
+
+	// preserveOrder causes migrations to be run in the order provided rather
+	// than being sorted by ID. See WithPreserveOrder.
+	preserveOrder bool
+
+	// minServerVersion is the minimum major PostgreSQL version Apply will run
+	// against. See WithMinServerVersion.
+	minServerVersion int
+
+	// requiredExtensions are installed (if they aren't already) before the
+	// migrations are run. See WithRequiredExtensions.
+	requiredExtensions []string
+
+	// planValidator is given the chance to veto the computed plan before any
+	// migrations are run. See WithPlanValidator.
+	planValidator func(plan []*Migration) error
+
+	// allowTransactionControl disables the check which rejects migrations
+	// containing BEGIN, COMMIT or similar. See WithAllowTransactionControl.
+	allowTransactionControl bool
+
+	// baselineVersion is the ID at or below which migrations are assumed to
+	// have already been applied. See WithBaselineVersion.
+	baselineVersion string
+
+	// lintFailOn is the LintSeverity at or above which a LintMigrations
+	// finding in the plan aborts Apply. See WithLintFailOn.
+	lintFailOn LintSeverity
+
+	// held keeps the connection used by the most recent successful Apply. It
+	// is nil unless WithHoldConnection is used.
+	held *heldConnection
+
+	// onError decides how a failed migration is handled when running via
+	// ApplyInteractive. It is nil otherwise.
+	onError func(m *Migration, err error) Decision
+
+	// afterRun is invoked with the migration transaction after the plan has
+	// run, before it is committed, when running via ApplyThen.
+	afterRun func(ctx context.Context, tx pgx.Tx) error
+
+	// applyTimeout bounds the duration of each Apply call. See
+	// WithApplyTimeout.
+	applyTimeout time.Duration
+
+	// serverQuoted caches the tracking table's name as quoted by the server.
+	// It is nil unless WithServerSideQuoting is used.
+	serverQuoted *serverQuotedName
+
+	// onLockWait is called when the lock is held by another process, before
+	// waiting for it. See WithOnLockWait.
+	onLockWait func()
+
+	// singleVersion causes the tracking table to hold only the ID of the most
+	// recently applied migration. See WithSingleVersionMode.
+	singleVersion bool
+
+	// logPlan causes the pending migrations to be logged before any are run.
+	// See WithLogPlan.
+	logPlan bool
+
+	// syntaxCheck causes the plan to be dry-run before it is run. See
+	// WithSyntaxCheck.
+	syntaxCheck bool
+
+	// events receives a MigrationEvent as Apply progresses. See
+	// WithEventChannel.
+	events chan<- MigrationEvent
+
+	// notifyChannel receives a notification, when the migration transaction
+	// commits, if any migrations were run. See WithNotifyChannel.
+	notifyChannel string
+
+	// lockRetryAttempts and lockRetryBackoff control how statements which fail
+	// because a lock wasn't available are retried. See WithMigrationLockRetry.
+	lockRetryAttempts int
+	lockRetryBackoff  time.Duration
+
+	// store records which migrations have been applied, instead of the
+	// tracking table. See WithStore.
+	store Store
+
+	// idPattern splits migration IDs into their version and name. See
+	// WithIDPattern.
+	idPattern *regexp.Regexp
+
+	// deferredConstraints defers constraint checks until the migration
+	// transaction commits. See WithDeferredConstraints.
+	deferredConstraints bool
+
+	// role is the role the migration transaction switches to. See WithRole.
+	role string
+
+	// readOnly prevents the Migrator from changing the database. See
+	// WithReadOnly.
+	readOnly bool
+
+	// recordFailures records failed migrations in the failures table. See
+	// WithRecordFailures.
+	recordFailures bool
+
+	// healthCheck is a query which must return a truthy value after each
+	// migration. See WithHealthCheck.
+	healthCheck string
+
+	// scriptTransform produces the SQL which is executed for each Script. See
+	// WithScriptTransform.
+	scriptTransform func(m *Migration, script string) (string, error)
+
+	// expectedDatabase is the name of the database Apply must be connected
+	// to. See WithExpectedDatabase.
+	expectedDatabase string
+
+	// vacuumTables are vacuumed after migrations are committed. See
+	// WithPostApplyVacuum.
+	vacuumTables []string
+
+	// caseInsensitiveIDs causes IDs which differ only by case to be treated
+	// as duplicates. See WithCaseInsensitiveIDs.
+	caseInsensitiveIDs bool
+
+	// tablespace is the tablespace the tracking table is kept in. It is blank
+	// unless WithTablespace is used.
+	tablespace string
+
+	// ordinalColumn causes an ordinal column to be added to the tracking table
+	// and populated for each migration applied. See WithOrdinalColumn.
+	ordinalColumn bool
+
+	// checksumSigner signs each recorded checksum, so that Validate can detect
+	// tampering with the tracking table. See WithChecksumSigner.
+	checksumSigner func(checksum string) string
+
+	// checksumIncludesID causes checksums to hash each migration's ID as well
+	// as its Script. See WithChecksumIncludesID.
+	checksumIncludesID bool
+
+	// trimScriptForChecksum causes checksums to ignore trailing newlines and
+	// spaces. See WithTrimScriptForChecksum.
+	trimScriptForChecksum bool
+
+	// heartbeatInterval is how often the coordination table is updated while
+	// migrations are running. It is zero unless WithHeartbeat is used.
+	heartbeatInterval time.Duration
+
+	// appliedAtSource selects the clock which provides each migration's
+	// applied_at time. See WithAppliedAtSource.
+	appliedAtSource AppliedAtSource
+
+	// timingLog causes Apply to log how long each of its phases took. See
+	// WithTimingLog.
+	timingLog bool
+
+	// tableOutsideTx causes the tracking table to be created (and committed)
+	// before the migration transaction begins. See WithTableOutsideTransaction.
+	tableOutsideTx bool
+
+	// skipLock causes lock and unlock to do nothing. RunOnce sets it on its
+	// copy of the Migrator, since its lease excludes other runners instead.
+	skipLock bool
 
 	// ctx holds the context in which the migrator is running.
 	ctx context.Context
@@ -42,161 +240,2533 @@ type Migrator struct {
 func NewMigrator(options ...Option) *Migrator {
 	m := Migrator{
 		tableName: DefaultTableName,
+		dialect:   Postgres,
 		ctx:       context.Background(),
 	}
 	for _, opt := range options {
 		m = opt(m)
 	}
-	m.lockID = LockIdentifierForTable(m.tableName)
 	return &m
 }
 
+// NewMigratorE creates a new Migrator with the supplied options, but unlike
+// NewMigrator it validates the resulting configuration and returns an error
+// when it could not produce valid SQL (e.g. a table name consisting only of
+// spaces or semicolons).
+func NewMigratorE(options ...Option) (*Migrator, error) {
+	m := NewMigrator(options...)
+	if IsBlankIdent(m.tableName) {
+		return nil, fmt.Errorf("%w: '%s'", ErrBlankTableName, m.tableName)
+	}
+	if m.schemaName != "" && IsBlankIdent(m.schemaName) {
+		return nil, fmt.Errorf("%w: '%s'", ErrBlankSchemaName, m.schemaName)
+	}
+	err := m.checkTableOutsideTx()
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // QuotedTableName returns the dialect-quoted fully-qualified name for the
 // migrations tracking table
 func (m *Migrator) QuotedTableName() string {
+	if quoted := m.serverQuoted.get(); quoted != "" {
+		return quoted
+	}
 	return QuotedTableName(m.schemaName, m.tableName)
 }
 
 // Apply takes a slice of Migrations and applies any which have not yet
-// been applied
-func (m *Migrator) Apply(db Connection, migrations []*Migration) error {
+// been applied. ApplyOptions (e.g. WithCallLogger) customize the Migrator for
+// this call only.
+func (m *Migrator) Apply(db Connection, migrations []*Migration, opts ...ApplyOption) error {
+	if len(opts) > 0 {
+		mc := *m
+		for _, opt := range opts {
+			mc = opt(mc)
+		}
+		m = &mc
+	}
+	_, err := m.apply(db, migrations)
+	return err
+}
+
+// ApplyContext behaves like Apply, but uses the provided context instead of
+// the one provided via WithContext. Cancelling it aborts the Apply, which
+// then returns an error wrapping ErrApplyCancelled.
+func (m *Migrator) ApplyContext(ctx context.Context, db Connection, migrations []*Migration) error {
+	mc := *m
+	mc.ctx = ctx
+	return mc.Apply(db, migrations)
+}
+
+// ApplyWithSignalHandling behaves like ApplyContext, with a context which is
+// cancelled when the process receives one of the provided signals (SIGINT
+// or SIGTERM if none are provided), so that an Apply in progress during a
+// shutdown is rolled back cleanly rather than killed. Once it returns, the
+// signals are handled as they were before.
+func (m *Migrator) ApplyWithSignalHandling(db Connection, migrations []*Migration, signals ...os.Signal) error {
+	if len(signals) == 0 {
+		signals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+	ctx, stop := signal.NotifyContext(m.ctx, signals...)
+	defer stop()
+	return m.ApplyContext(ctx, db, migrations)
+}
+
+// ApplyReportingChanges behaves like Apply, but additionally reports whether
+// any migrations were applied by this call. It returns false if the database
+// was already up to date.
+func (m *Migrator) ApplyReportingChanges(db Connection, migrations []*Migration) (changed bool, err error) {
+	count, err := m.apply(db, migrations)
+	return count > 0, err
+}
+
+// ParseID splits a migration ID into its version and name with the pattern
+// provided via WithIDPattern, or DefaultIDPattern if none was. It returns
+// false if the ID doesn't match the pattern.
+func (m *Migrator) ParseID(id string) (version string, name string, ok bool) {
+	if m.idPattern == nil {
+		return ParseID(id)
+	}
+	return parseID(m.idPattern, id)
+}
+
+// Resume applies the migrations like Apply, except that each migration is
+// applied and committed in its own transaction. Every migration which
+// succeeds is therefore a checkpoint: if a long set of migrations is
+// interrupted (or one fails), those which were committed stay applied, and
+// calling Resume again continues with the first one which wasn't. The number
+// of migrations which were already applied is logged before starting.
+//
+// Migrations which share a Group are applied together in one transaction
+// instead, so either all of them are applied or none are. The members of a
+// Group must be consecutive once the migrations are ordered.
+//
+// Since each migration (or Group) is applied separately, options which
+// inspect the whole plan (such as WithPlanValidator or WithLogPlan) see one
+// at a time, and a failure only rolls back the one which failed.
+func (m *Migrator) Resume(db Connection, migrations []*Migration) error {
+	if db == nil {
+		return ErrNilDB
+	}
+	if m.readOnly {
+		return ErrReadOnlyMigrator
+	}
+
+	ordered := append([]*Migration(nil), migrations...)
+	if !m.preserveOrder {
+		SortMigrations(ordered)
+	}
+	batches, err := groupMigrations(ordered)
+	if err != nil {
+		return err
+	}
+
+	pending, err := m.PendingCount(db, migrations)
+	if err != nil {
+		return err
+	}
+	m.log(fmt.Sprintf("Resuming: %d of %d migrations were already applied\n", len(migrations)-pending, len(migrations)))
+
+	for _, batch := range batches {
+		_, err = m.apply(db, batch)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// groupMigrations splits the ordered migrations into the batches Resume
+// applies in separate transactions: each consecutive run of migrations which
+// share a Group, and each migration without one
+func groupMigrations(ordered []*Migration) ([][]*Migration, error) {
+	batches := make([][]*Migration, 0, len(ordered))
+	finished := make(map[string]bool)
+	for i, migration := range ordered {
+		if i > 0 && migration.Group != "" && migration.Group == ordered[i-1].Group {
+			batches[len(batches)-1] = append(batches[len(batches)-1], migration)
+			continue
+		}
+		if finished[migration.Group] {
+			return nil, fmt.Errorf("%w: '%s' (at migration '%s')", ErrSplitGroup, migration.Group, migration.ID)
+		}
+		if migration.Group != "" {
+			finished[migration.Group] = true
+		}
+		batches = append(batches, []*Migration{migration})
+	}
+	return batches, nil
+}
+
+// Decision is returned by the onError callback of ApplyInteractive to choose
+// what happens to a migration which failed
+type Decision int
+
+const (
+	// Abort stops applying migrations. The transaction is rolled back and the
+	// migration's error is returned.
+	Abort Decision = iota
+
+	// Retry runs the failed migration again
+	Retry
+
+	// Skip leaves the failed migration unapplied (it remains pending) and
+	// continues with the next one
+	Skip
+)
+
+// ApplyInteractive behaves like Apply, but runs each migration inside a
+// savepoint. When one fails, its changes are rolled back to the savepoint and
+// onError is called to decide whether to Retry it, Skip it and continue, or
+// Abort. This enables interactive tooling which lets an operator respond to
+// failures as they happen.
+func (m *Migrator) ApplyInteractive(db Connection, migrations []*Migration, onError func(m *Migration, err error) Decision) error {
+	mc := *m
+	mc.onError = onError
+	_, err := mc.apply(db, migrations)
+	return err
+}
+
+// ApplyThen behaves like Apply, but after the pending migrations have run it
+// invokes fn with the migration transaction, before that transaction is
+// committed. This allows work such as seeding data to be atomic with the
+// schema changes: if fn returns an error, everything is rolled back. fn is
+// called even when there are no pending migrations.
+func (m *Migrator) ApplyThen(db Connection, migrations []*Migration, fn func(ctx context.Context, tx pgx.Tx) error) error {
+	mc := *m
+	mc.afterRun = fn
+	_, err := mc.apply(db, migrations)
+	return err
+}
+
+// TrialApply runs the pending migrations exactly as Apply would, but always
+// rolls back the transaction afterwards, so neither the migrations' changes nor
+// the tracking table are persisted. It returns the first error a migration
+// encountered, which makes it useful for catching runtime SQL errors before a
+// real deploy. The migration lock is held while it runs.
+func (m *Migrator) TrialApply(db Connection, migrations []*Migration) (err error) {
 	if db == nil {
 		return ErrNilDB
 	}
+	if m.readOnly {
+		return ErrReadOnlyMigrator
+	}
 
 	if len(migrations) == 0 {
 		return nil
 	}
 
-	err := m.lock(db)
+	db, release, err := m.acquire(db)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	err = m.checkServerVersion(db)
+	if err != nil {
+		return err
+	}
+
+	err = m.checkDatabase(db)
+	if err != nil {
+		return err
+	}
+
+	err = m.lock(db)
 	if err != nil {
 		return err
 	}
-	defer func() { err = coalesceErrs(err, m.unlock(db)) }()
+	defer func() { err = joinErrs(err, m.unlock(db)) }()
 
 	tx, err := db.Begin(m.ctx)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		err = joinErrs(err, tx.Rollback(m.ctx))
+		m.log("Trial apply rolled back at ", time.Now().Format(time.RFC3339Nano))
+	}()
+
+	err = m.setRole(tx)
+	if err != nil {
+		return err
+	}
 
+	// The tracking table is always created inside the transaction, even with
+	// WithTableOutsideTransaction, so that it is rolled back too.
 	err = m.createMigrationsTable(tx)
 	if err != nil {
-		_ = tx.Rollback(m.ctx)
 		return err
 	}
 
-	err = m.run(tx, migrations)
+	err = m.checkChecksumColumn(tx)
 	if err != nil {
-		_ = tx.Rollback(m.ctx)
 		return err
 	}
 
-	err = tx.Commit(m.ctx)
+	err = m.installExtensions(tx)
+	if err != nil {
+		return err
+	}
+
+	err = m.deferConstraints(tx)
+	if err != nil {
+		return err
+	}
 
+	_, err = m.run(tx, migrations, nil)
+	if err == nil && m.deferredConstraints {
+		// The trial is rolled back rather than committed, so the deferred
+		// constraints must be checked explicitly
+		_, err = tx.Exec(m.ctx, "SET CONSTRAINTS ALL IMMEDIATE")
+	}
 	return err
 }
 
-func (m *Migrator) lock(db Queryer) error {
-	query := fmt.Sprintf(`SELECT pg_advisory_lock(%d)`, m.lockID)
-	_, err := db.Exec(m.ctx, query)
-	if err == nil {
-		m.log("Locked at ", time.Now().Format(time.RFC3339Nano))
+// ApplyWithBootstrap applies any pending bootstrap migrations before applying
+// migrations as Apply does. Bootstrap migrations are for statements which
+// PostgreSQL refuses to run inside a transaction block (e.g. CREATE INDEX
+// CONCURRENTLY or some CREATE EXTENSION scripts), so each one runs and is
+// recorded in the tracking table directly against db, without a transaction.
+// They always complete before any of the transactional migrations begin.
+// Bootstrap migrations aren't supported by the CockroachDB dialect.
+func (m *Migrator) ApplyWithBootstrap(db Connection, bootstrap, migrations []*Migration) error {
+	if db == nil {
+		return ErrNilDB
 	}
+	err := m.bootstrap(db, bootstrap)
+	if err != nil {
+		return err
+	}
+	_, err = m.apply(db, migrations)
 	return err
 }
 
-func (m *Migrator) createMigrationsTable(tx Queryer) error {
-	tn := QuotedTableName(m.schemaName, m.tableName)
-	query := fmt.Sprintf(`
-				CREATE TABLE IF NOT EXISTS %s (
-					id VARCHAR(255) NOT NULL,
-					checksum VARCHAR(32) NOT NULL DEFAULT '',
-					execution_time_in_millis INTEGER NOT NULL DEFAULT 0,
-					applied_at TIMESTAMP WITH TIME ZONE NOT NULL
-				)
-			`, tn)
-	_, err := tx.Exec(m.ctx, query)
+// bootstrap applies the pending migrations outside of a transaction. Because
+// each migration commits as it completes, a failure leaves the migrations
+// before it applied and recorded.
+func (m *Migrator) bootstrap(db Connection, migrations []*Migration) (err error) {
+	if len(migrations) == 0 {
+		return nil
+	}
+	if m.readOnly {
+		return ErrReadOnlyMigrator
+	}
+	// The CockroachDB lock is the SELECT ... FOR UPDATE in CreateSQL, which
+	// would be autocommitted (releasing the lock at once) without a
+	// transaction.
+	if _, cockroach := m.dialect.(cockroachDialect); cockroach {
+		return ErrBootstrapUnsupported
+	}
+
+	db, release, err := m.acquire(db)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	err = m.checkServerVersion(db)
+	if err != nil {
+		return err
+	}
+
+	err = m.checkDatabase(db)
+	if err != nil {
+		return err
+	}
+
+	err = m.lock(db)
+	if err != nil {
+		return err
+	}
+	defer func() { err = joinErrs(err, m.unlock(db)) }()
+
+	err = m.createMigrationsTable(db)
+	if err != nil {
+		return err
+	}
+
+	// Bootstrap migrations don't run inside a transaction, so they are free
+	// to manage their own.
+	mc := *m
+	mc.allowTransactionControl = true
+	_, err = mc.run(db, migrations, nil)
 	return err
 }
 
-func (m *Migrator) unlock(db Queryer) error {
-	query := fmt.Sprintf(`SELECT pg_advisory_unlock(%d)`, m.lockID)
-	_, err := db.Exec(m.ctx, query)
-	if err == nil {
-		m.log("Unlocked at ", time.Now().Format(time.RFC3339Nano))
+// ApplyToAll applies the same migrations to each of the provided databases,
+// running Apply on at most parallelism of them at a time (a parallelism below
+// 1 is treated as 1). Each database is locked and migrated in its own
+// transaction, so a failure on one does not affect the others. The returned
+// slice holds the error (or nil) for each database, aligned by index with dbs.
+func (m *Migrator) ApplyToAll(dbs []Connection, migrations []*Migration, parallelism int) []error {
+	if parallelism < 1 {
+		parallelism = 1
 	}
-	return err
+	errs := make([]error, len(dbs))
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i := range dbs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = m.Apply(dbs[i], migrations)
+		}(i)
+	}
+	wg.Wait()
+	return errs
 }
 
-func (m *Migrator) run(tx Queryer, migrations []*Migration) error {
-	if tx == nil {
-		return ErrNilTx
+// apply performs the work of Apply, returning the number of migrations which
+// were applied and committed.
+func (m *Migrator) apply(db Connection, migrations []*Migration) (count int, err error) {
+	if db == nil {
+		return 0, ErrNilDB
+	}
+	if m.readOnly {
+		return 0, ErrReadOnlyMigrator
+	}
+	// The tracking table has no unique key on id (a rolled back migration gets
+	// a row for each attempt), so duplicates must be caught before any are run
+	// or recorded.
+	err = m.ValidateMigrations(migrations)
+	if err != nil {
+		return 0, err
 	}
 
-	plan, err := m.computeMigrationPlan(tx, migrations)
+	if len(migrations) == 0 {
+		return 0, nil
+	}
+
+	started := time.Now()
+	defer func() {
+		m.emit(MigrationEvent{Type: EventCompleted, Duration: time.Since(started), Err: err})
+	}()
+
+	if m.applyTimeout > 0 {
+		ctx, cancel := context.WithTimeout(m.ctx, m.applyTimeout)
+		defer cancel()
+		mc := *m
+		mc.ctx = ctx
+		m = &mc
+	}
+	defer func() { err = m.cancelled(err) }()
+
+	conn, release, err := m.acquire(db)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	for _, migration := range plan {
-		err := m.runMigration(tx, migration)
+	// The heartbeat is written through the pool on a different connection,
+	// since the acquired one is busy with the migration transaction
+	var heartbeatDB Queryer
+	if _, ok := db.(Acquirer); ok {
+		heartbeatDB = db
+	}
+
+	count, err = m.applyTo(conn, heartbeatDB, migrations)
+	if err == nil && m.held != nil {
+		if pooled, ok := conn.(*pgxpool.Conn); ok {
+			m.held.hold(pooled)
+			return count, nil
+		}
+	}
+	release()
+	return count, err
+}
+
+// applyTo applies the migrations using a single connection. If heartbeatDB is
+// not nil, it is used to maintain the WithHeartbeat coordination table.
+func (m *Migrator) applyTo(db Connection, heartbeatDB Queryer, migrations []*Migration) (count int, err error) {
+	err = m.checkTableOutsideTx()
+	if err != nil {
+		return 0, err
+	}
+
+	err = m.checkServerVersion(db)
+	if err != nil {
+		return 0, err
+	}
+
+	err = m.checkDatabase(db)
+	if err != nil {
+		return 0, err
+	}
+
+	var timer *phaseTimer
+	if m.timingLog {
+		timer = &phaseTimer{}
+		defer func() { m.log(timer.String()) }()
+	}
+
+	started := time.Now()
+	err = m.lock(db)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { err = joinErrs(err, m.unlock(db)) }()
+	defer m.startHeartbeat(heartbeatDB)()
+	timer.record("lock", started)
+
+	started = time.Now()
+	if m.tableOutsideTx {
+		err = m.createMigrationsTable(db)
 		if err != nil {
-			return err
+			return 0, err
 		}
 	}
 
-	return nil
-}
+	tx, err := db.Begin(m.ctx)
+	if err != nil {
+		return 0, err
+	}
 
-func (m *Migrator) computeMigrationPlan(db Queryer, toRun []*Migration) (plan []*Migration, err error) {
-	applied, err := m.GetAppliedMigrations(db)
+	err = m.setRole(tx)
 	if err != nil {
-		return plan, err
+		_ = tx.Rollback(m.ctx)
+		return 0, err
 	}
-	plan = make([]*Migration, 0)
-	for _, migration := range toRun {
-		if _, exists := applied[migration.ID]; !exists {
-			plan = append(plan, migration)
+
+	if !m.tableOutsideTx {
+		err = m.createMigrationsTable(tx)
+		if err != nil {
+			_ = tx.Rollback(m.ctx)
+			return 0, err
 		}
 	}
-	SortMigrations(plan)
-	return plan, err
-}
+	timer.record("create", started)
 
-func (m *Migrator) runMigration(tx Queryer, migration *Migration) error {
-	startedAt := time.Now()
-	_, err := tx.Exec(m.ctx, migration.Script)
+	err = m.checkChecksumColumn(tx)
 	if err != nil {
-		return fmt.Errorf("migration '%s' Failed: %w", migration.ID, err)
+		_ = tx.Rollback(m.ctx)
+		return 0, err
 	}
 
-	executionTime := time.Since(startedAt)
-	m.log(fmt.Sprintf("Migration '%s' applied in %s\n", migration.ID, executionTime))
+	err = m.installExtensions(tx)
+	if err != nil {
+		_ = tx.Rollback(m.ctx)
+		return 0, err
+	}
 
-	tn := QuotedTableName(m.schemaName, m.tableName)
-	query := fmt.Sprintf(`
-				INSERT INTO %s
-				( id, checksum, execution_time_in_millis, applied_at )
-				VALUES
-				( $1, $2, $3, $4 )
-				`,
-		tn,
-	)
-	_, err = tx.Exec(m.ctx, query, migration.ID, migration.MD5(), executionTime.Milliseconds(), startedAt)
-	return err
-}
+	err = m.deferConstraints(tx)
+	if err != nil {
+		_ = tx.Rollback(m.ctx)
+		return 0, err
+	}
 
-func (m *Migrator) log(msgs ...interface{}) {
-	if m.Logger != nil {
-		m.Logger.Print(msgs...)
+	count, err = m.run(tx, migrations, timer)
+	if err != nil {
+		_ = tx.Rollback(m.ctx)
+		m.recordFailure(db, err)
+		return 0, err
 	}
-}
 
-func coalesceErrs(errs ...error) error {
-	for _, err := range errs {
+	if m.afterRun != nil {
+		err = m.afterRun(m.ctx, tx)
 		if err != nil {
-			return err
+			_ = tx.Rollback(m.ctx)
+			return 0, err
 		}
 	}
-	return nil
+
+	err = tx.Commit(m.ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	if count > 0 && len(m.vacuumTables) > 0 {
+		started = time.Now()
+		m.vacuum(db)
+		timer.record("vacuum", started)
+	}
+
+	return count, nil
+}
+
+// vacuum runs VACUUM (ANALYZE) on each of the tables provided via
+// WithPostApplyVacuum. VACUUM can't run inside a transaction, so it must be
+// called after the migration transaction has committed. Failures are logged
+// rather than returned, since the migrations have already been committed.
+func (m *Migrator) vacuum(db Queryer) {
+	for _, table := range m.vacuumTables {
+		name := QuotedIdent(table)
+		if i := strings.Index(table, "."); i >= 0 {
+			name = QuotedTableName(table[:i], table[i+1:])
+		}
+		_, err := db.Exec(m.ctx, "VACUUM (ANALYZE) "+name)
+		if err != nil {
+			m.log(fmt.Sprintf("VACUUM of %s failed: %s\n", name, err))
+			continue
+		}
+		m.log(fmt.Sprintf("Vacuumed %s\n", name))
+	}
+}
+
+// PendingCount returns the number of the provided migrations which have not
+// yet been applied. It only reads the applied IDs from the tracking table, so
+// it is cheap enough to call periodically (e.g. to populate a metrics gauge).
+// If the tracking table hasn't been created yet, every migration is pending.
+func (m *Migrator) PendingCount(db Queryer, migrations []*Migration) (int, error) {
+	if db == nil {
+		return 0, ErrNilDB
+	}
+	isApplied, err := m.appliedFilter(db)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == undefinedTable {
+		isApplied, err = func(id string) bool { return false }, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, migration := range migrations {
+		if !isApplied(migration.ID) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// IsApplied reports whether the migration with the provided ID has been
+// applied (and not rolled back). Unlike GetAppliedMigrations, it doesn't read
+// the whole tracking table. If the tracking table hasn't been created yet, no
+// migration has been applied.
+func (m *Migrator) IsApplied(db Queryer, id string) (bool, error) {
+	if db == nil {
+		return false, ErrNilDB
+	}
+	err := m.resolveQuoting(db)
+	if err != nil {
+		return false, err
+	}
+
+	var applied bool
+	if m.singleVersion || m.store != nil {
+		var isApplied func(id string) bool
+		isApplied, err = m.appliedFilter(db)
+		applied = err == nil && isApplied(id)
+	} else {
+		query := fmt.Sprintf("SELECT EXISTS(SELECT 1 FROM %s WHERE id = $1 AND rolled_back_at IS NULL)", m.QuotedTableName())
+		applied, err = m.queryBool(m.ctx, db, query, id)
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == undefinedTable {
+		return false, nil
+	}
+	return applied, err
+}
+
+// TrackingInfo reports whether the tracking table exists and, if it does, how
+// many migrations it records as applied (and not rolled back). Unlike the
+// other read methods, it doesn't fail when the table doesn't exist, so it
+// suits health checks and diagnostics. It returns ErrUnsupportedWithStore
+// when a custom Store was provided via WithStore.
+func (m *Migrator) TrackingInfo(db Queryer) (exists bool, count int, err error) {
+	if db == nil {
+		return false, 0, ErrNilDB
+	}
+	if m.store != nil {
+		return false, 0, ErrUnsupportedWithStore
+	}
+	err = m.resolveQuoting(db)
+	if err != nil {
+		return false, 0, err
+	}
+
+	tn := m.QuotedTableName()
+	exists, err = m.queryBool(m.ctx, db, "SELECT to_regclass($1) IS NOT NULL", tn)
+	if err != nil || !exists {
+		return false, 0, err
+	}
+
+	query := fmt.Sprintf("SELECT COUNT(DISTINCT id) FROM %s WHERE rolled_back_at IS NULL", tn)
+	if m.singleVersion {
+		query = fmt.Sprintf("SELECT COUNT(*) FROM %s", tn)
+	}
+	rows, err := db.Query(m.ctx, query)
+	if err != nil {
+		return true, 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		err = rows.Scan(&count)
+		if err != nil {
+			return true, 0, err
+		}
+	}
+	return true, count, rows.Err()
+}
+
+// BlockingInfo describes a session which is blocking a migrator, as reported
+// by BlockingQueries
+type BlockingInfo struct {
+	// PID is the process ID of the blocking session, which can be passed to
+	// pg_cancel_backend or pg_terminate_backend
+	PID int32
+
+	// Query is the blocking session's current (or most recent) query, and
+	// State is its state, e.g. "idle in transaction"
+	Query string
+	State string
+
+	// BlockedPID is the process ID of the migrator session it is blocking,
+	// and Waited is how long that session's current query has been running
+	BlockedPID int32
+	Waited     time.Duration
+}
+
+// BlockingQueries reports the sessions which are blocking a migrator: those
+// holding the advisory lock which another migrator is waiting for, and those
+// holding a lock which the migrator holding the advisory lock is waiting for
+// (e.g. a long transaction on a table being altered). It is intended for
+// diagnosing an Apply which seems to hang.
+func (m *Migrator) BlockingQueries(db Queryer) ([]BlockingInfo, error) {
+	if db == nil {
+		return nil, ErrNilDB
+	}
+	rows, err := db.Query(m.ctx, blockingQueriesSQL(), LockIdentifierForTable(m.tableName))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blocking := make([]BlockingInfo, 0)
+	for rows.Next() {
+		var info BlockingInfo
+		var waitedMillis int64
+		err = rows.Scan(&info.PID, &info.Query, &info.State, &info.BlockedPID, &waitedMillis)
+		if err != nil {
+			return nil, err
+		}
+		info.Waited = time.Duration(waitedMillis) * time.Millisecond
+		blocking = append(blocking, info)
+	}
+	return blocking, rows.Err()
+}
+
+// PlanToTarget returns the provided migrations which are pending, up to and
+// including the one with targetID, in the order Apply would run them. Nothing
+// is run, so it can be used to preview what a deploy will do. If the target
+// has already been applied, the plan is empty. If the tracking table hasn't
+// been created yet, every migration is pending.
+func (m *Migrator) PlanToTarget(db Queryer, migrations []*Migration, targetID string) ([]*Migration, error) {
+	if db == nil {
+		return nil, ErrNilDB
+	}
+	found := false
+	for _, migration := range migrations {
+		if migration.ID == targetID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: '%s'", ErrUnknownTarget, targetID)
+	}
+
+	plan, err := m.computeMigrationPlan(db, migrations)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == undefinedTable {
+		plan = append([]*Migration{}, migrations...)
+		if !m.preserveOrder {
+			SortMigrations(plan)
+		}
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i, migration := range plan {
+		if migration.ID == targetID {
+			return plan[:i+1], nil
+		}
+	}
+	return []*Migration{}, nil
+}
+
+// WithinReadTx calls fn with a read-only, REPEATABLE READ transaction, so that
+// the read methods it calls with it (e.g. GetAppliedMigrations, PendingCount
+// and Validate) all see the same snapshot of the tracking table. The
+// transaction is always rolled back afterwards.
+func (m *Migrator) WithinReadTx(db Transactor, fn func(tx Queryer) error) (err error) {
+	if db == nil {
+		return ErrNilDB
+	}
+	tx, err := db.Begin(m.ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { err = joinErrs(err, tx.Rollback(m.ctx)) }()
+
+	_, err = tx.Exec(m.ctx, "SET TRANSACTION ISOLATION LEVEL REPEATABLE READ, READ ONLY")
+	if err != nil {
+		return err
+	}
+	return fn(tx)
+}
+
+// OutOfOrderMigrations returns the provided migrations which are pending, but
+// whose IDs sort before the highest applied ID, in the order Apply would run
+// them. Apply still runs them, but after migrations with later IDs, which may
+// be worth logging or investigating.
+func (m *Migrator) OutOfOrderMigrations(db Queryer, migrations []*Migration) ([]*Migration, error) {
+	if db == nil {
+		return nil, ErrNilDB
+	}
+	applied, err := m.appliedIDs(db)
+	if err != nil {
+		return nil, err
+	}
+
+	latest := ""
+	for id := range applied {
+		if id > latest {
+			latest = id
+		}
+	}
+
+	outOfOrder := make([]*Migration, 0)
+	for _, migration := range migrations {
+		if _, exists := applied[migration.ID]; !exists && migration.ID < latest {
+			outOfOrder = append(outOfOrder, migration)
+		}
+	}
+	if !m.preserveOrder {
+		SortMigrations(outOfOrder)
+	}
+	return outOfOrder, nil
+}
+
+// ValidateMigrations checks that no two of the provided migrations share an
+// ID, returning an error wrapping ErrDuplicateIDs which lists every duplicate
+// if they do. When the Migrator was created with the WithCaseInsensitiveIDs()
+// option, IDs which differ only by case are duplicates too. Apply performs
+// the same check before running any migrations.
+func (m *Migrator) ValidateMigrations(migrations []*Migration) error {
+	duplicates := m.duplicateIDs(migrations)
+	if len(duplicates) > 0 {
+		return fmt.Errorf("%w: %s", ErrDuplicateIDs, strings.Join(duplicates, "; "))
+	}
+	return nil
+}
+
+// duplicateIDs describes each set of the migrations which share an ID, in the
+// order of their IDs
+func (m *Migrator) duplicateIDs(migrations []*Migration) []string {
+	byKey := make(map[string][]string)
+	keys := make([]string, 0)
+	for _, migration := range migrations {
+		key := migration.ID
+		if m.caseInsensitiveIDs {
+			key = strings.ToLower(key)
+		}
+		if _, exists := byKey[key]; !exists {
+			keys = append(keys, key)
+		}
+		byKey[key] = append(byKey[key], migration.ID)
+	}
+	sort.Strings(keys)
+
+	duplicates := make([]string, 0)
+	for _, key := range keys {
+		if ids := byKey[key]; len(ids) > 1 {
+			duplicates = append(duplicates, "'"+strings.Join(ids, "' and '")+"'")
+		}
+	}
+	return duplicates
+}
+
+// Validate checks that the migrations which have been applied to the database
+// still match the provided ones. Drift is reported (as an error wrapping
+// ErrDrift which lists every problem) when an applied migration's recorded
+// checksum differs from the checksum of the provided Script, or when an
+// applied migration is missing from the provided ones. Data migrations can't
+// be verified without copying their rows, nor migrations with a ScriptReader
+// without reading it, so they are skipped. Migrations which are pending are
+// not considered drift.
+func (m *Migrator) Validate(db Queryer, migrations []*Migration) error {
+	if db == nil {
+		return ErrNilDB
+	}
+	applied, err := m.GetAppliedMigrations(db)
+	if err != nil {
+		return err
+	}
+
+	provided := make(map[string]*Migration, len(migrations))
+	for _, migration := range migrations {
+		provided[migration.ID] = migration
+	}
+
+	ids := make([]string, 0, len(applied))
+	for id := range applied {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	problems := make([]string, 0)
+	for _, id := range ids {
+		record := applied[id]
+		if record.RolledBackAt != nil {
+			continue
+		}
+		if m.checksumSigner != nil {
+			signature := m.checksumSigner(record.Checksum)
+			if subtle.ConstantTimeCompare([]byte(signature), []byte(record.ChecksumSignature)) != 1 {
+				problems = append(problems, fmt.Sprintf("migration '%s' has an invalid checksum signature", id))
+			}
+		}
+		migration, exists := provided[id]
+		if !exists {
+			problems = append(problems, fmt.Sprintf("migration '%s' was applied, but is missing", id))
+			continue
+		}
+		if migration.Data != nil || migration.isStreamed() {
+			continue
+		}
+		expected, known := migration.checksum(record.ChecksumAlgorithm)
+		if !known {
+			problems = append(problems, fmt.Sprintf("migration '%s' has unknown checksum algorithm '%s'", id, record.ChecksumAlgorithm))
+			continue
+		}
+		if expected != record.Checksum {
+			problems = append(problems, fmt.Sprintf("migration '%s' was applied with checksum %s, but its Script's is %s", id, record.Checksum, expected))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrDrift, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// MigrationStatus describes a migration for DetailedStatus. It covers both
+// the provided migrations and those recorded in the tracking table.
+type MigrationStatus struct {
+	ID string
+
+	// State summarizes the fields below as a single value
+	State MigrationState
+
+	// Pending is true if the migration was provided, but hasn't been applied
+	// (or has been marked as rolled back since it was)
+	Pending bool
+
+	// Missing is true if the migration has been applied, but wasn't provided
+	Missing bool
+
+	// AppliedAt is when the migration was applied. It is zero if Pending.
+	AppliedAt time.Time
+
+	// StoredChecksum is the checksum recorded in the tracking table when the
+	// migration was applied. ExpectedChecksum is the checksum of the provided
+	// migration, computed with the same algorithm. ChecksumMatches reports
+	// whether they are equal. It is always true for Data migrations and
+	// migrations with a ScriptReader, which can't be checked without copying
+	// their rows or reading their SQL, and false for Missing migrations.
+	StoredChecksum   string
+	ExpectedChecksum string
+	ChecksumMatches  bool
+}
+
+// DetailedStatus reports the status of each of the provided migrations, and
+// of each applied migration which wasn't provided, sorted by ID. It is
+// intended for dashboards and tooling which show whether the migrations
+// applied to a database still match the ones provided. If the tracking table
+// doesn't exist yet, every migration is pending.
+func (m *Migrator) DetailedStatus(db Queryer, migrations []*Migration) ([]MigrationStatus, error) {
+	if db == nil {
+		return nil, ErrNilDB
+	}
+	applied, err := m.GetAppliedMigrations(db)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == undefinedTable {
+		applied, err = map[string]*AppliedMigration{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provided := make(map[string]*Migration, len(migrations))
+	for _, migration := range migrations {
+		provided[migration.ID] = migration
+	}
+
+	statuses := make([]MigrationStatus, 0, len(provided))
+	for id, migration := range provided {
+		record, exists := applied[id]
+		if !exists {
+			statuses = append(statuses, MigrationStatus{ID: id, State: StatePending, Pending: true})
+			continue
+		}
+		if record.RolledBackAt != nil {
+			statuses = append(statuses, MigrationStatus{ID: id, State: StateRolledBack, Pending: true})
+			continue
+		}
+		status := MigrationStatus{
+			ID:              id,
+			State:           StateApplied,
+			AppliedAt:       record.AppliedAt,
+			StoredChecksum:  record.Checksum,
+			ChecksumMatches: migration.Data != nil || migration.isStreamed(),
+		}
+		if !status.ChecksumMatches {
+			status.ExpectedChecksum, _ = migration.checksum(record.ChecksumAlgorithm)
+			status.ChecksumMatches = status.ExpectedChecksum == record.Checksum
+		}
+		if !status.ChecksumMatches {
+			status.State = StateDrifted
+		}
+		statuses = append(statuses, status)
+	}
+	for id, record := range applied {
+		if _, exists := provided[id]; exists || record.RolledBackAt != nil {
+			continue
+		}
+		statuses = append(statuses, MigrationStatus{
+			ID:             id,
+			State:          StateOrphaned,
+			Missing:        true,
+			AppliedAt:      record.AppliedAt,
+			StoredChecksum: record.Checksum,
+		})
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].ID < statuses[j].ID
+	})
+	return statuses, nil
+}
+
+// CompareWith compares the migrations applied to two databases (e.g. staging
+// and production), which is useful to verify that they match before promoting
+// a build. It returns the IDs of the migrations applied only to dbA, those
+// applied only to dbB, and those applied to both but recorded with different
+// checksums, each sorted. Migrations marked as rolled back are ignored.
+func (m *Migrator) CompareWith(dbA, dbB Queryer) (onlyInA, onlyInB []string, checksumDiffs []string, err error) {
+	if dbA == nil || dbB == nil {
+		return nil, nil, nil, ErrNilDB
+	}
+	appliedA, err := m.currentlyApplied(dbA)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("reading applied migrations from dbA: %w", err)
+	}
+	appliedB, err := m.currentlyApplied(dbB)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("reading applied migrations from dbB: %w", err)
+	}
+
+	onlyInA, onlyInB, checksumDiffs = []string{}, []string{}, []string{}
+	for id, a := range appliedA {
+		b, exists := appliedB[id]
+		if !exists {
+			onlyInA = append(onlyInA, id)
+		} else if a.Checksum != b.Checksum || a.ChecksumAlgorithm != b.ChecksumAlgorithm {
+			checksumDiffs = append(checksumDiffs, id)
+		}
+	}
+	for id := range appliedB {
+		if _, exists := appliedA[id]; !exists {
+			onlyInB = append(onlyInB, id)
+		}
+	}
+	sort.Strings(onlyInA)
+	sort.Strings(onlyInB)
+	sort.Strings(checksumDiffs)
+	return onlyInA, onlyInB, checksumDiffs, nil
+}
+
+// VerifyOrder checks that the migrations recorded in the tracking table were
+// applied in the lexical order of their IDs, which is the order Apply uses.
+// An error wrapping ErrOutOfOrder, listing each migration which was applied
+// after one with a later ID, is returned if they weren't (e.g. because a
+// migration was merged with an older ID than one already deployed, or
+// WithPreserveOrder was used). Migrations marked as rolled back are ignored.
+func (m *Migrator) VerifyOrder(db Queryer) error {
+	if db == nil {
+		return ErrNilDB
+	}
+	history, err := m.appliedHistory(db)
+	if err != nil {
+		return err
+	}
+
+	problems := make([]string, 0)
+	latest := ""
+	for _, record := range history {
+		if record.ID < latest {
+			problems = append(problems, fmt.Sprintf("migration '%s' was applied after '%s'", record.ID, latest))
+			continue
+		}
+		latest = record.ID
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrOutOfOrder, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// RepairConcurrentIndexes finds indexes which PostgreSQL has marked invalid
+// (pg_index.indisvalid = false). These are left behind when a migration which
+// runs CREATE INDEX CONCURRENTLY is interrupted, and they block the migration
+// from being retried. Each one is reported via the Logger. If the Migrator was
+// created with the WithDropInvalidIndexes() option they are dropped, otherwise
+// an error naming them is returned.
+//
+// The migration lock is held while searching, so indexes which are still being
+// built by a running migration are not mistaken for abandoned ones. That only
+// excludes other migrators, though: an index being built concurrently by any
+// other session is invalid too until it finishes. So indexes on tables which
+// another session holds a SHARE UPDATE EXCLUSIVE lock on (as CREATE INDEX
+// CONCURRENTLY does while it builds) are skipped. VACUUM and ANALYZE take
+// that lock as well, so their tables' invalid indexes are only found once
+// they finish.
+func (m *Migrator) RepairConcurrentIndexes(db Connection) (err error) {
+	if db == nil {
+		return ErrNilDB
+	}
+	if m.readOnly {
+		return ErrReadOnlyMigrator
+	}
+
+	db, release, err := m.acquire(db)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	err = m.lock(db)
+	if err != nil {
+		return err
+	}
+	defer func() { err = joinErrs(err, m.unlock(db)) }()
+
+	indexes, err := m.invalidIndexes(db)
+	if err != nil {
+		return err
+	}
+
+	for _, index := range indexes {
+		m.log(fmt.Sprintf("Invalid index %s found\n", index))
+	}
+	if len(indexes) == 0 {
+		return nil
+	}
+	if !m.dropInvalidIndexes {
+		return fmt.Errorf("%w: %s", ErrInvalidIndexes, strings.Join(indexes, ", "))
+	}
+
+	for _, index := range indexes {
+		// Identifiers were quoted with quote_ident() in invalidIndexes
+		_, err = db.Exec(m.ctx, fmt.Sprintf("DROP INDEX CONCURRENTLY IF EXISTS %s", index))
+		if err != nil {
+			return fmt.Errorf("failed to drop invalid index %s: %w", index, err)
+		}
+		m.log(fmt.Sprintf("Invalid index %s dropped\n", index))
+	}
+	return nil
+}
+
+// UpgradeTrackingTable brings a tracking table created by an older version of
+// this package up to date, adding any columns it lacks without disturbing
+// its existing rows. If the table doesn't exist yet, it is created. Apply
+// performs the same upgrade implicitly, so this is only needed to upgrade the
+// table ahead of time (e.g. before deploying a new version of the package).
+func (m *Migrator) UpgradeTrackingTable(db Connection) (err error) {
+	if db == nil {
+		return ErrNilDB
+	}
+	if m.readOnly {
+		return ErrReadOnlyMigrator
+	}
+
+	conn, release, err := m.acquire(db)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	err = m.lock(conn)
+	if err != nil {
+		return err
+	}
+	defer func() { err = joinErrs(err, m.unlock(conn)) }()
+
+	tx, err := conn.Begin(m.ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(m.ctx)
+		}
+	}()
+
+	err = m.resolveQuoting(tx)
+	if err != nil {
+		return err
+	}
+	columns, err := m.trackingColumns(tx)
+	if err != nil {
+		return err
+	}
+
+	if len(columns) == 0 {
+		m.log(fmt.Sprintf("Creating tracking table %s\n", m.QuotedTableName()))
+		err = m.createMigrationsTable(tx)
+		if err != nil {
+			return err
+		}
+		return tx.Commit(m.ctx)
+	}
+
+	missing := []string{}
+	for _, definition := range append(append([]string{}, addedTrackingColumns...), m.optionalColumns()...) {
+		name := strings.Fields(definition)[0]
+		if _, exists := columns[name]; !exists {
+			m.log(fmt.Sprintf("Adding column %s to tracking table %s\n", name, m.QuotedTableName()))
+			missing = append(missing, "ADD COLUMN IF NOT EXISTS "+definition)
+		}
+	}
+	if len(missing) > 0 {
+		_, err = tx.Exec(m.ctx, fmt.Sprintf("ALTER TABLE %s %s", m.QuotedTableName(), strings.Join(missing, ", ")))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit(m.ctx)
+}
+
+// Squash replaces the whole history in the tracking table with a single record
+// of newBaseline, without running its Script. It is meant for when many
+// migrations have accumulated: newBaseline's Script should create the schema
+// which they have already created, so that it can be applied to new
+// databases instead of them. Once squashed, the old migrations must no longer
+// be provided to Apply, which would otherwise consider them pending. The
+// history is replaced in a single transaction while holding the migration
+// lock. It returns ErrUnsupportedWithStore when a custom Store was provided
+// via WithStore.
+func (m *Migrator) Squash(db Connection, newBaseline *Migration) (err error) {
+	if db == nil {
+		return ErrNilDB
+	}
+	if newBaseline == nil {
+		return ErrNilBaseline
+	}
+	if m.readOnly {
+		return ErrReadOnlyMigrator
+	}
+	if m.store != nil {
+		return ErrUnsupportedWithStore
+	}
+
+	conn, release, err := m.acquire(db)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	err = m.lock(conn)
+	if err != nil {
+		return err
+	}
+	defer func() { err = joinErrs(err, m.unlock(conn)) }()
+
+	tx, err := conn.Begin(m.ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(m.ctx)
+		}
+	}()
+
+	err = m.createMigrationsTable(tx)
+	if err != nil {
+		return err
+	}
+	tag, err := tx.Exec(m.ctx, fmt.Sprintf("DELETE FROM %s", m.QuotedTableName()))
+	if err != nil {
+		return err
+	}
+	err = m.recordMigration(tx, newBaseline, m.scriptChecksum(newBaseline), time.Now(), 0)
+	if err != nil {
+		return err
+	}
+	m.log(fmt.Sprintf("Squashed %d tracking records into '%s'\n", tag.RowsAffected(), newBaseline.ID))
+	return tx.Commit(m.ctx)
+}
+
+// trackingColumns returns the names of the tracking table's columns, as
+// reported by information_schema. It is empty if the table doesn't exist.
+func (m *Migrator) trackingColumns(db Queryer) (map[string]struct{}, error) {
+	columns := make(map[string]struct{})
+	rows, err := db.Query(m.ctx, `
+		SELECT column_name FROM information_schema.columns
+		WHERE table_schema = COALESCE(NULLIF($1, ''), current_schema())
+		AND table_name = $2
+	`, m.schemaName, m.tableName)
+	if err != nil {
+		return columns, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return columns, err
+		}
+		columns[name] = struct{}{}
+	}
+	return columns, rows.Err()
+}
+
+// acquire returns a dedicated connection from db if it is a pool (see
+// Acquirer), along with a function which returns it to the pool. Other kinds
+// of db are returned as they are, with a release function which does nothing.
+func (m *Migrator) acquire(db Connection) (conn Connection, release func(), err error) {
+	pool, ok := db.(Acquirer)
+	if !ok {
+		return db, func() {}, nil
+	}
+	pooled, err := pool.Acquire(m.ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pooled, pooled.Release, nil
+}
+
+// HeldConnection returns the dedicated connection which the most recent
+// successful Apply used, when the Migrator was created with the
+// WithHoldConnection() option. Ownership passes to the caller, who must call
+// its Release method when finished with it. It returns nil if no connection
+// is held (e.g. because the db passed to Apply wasn't a pool).
+func (m *Migrator) HeldConnection() *pgxpool.Conn {
+	if m.held == nil {
+		return nil
+	}
+	return m.held.take()
+}
+
+// heldConnection stores the connection kept by WithHoldConnection
+type heldConnection struct {
+	mu   sync.Mutex
+	conn *pgxpool.Conn
+}
+
+// hold keeps the connection, releasing any connection previously held which
+// the caller never took
+func (hc *heldConnection) hold(conn *pgxpool.Conn) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if hc.conn != nil {
+		hc.conn.Release()
+	}
+	hc.conn = conn
+}
+
+// take returns the held connection and stops holding it
+func (hc *heldConnection) take() *pgxpool.Conn {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	conn := hc.conn
+	hc.conn = nil
+	return conn
+}
+
+// invalidIndexes retrieves the schema-qualified, quoted names of the indexes
+// which PostgreSQL has marked as invalid, leaving out those which may still
+// be being built by another session
+func (m *Migrator) invalidIndexes(db Queryer) (indexes []string, err error) {
+	indexes = make([]string, 0)
+	rows, err := db.Query(m.ctx, `
+		SELECT quote_ident(n.nspname) || '.' || quote_ident(c.relname)
+		FROM pg_index i
+		JOIN pg_class c ON c.oid = i.indexrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE NOT i.indisvalid
+			AND NOT EXISTS (
+				SELECT 1 FROM pg_locks l
+				WHERE l.locktype = 'relation' AND l.relation = i.indrelid
+					AND l.mode = 'ShareUpdateExclusiveLock' AND l.granted
+					AND l.pid <> pg_backend_pid()
+			)
+		ORDER BY 1
+	`)
+	if err != nil {
+		return indexes, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var index string
+		err = rows.Scan(&index)
+		if err != nil {
+			return indexes, err
+		}
+		indexes = append(indexes, index)
+	}
+	return indexes, rows.Err()
+}
+
+// insufficientPrivilege is the SQLSTATE PostgreSQL reports when the role
+// lacks permission for an operation
+const insufficientPrivilege = "42501"
+
+// lockNotAvailable is the SQLSTATE PostgreSQL reports when a lock couldn't be
+// obtained, e.g. because lock_timeout elapsed
+const lockNotAvailable = "55P03"
+
+// undefinedTable is the SQLSTATE PostgreSQL reports when a query refers to a
+// table which doesn't exist
+const undefinedTable = "42P01"
+
+// deferConstraints defers the checking of deferrable constraints until the
+// migration transaction commits, when WithDeferredConstraints is used
+func (m *Migrator) deferConstraints(tx Queryer) error {
+	if !m.deferredConstraints {
+		return nil
+	}
+	_, err := tx.Exec(m.ctx, "SET CONSTRAINTS ALL DEFERRED")
+	return err
+}
+
+// checkTableOutsideTx rejects WithTableOutsideTransaction with the CockroachDB
+// dialect. Its lock is the SELECT ... FOR UPDATE in CreateSQL, which would be
+// autocommitted (releasing the lock at once) outside the migration
+// transaction.
+func (m *Migrator) checkTableOutsideTx() error {
+	if _, cockroach := m.dialect.(cockroachDialect); m.tableOutsideTx && cockroach {
+		return ErrTableOutsideTxUnsupported
+	}
+	return nil
+}
+
+// setRole switches the migration transaction to the role provided via
+// WithRole. SET LOCAL lasts until the transaction ends, so the role is reset
+// by the commit or rollback.
+func (m *Migrator) setRole(tx Queryer) error {
+	if m.role == "" {
+		return nil
+	}
+	_, err := tx.Exec(m.ctx, "SET LOCAL ROLE "+QuotedIdent(m.role))
+	if err != nil {
+		return fmt.Errorf("%w '%s': %v", ErrSetRole, m.role, err)
+	}
+	return nil
+}
+
+// installExtensions runs CREATE EXTENSION IF NOT EXISTS for each of the
+// extensions required via WithRequiredExtensions
+func (m *Migrator) installExtensions(tx Queryer) error {
+	for _, name := range m.requiredExtensions {
+		_, err := tx.Exec(m.ctx, "CREATE EXTENSION IF NOT EXISTS "+QuotedIdent(name))
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == insufficientPrivilege {
+			return fmt.Errorf("%w '%s': %s", ErrExtensionPermissionDenied, name, pgErr.Message)
+		}
+		if err != nil {
+			return fmt.Errorf("extension '%s' could not be installed: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// checkDatabase returns an error if the connection's current database isn't
+// the one expected via WithExpectedDatabase
+func (m *Migrator) checkDatabase(db Queryer) error {
+	if m.expectedDatabase == "" {
+		return nil
+	}
+
+	rows, err := db.Query(m.ctx, "SELECT current_database()")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var name string
+	for rows.Next() {
+		err = rows.Scan(&name)
+		if err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	if name != m.expectedDatabase {
+		return fmt.Errorf("%w: connected to '%s', but expected '%s'", ErrUnexpectedDatabase, name, m.expectedDatabase)
+	}
+	return nil
+}
+
+// checkServerVersion returns an error if the server's major version is older
+// than the one required via WithMinServerVersion
+func (m *Migrator) checkServerVersion(db Queryer) error {
+	if m.minServerVersion == 0 {
+		return nil
+	}
+
+	rows, err := db.Query(m.ctx, "SHOW server_version_num")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var versionNum string
+	for rows.Next() {
+		err = rows.Scan(&versionNum)
+		if err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	num, err := strconv.Atoi(versionNum)
+	if err != nil {
+		return fmt.Errorf("unexpected server_version_num '%s': %w", versionNum, err)
+	}
+	if major := num / 10000; major < m.minServerVersion {
+		return fmt.Errorf("%w: server is version %d, but version %d or newer is required", ErrServerVersionTooOld, major, m.minServerVersion)
+	}
+	return nil
+}
+
+func (m *Migrator) lock(db Queryer) error {
+	query := m.dialect.LockSQL(m.schemaName, m.tableName)
+	if query == "" || m.skipLock {
+		return nil
+	}
+
+	if tryLocker, ok := m.dialect.(TryLocker); ok && m.onLockWait != nil {
+		locked, err := m.queryBool(m.ctx, db, tryLocker.TryLockSQL(m.schemaName, m.tableName))
+		if err != nil {
+			return err
+		}
+		if locked {
+			m.log("Locked at ", time.Now().Format(time.RFC3339Nano))
+			return nil
+		}
+		m.onLockWait()
+	}
+
+	_, err := db.Exec(m.ctx, query)
+	if err == nil {
+		m.log("Locked at ", time.Now().Format(time.RFC3339Nano))
+	}
+	return err
+}
+
+// checkChecksumColumn returns ErrChecksumColumnTooNarrow when the tracking
+// table's checksum column (as reported by information_schema) can't hold the
+// checksums of the active algorithm, which would otherwise cause inserts to
+// fail with a less helpful error. The error suggests the ALTER which fixes it.
+func (m *Migrator) checkChecksumColumn(db Queryer) error {
+	rows, err := db.Query(m.ctx, `
+		SELECT COALESCE(character_maximum_length, 0) FROM information_schema.columns
+		WHERE table_schema = COALESCE(NULLIF($1, ''), current_schema())
+		AND table_name = $2 AND column_name = 'checksum'
+	`, m.schemaName, m.tableName)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	// A width of 0 means the column's length is unlimited (e.g. TEXT)
+	var width int32
+	for rows.Next() {
+		err = rows.Scan(&width)
+		if err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	needed := len(m.scriptChecksum(&Migration{}))
+	if width > 0 && int(width) < needed {
+		return fmt.Errorf("%w: %s.checksum holds %d characters, but %s checksums are %d. Widen it with: ALTER TABLE %s ALTER COLUMN checksum TYPE VARCHAR(%d)",
+			ErrChecksumColumnTooNarrow, m.QuotedTableName(), width, m.checksumAlgorithm(), needed, m.QuotedTableName(), needed)
+	}
+	return nil
+}
+
+func (m *Migrator) createMigrationsTable(tx Queryer) error {
+	err := m.resolveQuoting(tx)
+	if err != nil {
+		return err
+	}
+	for _, stmt := range m.trackingTableStatements() {
+		_, err = tx.Exec(m.ctx, stmt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TrackingTableDDL returns the statements Apply runs to create the tracking
+// table, separated by semicolons, including the columns and tablespace added
+// by options. DBAs can review it, or run it by hand to create the table
+// ahead of time. The statements are idempotent, like the ones Apply runs.
+// With WithServerSideQuoting, the names are quoted client-side, since no
+// database is available to quote them.
+func (m *Migrator) TrackingTableDDL() string {
+	var ddl strings.Builder
+	for _, stmt := range m.trackingTableStatements() {
+		ddl.WriteString(strings.TrimSuffix(strings.TrimSpace(stmt), ";"))
+		ddl.WriteString(";\n")
+	}
+	return ddl.String()
+}
+
+// trackingTableStatements returns the statements which create the tracking
+// table and bring it up to date with the Migrator's options
+func (m *Migrator) trackingTableStatements() []string {
+	if m.singleVersion {
+		stmts := []string{singleVersionCreateSQL(m.QuotedTableName(), m.tablespace)}
+		// The single version table bypasses the Dialect's CreateSQL, which is
+		// where CockroachDB takes its lock
+		if cockroach, ok := m.dialect.(cockroachDialect); ok {
+			stmts = append(stmts, cockroach.lockRowSQL())
+		}
+		return stmts
+	}
+	stmts := []string{m.requoted(m.createSQL())}
+	if optional := m.optionalColumns(); len(optional) > 0 {
+		stmts = append(stmts, fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s",
+			m.QuotedTableName(), strings.Join(optional, ", ADD COLUMN IF NOT EXISTS ")))
+	}
+	return stmts
+}
+
+// createSQL returns the Dialect's statements which create the tracking table,
+// in the tablespace provided via WithTablespace if there is one
+func (m *Migrator) createSQL() string {
+	if m.tablespace == "" {
+		return m.dialect.CreateSQL(m.schemaName, m.tableName)
+	}
+	if creator, ok := m.dialect.(TablespaceCreator); ok {
+		return creator.CreateInTablespaceSQL(m.schemaName, m.tableName, m.tablespace)
+	}
+	// The Dialect can't add the clause, so the table is moved instead
+	return m.dialect.CreateSQL(m.schemaName, m.tableName) + ";\n" +
+		fmt.Sprintf("ALTER TABLE %s SET TABLESPACE %s", m.QuotedTableName(), QuotedIdent(m.tablespace))
+}
+
+// optionalColumns returns the definitions of the columns which options (e.g.
+// WithOrdinalColumn) add to the tracking table
+func (m *Migrator) optionalColumns() []string {
+	columns := []string{}
+	if m.ordinalColumn {
+		columns = append(columns, ordinalColumnDefinition)
+	}
+	if m.checksumSigner != nil {
+		columns = append(columns, checksumSignatureColumnDefinition)
+	}
+	return columns
+}
+
+// resolveQuoting asks the server to quote the tracking table's name with
+// quote_ident, and caches the result, when WithServerSideQuoting is used
+func (m *Migrator) resolveQuoting(db Queryer) error {
+	if m.serverQuoted == nil {
+		return nil
+	}
+	m.serverQuoted.mutex.Lock()
+	defer m.serverQuoted.mutex.Unlock()
+	if m.serverQuoted.quoted != "" {
+		return nil
+	}
+
+	rows, err := db.Query(m.ctx, "SELECT quote_ident($1), quote_ident($2)", m.schemaName, m.tableName)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var schemaName, tableName string
+	for rows.Next() {
+		err = rows.Scan(&schemaName, &tableName)
+		if err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	if m.schemaName == "" {
+		m.serverQuoted.quoted = tableName
+	} else {
+		m.serverQuoted.quoted = schemaName + "." + tableName
+	}
+	return nil
+}
+
+// requoted replaces the client-side quoting of the tracking table's name in
+// SQL generated by the Dialect with the server's, once it has been resolved.
+// Quoted identifiers are delimited, so this can't match a longer name.
+func (m *Migrator) requoted(query string) string {
+	quoted := m.serverQuoted.get()
+	if quoted == "" {
+		return query
+	}
+	return strings.ReplaceAll(query, QuotedTableName(m.schemaName, m.tableName), quoted)
+}
+
+// unlockTimeout bounds how long releasing the migration lock may take
+const unlockTimeout = 10 * time.Second
+
+func (m *Migrator) unlock(db Queryer) error {
+	query := m.dialect.UnlockSQL(m.schemaName, m.tableName)
+	if query == "" || m.skipLock {
+		return nil
+	}
+	// The lock is released with a fresh context, rather than the Migrator's,
+	// so that it is released even after that context has been cancelled or
+	// its deadline has passed. Otherwise the session would keep holding it.
+	ctx, cancel := context.WithTimeout(context.Background(), unlockTimeout)
+	defer cancel()
+	released, err := m.queryBool(ctx, db, query)
+	if err != nil {
+		return err
+	}
+	if !released {
+		// pg_advisory_unlock returns false when this session didn't hold the
+		// lock, which means the lock was taken on some other connection.
+		m.log("WARNING: lock was not held when unlocking at ", time.Now().Format(time.RFC3339Nano))
+		return ErrLockNotHeld
+	}
+	m.log("Unlocked at ", time.Now().Format(time.RFC3339Nano))
+	return nil
+}
+
+// run applies each migration which hasn't been applied yet, returning the
+// number of migrations which were run
+func (m *Migrator) run(tx Queryer, migrations []*Migration, timer *phaseTimer) (int, error) {
+	if tx == nil {
+		return 0, fmt.Errorf("%w while running migrations tracked in %s (did Begin fail?)", ErrNilTx, m.QuotedTableName())
+	}
+
+	started := time.Now()
+	plan, err := m.computeMigrationPlan(tx, migrations)
+	if err != nil {
+		return 0, err
+	}
+	timer.record("plan", started)
+
+	baselined, plan := m.splitBaseline(plan)
+	if m.logPlan {
+		m.log(planSummary(plan))
+	}
+
+	if !m.allowTransactionControl {
+		for _, migration := range plan {
+			if stmt := findTransactionControl(migration.Script); stmt != "" {
+				return 0, fmt.Errorf("migration '%s' Failed: %w: %s", migration.ID, ErrTransactionControl, stmt)
+			}
+		}
+	}
+
+	if m.lintFailOn > 0 {
+		err = m.lint(plan)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if m.planValidator != nil {
+		err = m.planValidator(plan)
+		if err != nil {
+			return 0, fmt.Errorf("migration plan rejected: %w", err)
+		}
+	}
+
+	if m.syntaxCheck {
+		err = m.checkSyntax(tx, plan)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for _, migration := range baselined {
+		err = m.recordMigration(tx, migration, m.scriptChecksum(migration), time.Now(), 0)
+		if err != nil {
+			return 0, err
+		}
+		m.log(fmt.Sprintf("Migration '%s' recorded as applied by the baseline\n", migration.ID))
+	}
+
+	started = time.Now()
+	count := 0
+	latest := ""
+	for _, migration := range plan {
+		if err = m.ctx.Err(); err != nil {
+			return 0, err
+		}
+		ran := true
+		if m.onError != nil {
+			ran, err = m.runInSavepoint(tx, migration)
+		} else {
+			err = m.runMigration(tx, migration)
+		}
+		if err != nil {
+			return 0, migrationFailure{id: migration.ID, err: err}
+		}
+		if ran {
+			count++
+			if migration.ID > latest {
+				latest = migration.ID
+			}
+		}
+	}
+	timer.record("migrations", started)
+
+	if m.notifyChannel != "" && count > 0 {
+		_, err = tx.Exec(m.ctx, "SELECT pg_notify($1, $2)", m.notifyChannel, latest)
+		if err != nil {
+			return 0, fmt.Errorf("notifying channel '%s': %w", m.notifyChannel, err)
+		}
+	}
+
+	return count, nil
+}
+
+// checkSyntax dry-runs the Scripts of the plan inside a savepoint which is
+// then rolled back, so that syntax errors are reported before any migration
+// is run. DML statements are only EXPLAINed, which parses and plans them
+// without executing them. Other statements (DDL) can only be checked by
+// executing them, but they are rolled back along with the savepoint.
+func (m *Migrator) checkSyntax(tx Queryer, plan []*Migration) error {
+	_, err := tx.Exec(m.ctx, "SAVEPOINT pgxschema_syntax_check")
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range plan {
+		if migration.Data != nil || migration.isFunc() {
+			continue
+		}
+		var script string
+		script, err = m.transformScript(migration)
+		if err != nil {
+			err = fmt.Errorf("%w: migration '%s': %s", ErrSyntaxCheckFailed, migration.ID, err)
+			break
+		}
+		for _, stmt := range splitStatements(script) {
+			if isDML(stmt) {
+				_, err = m.explain(tx, stmt)
+			} else {
+				_, err = tx.Exec(m.ctx, stmt)
+			}
+			if err != nil {
+				err = fmt.Errorf("%w: migration '%s': %s", ErrSyntaxCheckFailed, migration.ID, err)
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	_, rollbackErr := tx.Exec(m.ctx, "ROLLBACK TO SAVEPOINT pgxschema_syntax_check")
+	if rollbackErr == nil {
+		_, rollbackErr = tx.Exec(m.ctx, "RELEASE SAVEPOINT pgxschema_syntax_check")
+	}
+	return joinErrs(err, rollbackErr)
+}
+
+// runInSavepoint runs a migration inside a savepoint. When it fails, the
+// savepoint is rolled back and the onError callback decides whether to retry
+// it, skip it (leaving it pending) or abort. It reports whether the migration
+// was applied.
+func (m *Migrator) runInSavepoint(tx Queryer, migration *Migration) (bool, error) {
+	for {
+		_, err := tx.Exec(m.ctx, "SAVEPOINT pgxschema_migration")
+		if err != nil {
+			return false, err
+		}
+
+		err = m.runMigration(tx, migration)
+		if err == nil {
+			_, err = tx.Exec(m.ctx, "RELEASE SAVEPOINT pgxschema_migration")
+			return err == nil, err
+		}
+
+		_, rollbackErr := tx.Exec(m.ctx, "ROLLBACK TO SAVEPOINT pgxschema_migration")
+		if rollbackErr != nil {
+			return false, joinErrs(err, rollbackErr)
+		}
+
+		switch m.onError(migration, err) {
+		case Retry:
+			m.log(fmt.Sprintf("Migration '%s' being retried\n", migration.ID))
+		case Skip:
+			m.log(fmt.Sprintf("Migration '%s' skipped\n", migration.ID))
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+}
+
+func (m *Migrator) computeMigrationPlan(db Queryer, toRun []*Migration) (plan []*Migration, err error) {
+	isApplied, err := m.appliedFilter(db)
+	if err != nil {
+		return plan, err
+	}
+	plan = make([]*Migration, 0)
+	for _, migration := range toRun {
+		if !isApplied(migration.ID) {
+			plan = append(plan, migration)
+		}
+	}
+	if !m.preserveOrder {
+		SortMigrations(plan)
+	}
+	return plan, err
+}
+
+// appliedFilter reads the applied IDs from the Store and returns a function
+// reporting whether the migration with a given ID has been applied. In single
+// version mode (without a Store provided via WithStore), every ID at or below
+// the version recorded in the tracking table is considered applied.
+func (m *Migrator) appliedFilter(db Queryer) (func(id string) bool, error) {
+	if !m.singleVersion || m.store != nil {
+		applied, err := m.appliedIDs(db)
+		return func(id string) bool {
+			_, exists := applied[id]
+			return exists
+		}, err
+	}
+
+	err := m.resolveQuoting(db)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(m.ctx, singleVersionSelectSQL(m.QuotedTableName()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	version := ""
+	for rows.Next() {
+		err = rows.Scan(&version)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return func(id string) bool {
+		return version != "" && id <= version
+	}, rows.Err()
+}
+
+// planSummary describes the plan in a single line listing the IDs of the
+// migrations, in the order they'll be run
+func planSummary(plan []*Migration) string {
+	switch len(plan) {
+	case 0:
+		return "No migrations to apply\n"
+	case 1:
+		return fmt.Sprintf("Applying 1 migration: %s\n", plan[0].ID)
+	}
+	ids := make([]string, len(plan))
+	for i, migration := range plan {
+		ids[i] = migration.ID
+	}
+	return fmt.Sprintf("Applying %d migrations: %s\n", len(plan), strings.Join(ids, ", "))
+}
+
+// lint runs LintMigrations over the plan, logging findings below the
+// configured severity and returning an error describing those at or above it
+func (m *Migrator) lint(plan []*Migration) error {
+	failures := make([]string, 0)
+	for _, warning := range LintMigrations(plan) {
+		if warning.Severity >= m.lintFailOn {
+			failures = append(failures, warning.String())
+		} else {
+			m.log(warning.String() + "\n")
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%w: %s", ErrLintFailed, strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// splitBaseline separates the migrations whose IDs are at or below the
+// baseline version (which are to be recorded as applied without being run)
+// from those which are to be run
+func (m *Migrator) splitBaseline(plan []*Migration) (baselined, remaining []*Migration) {
+	if m.baselineVersion == "" {
+		return nil, plan
+	}
+	remaining = make([]*Migration, 0, len(plan))
+	for _, migration := range plan {
+		if migration.ID <= m.baselineVersion {
+			baselined = append(baselined, migration)
+		} else {
+			remaining = append(remaining, migration)
+		}
+	}
+	return baselined, remaining
+}
+
+func (m *Migrator) runMigration(tx Queryer, migration *Migration) (err error) {
+	if m.notices != nil {
+		defer m.notices.start(tx, migration.ID)()
+	}
+
+	m.emit(MigrationEvent{Type: EventStarted, MigrationID: migration.ID})
+	started := time.Now()
+	defer func() {
+		event := MigrationEvent{Type: EventApplied, MigrationID: migration.ID, Duration: time.Since(started), Err: err}
+		if err != nil {
+			event.Type = EventFailed
+		}
+		m.emit(event)
+	}()
+
+	appliedAt, err := m.appliedAt(tx)
+	if err != nil {
+		return fmt.Errorf("migration '%s' Failed to read the applied_at time: %w", migration.ID, err)
+	}
+
+	previous, err := m.applySettings(tx, migration.Settings)
+	if err != nil {
+		return fmt.Errorf("migration '%s' Failed to apply its Settings: %w", migration.ID, err)
+	}
+
+	startedAt := time.Now()
+	checksum, err := m.execute(tx, migration)
+	if err != nil {
+		return fmt.Errorf("migration '%s' Failed: %w", migration.ID, err)
+	}
+
+	if migration.Verify != "" {
+		ok, err := m.queryTruthy(tx, migration.Verify)
+		if err != nil {
+			return fmt.Errorf("migration '%s' Verify query failed: %w", migration.ID, err)
+		}
+		if !ok {
+			return fmt.Errorf("migration '%s' Failed: %w", migration.ID, ErrVerificationFailed)
+		}
+	}
+
+	if m.healthCheck != "" {
+		ok, err := m.queryTruthy(tx, m.healthCheck)
+		if err != nil {
+			return fmt.Errorf("migration '%s' health check failed: %w", migration.ID, err)
+		}
+		if !ok {
+			return fmt.Errorf("migration '%s' Failed: %w", migration.ID, ErrHealthCheckFailed)
+		}
+	}
+
+	executionTime := time.Since(startedAt)
+	m.log(fmt.Sprintf("Migration '%s' applied in %s\n", migration.ID, executionTime))
+
+	_, err = m.applySettings(tx, previous)
+	if err != nil {
+		return fmt.Errorf("migration '%s' Failed to restore the settings it changed: %w", migration.ID, err)
+	}
+
+	return m.recordMigration(tx, migration, checksum, appliedAt, executionTime)
+}
+
+// applySettings sets each of the settings for the rest of the transaction (as
+// with SET LOCAL), in the order of their names, and returns the values they
+// had before. The names and values are passed to set_config() as parameters,
+// so they can't be used to inject SQL.
+func (m *Migrator) applySettings(tx Queryer, settings map[string]string) (previous map[string]string, err error) {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	previous = make(map[string]string, len(settings))
+	for _, name := range names {
+		// current_setting's missing_ok argument allows custom settings (e.g.
+		// myapp.tenant) which haven't been set yet. They're restored as empty.
+		rows, err := tx.Query(m.ctx, "SELECT COALESCE(current_setting($1, true), ''), set_config($1, $2, true)", name, settings[name])
+		if err != nil {
+			return previous, fmt.Errorf("setting '%s': %w", name, err)
+		}
+		var old, current string
+		for rows.Next() {
+			err = rows.Scan(&old, &current)
+		}
+		rows.Close()
+		if err == nil {
+			err = rows.Err()
+		}
+		if err != nil {
+			return previous, fmt.Errorf("setting '%s': %w", name, err)
+		}
+		previous[name] = old
+	}
+	return previous, nil
+}
+
+// appliedAt returns the time to record as a migration's applied_at, from the
+// clock selected via WithAppliedAtSource
+func (m *Migrator) appliedAt(tx Queryer) (appliedAt time.Time, err error) {
+	query := m.appliedAtSource.query()
+	if query == "" {
+		return time.Now(), nil
+	}
+	rows, err := tx.Query(m.ctx, query)
+	if err != nil {
+		return appliedAt, err
+	}
+	defer rows.Close()
+	if rows.Next() {
+		err = rows.Scan(&appliedAt)
+		if err != nil {
+			return appliedAt, err
+		}
+	}
+	return appliedAt, rows.Err()
+}
+
+// executionMillis converts an execution time to the whole milliseconds which
+// are recorded. Durations shorter than a millisecond are rounded up to 1, so
+// that 0 means the migration wasn't timed at all (e.g. it was baselined).
+func executionMillis(executionTime time.Duration) int64 {
+	if executionTime > 0 && executionTime < time.Millisecond {
+		return 1
+	}
+	return executionTime.Milliseconds()
+}
+
+// recordMigration inserts a row into the tracking table recording that the
+// migration has been applied
+func (m *Migrator) recordMigration(tx Queryer, migration *Migration, checksum string, appliedAt time.Time, executionTime time.Duration) error {
+	return m.trackingStore().RecordApplied(m.ctx, tx, AppliedMigration{
+		Migration:             *migration,
+		Checksum:              checksum,
+		ChecksumAlgorithm:     m.checksumAlgorithm(),
+		ExecutionTimeInMillis: int(executionMillis(executionTime)),
+		AppliedAt:             appliedAt,
+		BuildVersion:          m.buildVersion,
+		BuildCommit:           m.buildCommit,
+	})
+}
+
+// insertRecord inserts a row recording an applied migration into the
+// tracking table, for the default Store
+func (m *Migrator) insertRecord(tx Queryer, record AppliedMigration) error {
+	if m.singleVersion {
+		_, err := tx.Exec(m.ctx, singleVersionRecordSQL(m.QuotedTableName()), record.ID, record.AppliedAt)
+		return err
+	}
+	_, err := tx.Exec(m.ctx, m.requoted(m.dialect.InsertSQL(m.schemaName, m.tableName)),
+		record.ID, record.Checksum, int64(record.ExecutionTimeInMillis), record.AppliedAt,
+		record.ChecksumAlgorithm, record.BuildVersion, record.BuildCommit,
+	)
+	if err == nil && m.ordinalColumn {
+		_, err = tx.Exec(m.ctx, ordinalAssignSQL(m.QuotedTableName()), record.ID)
+	}
+	if err == nil && m.checksumSigner != nil {
+		_, err = tx.Exec(m.ctx, checksumSignSQL(m.QuotedTableName()), record.ID, record.Checksum, m.checksumSigner(record.Checksum))
+	}
+	return err
+}
+
+// execute runs the migration's Script (or copies its Data, or calls its
+// Func) and returns the checksum which should be recorded for it.
+func (m *Migrator) execute(tx Queryer, migration *Migration) (checksum string, err error) {
+	if migration.isFunc() {
+		fnTx, ok := tx.(pgx.Tx)
+		if !ok {
+			return "", ErrFuncUnsupported
+		}
+		return m.scriptChecksum(migration), migration.Func(m.ctx, fnTx)
+	}
+
+	if migration.isStreamed() {
+		return m.executeStream(tx, migration)
+	}
+
+	if migration.Data == nil {
+		script, err := m.transformScript(migration)
+		if err != nil {
+			return "", err
+		}
+		if m.explainCallback != nil || m.lockRetryAttempts > 1 {
+			return m.scriptChecksum(migration), m.execStatements(tx, migration.ID, script)
+		}
+		_, err = tx.Exec(m.ctx, script)
+		return m.scriptChecksum(migration), err
+	}
+
+	copier, ok := tx.(CopyFromer)
+	if !ok {
+		return "", ErrCopyFromUnsupported
+	}
+	src := newChecksumSource(migration.Data.Source)
+	if m.checksumIncludesID {
+		fmt.Fprintf(src.hash, "%s\n", migration.ID)
+	}
+	_, err = copier.CopyFrom(m.ctx, migration.Data.TableName, migration.Data.Columns, src)
+	return src.MD5(), err
+}
+
+// executeStream splits the migration's ScriptReader into statements and
+// executes each as it is read, so the whole script is never held in memory.
+// It returns the checksum of everything read, which is the same as the
+// checksum of the equivalent Script.
+func (m *Migrator) executeStream(tx Queryer, migration *Migration) (checksum string, err error) {
+	hash := md5.New() // #nosec not using MD5 cryptographically
+	if m.checksumIncludesID {
+		fmt.Fprintf(hash, "%s\n", migration.ID)
+	}
+	var hashed io.Writer = hash
+	if m.trimScriptForChecksum {
+		hashed = &trimRightWriter{w: hash, cutset: checksumTrimCutset}
+	}
+	scanner := newStatementScanner(io.TeeReader(migration.ScriptReader, hashed))
+	for scanner.Next() {
+		err = m.execStatement(tx, scanner.Statement())
+		if err != nil {
+			return "", err
+		}
+	}
+	if scanner.Err() != nil {
+		return "", scanner.Err()
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// scriptChecksum returns the checksum of the migration's Script, including
+// its ID when the WithChecksumIncludesID option was used, and ignoring its
+// trailing newlines and spaces when WithTrimScriptForChecksum was
+func (m *Migrator) scriptChecksum(migration *Migration) string {
+	checksum, _ := migration.checksum(m.checksumAlgorithm())
+	return checksum
+}
+
+// checksumAlgorithm returns the name of the algorithm scriptChecksum uses, as
+// recorded in the tracking table
+func (m *Migrator) checksumAlgorithm() string {
+	switch {
+	case m.checksumIncludesID && m.trimScriptForChecksum:
+		return ChecksumAlgorithmMD5WithIDTrimmed
+	case m.checksumIncludesID:
+		return ChecksumAlgorithmMD5WithID
+	case m.trimScriptForChecksum:
+		return ChecksumAlgorithmMD5Trimmed
+	}
+	return ChecksumAlgorithmMD5
+}
+
+// execStatements runs the script of the migration with the given ID one
+// statement at a time. If there is an explainCallback, the EXPLAIN (FORMAT
+// JSON) plan of each DML statement is passed to it before the statement is
+// executed. DDL and utility statements are never EXPLAINed.
+func (m *Migrator) execStatements(tx Queryer, id, script string) error {
+	for _, stmt := range splitStatements(script) {
+		if isDML(stmt) && m.explainCallback != nil {
+			plan, err := m.explain(tx, stmt)
+			if err != nil {
+				return fmt.Errorf("failed to EXPLAIN statement: %w", err)
+			}
+			m.explainCallback(id, stmt, plan)
+		}
+		err := m.execStatement(tx, stmt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transformScript returns the SQL to execute for the migration's Script,
+// which is the Script itself unless the Migrator was created with
+// WithScriptTransform
+func (m *Migrator) transformScript(migration *Migration) (string, error) {
+	if m.scriptTransform == nil {
+		return migration.Script, nil
+	}
+	script, err := m.scriptTransform(migration, migration.Script)
+	if err != nil {
+		return "", fmt.Errorf("transforming the Script: %w", err)
+	}
+	return script, nil
+}
+
+// execStatement executes a single statement. When the Migrator was created
+// with WithMigrationLockRetry, the statement is run inside a savepoint, so
+// that if it fails because a lock wasn't available (e.g. because lock_timeout
+// elapsed), it can be rolled back to the savepoint and retried without
+// aborting the migration transaction.
+func (m *Migrator) execStatement(tx Queryer, stmt string) error {
+	if m.lockRetryAttempts <= 1 {
+		_, err := tx.Exec(m.ctx, stmt)
+		return err
+	}
+
+	backoff := m.lockRetryBackoff
+	for attempt := 1; ; attempt++ {
+		_, err := tx.Exec(m.ctx, "SAVEPOINT pgxschema_lock_retry")
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(m.ctx, stmt)
+		if err == nil {
+			_, err = tx.Exec(m.ctx, "RELEASE SAVEPOINT pgxschema_lock_retry")
+			return err
+		}
+		var pgErr *pgconn.PgError
+		if !errors.As(err, &pgErr) || pgErr.Code != lockNotAvailable || attempt >= m.lockRetryAttempts {
+			return err
+		}
+
+		_, rollbackErr := tx.Exec(m.ctx, "ROLLBACK TO SAVEPOINT pgxschema_lock_retry")
+		if rollbackErr != nil {
+			return joinErrs(err, rollbackErr)
+		}
+		m.log(fmt.Sprintf("Lock not available (attempt %d of %d), retrying in %s: %s\n", attempt, m.lockRetryAttempts, backoff, pgErr.Message))
+		select {
+		case <-time.After(backoff):
+		case <-m.ctx.Done():
+			return joinErrs(err, m.ctx.Err())
+		}
+		backoff *= 2
+	}
+}
+
+// explain retrieves the JSON query plan for a statement without executing it
+func (m *Migrator) explain(tx Queryer, stmt string) (plan string, err error) {
+	rows, err := tx.Query(m.ctx, "EXPLAIN (FORMAT JSON) "+stmt)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		err = rows.Scan(&plan)
+		if err != nil {
+			return "", err
+		}
+	}
+	return plan, rows.Err()
+}
+
+// queryTruthy runs a query and reports whether it returned a row whose first
+// column is truthy. No rows, NULL, false, zero and blank are all falsy.
+func (m *Migrator) queryTruthy(tx Queryer, query string) (truthy bool, err error) {
+	rows, err := tx.Query(m.ctx, query)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		var values []interface{}
+		values, err = rows.Values()
+		if err != nil {
+			return false, err
+		}
+		truthy = len(values) > 0 && isTruthy(values[0])
+	}
+	return truthy, rows.Err()
+}
+
+// queryBool runs a query which returns a single boolean, returning false if
+// it returns no rows
+func (m *Migrator) queryBool(ctx context.Context, db Queryer, query string, args ...interface{}) (result bool, err error) {
+	rows, err := db.Query(ctx, query, args...)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		err = rows.Scan(&result)
+		if err != nil {
+			return false, err
+		}
+	}
+	return result, rows.Err()
+}
+
+// isTruthy reports whether a value scanned from the database should be
+// considered true
+func isTruthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case int16:
+		return v != 0
+	case int32:
+		return v != 0
+	case int64:
+		return v != 0
+	case int:
+		return v != 0
+	case float32:
+		return v != 0
+	case float64:
+		return v != 0
+	case string:
+		b, err := strconv.ParseBool(v)
+		return err == nil && b
+	default:
+		return true
+	}
+}
+
+func (m *Migrator) log(msgs ...interface{}) {
+	if m.Logger != nil {
+		m.Logger.Print(msgs...)
+	}
+}
+
+// joinErrs combines the non-nil errors provided. It returns nil if there are
+// none, and the error itself if there is only one. Otherwise the result's
+// message lists every error, and errors.Is and errors.As match any of them,
+// so that (for example) a failure to release the lock doesn't hide the
+// migration error which preceded it.
+func joinErrs(errs ...error) error {
+	joined := make(joinedError, 0, len(errs))
+	for _, err := range errs {
+		if err != nil {
+			joined = append(joined, err)
+		}
+	}
+	switch len(joined) {
+	case 0:
+		return nil
+	case 1:
+		return joined[0]
+	}
+	return joined
+}
+
+// cancelled wraps err in a cancelledError if the Migrator's context has been
+// cancelled or its deadline has passed, since that is then the likely cause
+// of err, whatever pgx reported
+func (m *Migrator) cancelled(err error) error {
+	if err == nil || m.ctx.Err() == nil {
+		return err
+	}
+	var already cancelledError
+	if errors.As(err, &already) {
+		return err
+	}
+	return cancelledError{ctxErr: m.ctx.Err(), err: err}
+}
+
+// cancelledError reports that Apply failed because its context was cancelled.
+// It matches both ErrApplyCancelled and the context's error (context.Canceled
+// or context.DeadlineExceeded) with errors.Is, and unwraps to the error which
+// the cancellation caused.
+type cancelledError struct {
+	ctxErr error
+	err    error
+}
+
+func (ce cancelledError) Error() string {
+	if errors.Is(ce.err, ce.ctxErr) {
+		return fmt.Sprintf("%s: %s", ErrApplyCancelled, ce.err)
+	}
+	return fmt.Sprintf("%s (%s): %s", ErrApplyCancelled, ce.ctxErr, ce.err)
+}
+
+// Is reports whether the target is ErrApplyCancelled or the context's error
+func (ce cancelledError) Is(target error) bool {
+	return target == ErrApplyCancelled || errors.Is(ce.ctxErr, target)
+}
+
+func (ce cancelledError) Unwrap() error {
+	return ce.err
+}
+
+// migrationFailure attributes an error to the migration which caused it, so
+// that WithRecordFailures can record its ID. Its message and unwrapping are
+// otherwise those of the underlying error.
+type migrationFailure struct {
+	id  string
+	err error
+}
+
+func (mf migrationFailure) Error() string {
+	return mf.err.Error()
+}
+
+func (mf migrationFailure) Unwrap() error {
+	return mf.err
+}
+
+// joinedError is an error made up of several errors. See joinErrs.
+type joinedError []error
+
+func (je joinedError) Error() string {
+	msgs := make([]string, len(je))
+	for i, err := range je {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Is reports whether any of the errors matches the target
+func (je joinedError) Is(target error) bool {
+	for _, err := range je {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first of the errors which matches the target
+func (je joinedError) As(target interface{}) bool {
+	for _, err := range je {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// phaseTimer accumulates how long each phase of an Apply took. A nil
+// phaseTimer records nothing, so callers needn't check whether timing is
+// enabled.
+type phaseTimer struct {
+	phases []string
+}
+
+// record notes that the named phase took the time elapsed since started
+func (pt *phaseTimer) record(name string, started time.Time) {
+	if pt == nil {
+		return
+	}
+	elapsed := time.Since(started).Round(time.Microsecond)
+	pt.phases = append(pt.phases, fmt.Sprintf("%s: %s", name, elapsed))
+}
+
+// String formats the recorded phases as a single log line
+func (pt *phaseTimer) String() string {
+	return fmt.Sprintf("Timing: %s\n", strings.Join(pt.phases, ", "))
 }
@@ -2,13 +2,21 @@ package pgxschema
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/pashagolub/pgxmock"
 )
 
 // TestCreateMigrationsTable ensures that each test datbase can
@@ -42,6 +50,10 @@ func TestLockAndUnlock(t *testing.T) {
 		if err != nil {
 			t.Error(err)
 		}
+		err = m.unlock(db)
+		if !errors.Is(err, ErrLockNotHeld) {
+			t.Errorf("Expected unlocking again to fail with %v. Got %v", ErrLockNotHeld, err)
+		}
 	})
 }
 
@@ -101,170 +113,2676 @@ func TestApplyInLexicalOrder(t *testing.T) {
 	})
 }
 
-// TestFailedMigration ensures that a migration with a syntax error triggers
-// an expected error when Apply() is run. This test is run on every test database
-func TestFailedMigration(t *testing.T) {
+// TestApplyUpgradesLegacyTrackingTable ensures that a tracking table created
+// before the checksum_algorithm column existed is upgraded in place, and that
+// its existing rows are treated as MD5 checksums.
+func TestApplyUpgradesLegacyTrackingTable(t *testing.T) {
 	withEachDB(t, func(db *pgxpool.Pool) {
-		tableName := time.Now().Format(time.RFC3339Nano)
-		migrator := NewMigrator(WithTableName(tableName))
-		migrations := []*Migration{
+		migrator := makeTestMigrator()
+		_, err := db.Exec(context.Background(), fmt.Sprintf(`
+			CREATE TABLE %s (
+				id VARCHAR(255) NOT NULL,
+				checksum VARCHAR(32) NOT NULL DEFAULT '',
+				execution_time_in_millis INTEGER NOT NULL DEFAULT 0,
+				applied_at TIMESTAMP WITH TIME ZONE NOT NULL
+			);
+			INSERT INTO %s (id, checksum, applied_at) VALUES ('0000-00-00 000', 'abc', NOW())
+		`, migrator.QuotedTableName(), migrator.QuotedTableName()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = migrator.Apply(db, testMigrations(t, "useless-ansi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		applied, err := migrator.GetAppliedMigrations(db)
+		if err != nil {
+			t.Error(err)
+		}
+		if len(applied) != 3 {
+			t.Errorf("Expected 3 applied migrations. Got %d", len(applied))
+		}
+		for id, migration := range applied {
+			if migration.ChecksumAlgorithm != ChecksumAlgorithmMD5 {
+				t.Errorf("Expected '%s' to have checksum algorithm '%s'. Got '%s'", id, ChecksumAlgorithmMD5, migration.ChecksumAlgorithm)
+			}
+		}
+	})
+}
+
+// TestApplyWithExplainCallback ensures that DML statements have their plans
+// captured, that DDL statements are not EXPLAINed, and that every statement
+// still runs.
+func TestApplyWithExplainCallback(t *testing.T) {
+	withEachDB(t, func(db *pgxpool.Pool) {
+		explained := make(map[string]string)
+		callback := func(id, sql, planJSON string) {
+			explained[sql] = planJSON
+		}
+		dataTable := fmt.Sprintf("explained%d", rand.Int()) // #nosec don't need a strong RNG here
+		migrator := NewMigrator(
+			WithTableName(time.Now().Format(time.RFC3339Nano)),
+			WithExplainCallback(callback),
+		)
+		err := migrator.Apply(db, []*Migration{
 			{
-				ID:     "2019-01-01 Bad Migration",
-				Script: "CREATE TIBBLE bad_table_name (id INTEGER NOT NULL PRIMARY KEY)",
+				ID: "2022-01-01 Create and Seed",
+				Script: fmt.Sprintf(`
+					CREATE TABLE %s (name VARCHAR(255));
+					INSERT INTO %s (name) VALUES ('explained')
+				`, dataTable, dataTable),
 			},
+		})
+		if err != nil {
+			t.Fatal(err)
 		}
-		err := migrator.Apply(db, migrations)
-		expectErrorContains(t, err, "TIBBLE")
 
-		query := "SELECT * FROM " + migrator.QuotedTableName()
-		rows, _ := db.Query(context.Background(), query)
-		defer rows.Close()
+		if len(explained) != 1 {
+			t.Errorf("Expected exactly 1 statement to be explained. Got %d", len(explained))
+		}
+		insert := fmt.Sprintf("INSERT INTO %s (name) VALUES ('explained')", dataTable)
+		if !strings.Contains(explained[insert], "Plan") {
+			t.Errorf("Expected a JSON plan for the INSERT. Got '%s'", explained[insert])
+		}
 
-		// We expect either an error (because the transaction was rolled back
-		// and the table no longer exists)... or  a query with no results
-		if rows != nil {
-			if rows.Next() {
-				t.Error("Record was inserted in tracking table even though the migration failed")
+		count := 0
+		err = db.QueryRow(context.Background(), fmt.Sprintf("SELECT COUNT(*) FROM %s", dataTable)).Scan(&count)
+		if err != nil {
+			t.Error(err)
+		}
+		if count != 1 {
+			t.Errorf("Expected the INSERT to be executed exactly once. Got %d rows", count)
+		}
+	})
+}
+
+// TestApplyWithBuildInfo ensures the version and commit provided via
+// WithBuildInfo are recorded with each applied migration.
+func TestApplyWithBuildInfo(t *testing.T) {
+	withEachDB(t, func(db *pgxpool.Pool) {
+		migrator := NewMigrator(
+			WithTableName(time.Now().Format(time.RFC3339Nano)),
+			WithBuildInfo("1.2.3", "0a1b2c3"),
+		)
+		err := migrator.Apply(db, testMigrations(t, "useless-ansi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		applied, err := migrator.GetAppliedMigrations(db)
+		if err != nil {
+			t.Error(err)
+		}
+		for id, migration := range applied {
+			if migration.BuildVersion != "1.2.3" || migration.BuildCommit != "0a1b2c3" {
+				t.Errorf("Expected '%s' to record build 1.2.3 (0a1b2c3). Got %s (%s)", id, migration.BuildVersion, migration.BuildCommit)
 			}
 		}
 	})
 }
 
-// TestSimultaneousApply creates multiple Migrators and multiple distinct
-// connections to each test database and attempts to call .Apply() on them all
-// concurrently. The migrations include an INSERT statement, which allows us
-// to count to ensure that each unique migration was only run once.
-//
-func TestSimultaneousApply(t *testing.T) {
-	concurrency := 4
-	dataTable := fmt.Sprintf("data%d", rand.Int()) // #nosec don't need a strong RNG here
-	migrationsTable := fmt.Sprintf("Migrations %s", time.Now().Format(time.RFC3339Nano))
-	sharedMigrations := []*Migration{
-		{
-			ID:     "2020-05-01 Sleep",
-			Script: "SELECT pg_sleep(1)",
-		},
-		{
-			ID: "2020-05-02 Create Data Table",
-			Script: fmt.Sprintf(`CREATE TABLE %s (
-				id INTEGER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
-				created_at TIMESTAMP WITH TIME ZONE NOT NULL
-			)`, dataTable),
-		},
-		{
-			ID:     "2020-05-03 Add Initial Record",
-			Script: fmt.Sprintf(`INSERT INTO %s (created_at) VALUES (NOW())`, dataTable),
-		},
+// TestApplyReportingChanges ensures that changes are reported only when a
+// migration was actually applied.
+func TestApplyReportingChanges(t *testing.T) {
+	withEachDB(t, func(db *pgxpool.Pool) {
+		migrator := makeTestMigrator()
+		changed, err := migrator.ApplyReportingChanges(db, testMigrations(t, "useless-ansi"))
+		if err != nil {
+			t.Error(err)
+		}
+		if !changed {
+			t.Error("Expected changes to be reported on the first Apply")
+		}
+
+		changed, err = migrator.ApplyReportingChanges(db, testMigrations(t, "useless-ansi"))
+		if err != nil {
+			t.Error(err)
+		}
+		if changed {
+			t.Error("Expected no changes to be reported when already up to date")
+		}
+	})
+}
+
+// TestResume ensures that each migration is committed in its own transaction,
+// so that those before a failure stay applied, and that a second Resume
+// continues from the migration which failed.
+func TestResume(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectApplyOne := func(applied []string) {
+		mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnResult(pgconn.CommandTag{})
+		mock.ExpectBegin()
+		mock.ExpectExec("^\\s*CREATE TABLE").WillReturnResult(pgconn.CommandTag{})
+		mock.ExpectQuery("^\\s*SELECT COALESCE\\(character_maximum_length").
+			WillReturnRows(pgxmock.NewRows([]string{"width"}).AddRow(int32(32)))
+		rows := pgxmock.NewRows([]string{"id"})
+		for _, id := range applied {
+			rows.AddRow(id)
+		}
+		mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(rows)
+	}
+	expectUnlock := func() {
+		mock.ExpectQuery("^SELECT pg_advisory_unlock").WillReturnRows(pgxmock.NewRows([]string{"pg_advisory_unlock"}).AddRow(true))
 	}
+	migrations := testMigrations(t, "useless-ansi")
+	first := "0000-00-00 001 Select 1"
 
-	var wg sync.WaitGroup
-	for i := 0; i < concurrency; i++ {
-		wg.Add(1)
-		go func(i int) {
-			db := connectDB(t, "postgres:latest")
-			migrator := NewMigrator(WithTableName(migrationsTable))
-			err := migrator.Apply(db, sharedMigrations)
-			if err != nil {
-				t.Error(err)
-			}
-			_, err = db.Exec(context.Background(), fmt.Sprintf("INSERT INTO %s (created_at) VALUES (NOW())", dataTable))
-			if err != nil {
-				t.Error(err)
-			}
-			wg.Done()
-		}(i)
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	expectApplyOne(nil)
+	mock.ExpectExec("^SELECT 1").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectCommit()
+	expectUnlock()
+	expectApplyOne([]string{first})
+	mock.ExpectExec("^SELECT 2").WillReturnError(fmt.Errorf("FAIL: interrupted"))
+	mock.ExpectRollback()
+	expectUnlock()
+
+	log := &sliceLog{}
+	migrator := NewMigrator(WithLogger(log))
+	err = migrator.Resume(mock, migrations)
+	expectErrorContains(t, err, "interrupted")
+
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(first))
+	expectApplyOne([]string{first})
+	mock.ExpectCommit()
+	expectUnlock()
+	expectApplyOne([]string{first})
+	mock.ExpectExec("^SELECT 2").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectCommit()
+	expectUnlock()
+
+	err = migrator.Resume(mock, migrations)
+	if err != nil {
+		t.Error(err)
 	}
-	wg.Wait()
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+	resumed := make([]string, 0)
+	for _, msg := range log.msgs {
+		if strings.HasPrefix(msg, "Resuming") {
+			resumed = append(resumed, msg)
+		}
+	}
+	expected := []string{
+		"Resuming: 0 of 2 migrations were already applied\n",
+		"Resuming: 1 of 2 migrations were already applied\n",
+	}
+	if !reflect.DeepEqual(resumed, expected) {
+		t.Errorf("Expected the number already applied to be logged. Got %v", log.msgs)
+	}
+}
 
-	// We expect concurrency + 1 rows in the data table
-	// (1 from the migration, and one each for the
-	// goroutines which ran Apply and then did an
-	// insert afterwards)
-	db := connectDB(t, "postgres:latest")
-	count := 0
-	row := db.QueryRow(context.Background(), fmt.Sprintf("SELECT COUNT(*) FROM %s", dataTable))
-	err := row.Scan(&count)
+func TestGroupMigrations(t *testing.T) {
+	migrations := []*Migration{
+		{ID: "001"},
+		{ID: "002", Group: "billing"},
+		{ID: "003", Group: "billing"},
+		{ID: "004"},
+		{ID: "005"},
+		{ID: "006", Group: "search"},
+	}
+	batches, err := groupMigrations(migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, len(batches))
+	for i, batch := range batches {
+		for _, migration := range batch {
+			ids[i] += migration.ID
+		}
+	}
+	expected := []string{"001", "002003", "004", "005", "006"}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Errorf("Expected batches %v. Got %v", expected, ids)
+	}
+
+	_, err = groupMigrations(append(migrations, &Migration{ID: "007", Group: "billing"}))
+	if !errors.Is(err, ErrSplitGroup) {
+		t.Errorf("Expected %v, got %v", ErrSplitGroup, err)
+	}
+	expectErrorContains(t, err, "'billing' (at migration '007')")
+}
+
+// TestResumeAppliesGroupsTogether ensures that the migrations in a Group are
+// committed in a single transaction by Resume.
+func TestResumeAppliesGroupsTogether(t *testing.T) {
+	mock, err := pgxmock.NewConn()
 	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectBegin()
+	mock.ExpectExec("^\\s*CREATE TABLE").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectQuery("^\\s*SELECT COALESCE\\(character_maximum_length").
+		WillReturnRows(pgxmock.NewRows([]string{"width"}).AddRow(int32(32)))
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^SELECT 1").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^SELECT 2").WillReturnError(fmt.Errorf("FAIL: second"))
+	mock.ExpectRollback()
+	mock.ExpectQuery("^SELECT pg_advisory_unlock").WillReturnRows(pgxmock.NewRows([]string{"pg_advisory_unlock"}).AddRow(true))
+
+	err = NewMigrator().Resume(mock, []*Migration{
+		{ID: "2021-01-01 001", Script: "SELECT 1", Group: "pair"},
+		{ID: "2021-01-01 002", Script: "SELECT 2", Group: "pair"},
+	})
+	expectErrorContains(t, err, "FAIL: second")
+	if err = mock.ExpectationsWereMet(); err != nil {
 		t.Error(err)
 	}
-	if count != concurrency+1 {
-		t.Errorf("Expected to get %d rows in %s table. Instead got %d", concurrency+1, dataTable, count)
+}
+
+func TestResumeWithNilDB(t *testing.T) {
+	err := NewMigrator().Resume(nil, nil)
+	if !errors.Is(err, ErrNilDB) {
+		t.Errorf("Expected %v, got %v", ErrNilDB, err)
 	}
 }
 
-func TestApplyMultistatementMigrations(t *testing.T) {
+// TestApplyWithBootstrap ensures that bootstrap migrations run outside of a
+// transaction (which CREATE INDEX CONCURRENTLY requires) and before the
+// normal migrations.
+func TestApplyWithBootstrap(t *testing.T) {
 	withEachDB(t, func(db *pgxpool.Pool) {
 		migrator := makeTestMigrator()
-		migrationSet1 := []*Migration{
-			{
-				ID: "2019-09-23 Create Artists and Albums",
-				Script: `
-		CREATE TABLE artists (
-			id SERIAL PRIMARY KEY,
-			name CHARACTER VARYING (255) NOT NULL DEFAULT ''
-		);
-		CREATE UNIQUE INDEX idx_artists_name ON artists (name);
-		CREATE TABLE albums (
-			id SERIAL PRIMARY KEY,
-			title CHARACTER VARYING (255) NOT NULL DEFAULT '',
-			artist_id INTEGER NOT NULL REFERENCES artists(id)
-		);
-		`,
-			},
+		dataTable := fmt.Sprintf("bootstrapped%d", rand.Int()) // #nosec don't need a strong RNG here
+		bootstrap := []*Migration{
+			{ID: "0000-00-00 000 Create Table", Script: fmt.Sprintf("CREATE TABLE %s (id INTEGER)", dataTable)},
+			{ID: "0000-00-00 000 Create Index", Script: fmt.Sprintf("CREATE INDEX CONCURRENTLY %s_idx ON %s (id)", dataTable, dataTable)},
 		}
-		err := migrator.Apply(db, migrationSet1)
+		err := migrator.ApplyWithBootstrap(db, bootstrap, testMigrations(t, "useless-ansi"))
 		if err != nil {
-			t.Error(err)
+			t.Fatal(err)
 		}
 
-		err = migrator.Apply(db, migrationSet1)
+		applied, err := migrator.GetAppliedMigrations(db)
 		if err != nil {
 			t.Error(err)
 		}
+		if len(applied) != 4 {
+			t.Errorf("Expected 4 applied migrations. Got %d", len(applied))
+		}
+		if !applied["0000-00-00 000 Create Index"].AppliedAt.Before(applied["0000-00-00 001 Select 1"].AppliedAt) {
+			t.Error("Expected bootstrap migrations to be applied before the others")
+		}
 
-		migrationSet2 := []*Migration{
-			{
-				ID: "2019-09-24 Create Tracks",
-				Script: `
-		CREATE TABLE tracks (
-			id SERIAL PRIMARY KEY,
-			name CHARACTER VARYING (255) NOT NULL DEFAULT '',
-			artist_id INTEGER NOT NULL REFERENCES artists(id),
-			album_id INTEGER NOT NULL REFERENCES albums(id)
-		);`,
-			},
+		err = migrator.ApplyWithBootstrap(db, bootstrap, testMigrations(t, "useless-ansi"))
+		if err != nil {
+			t.Errorf("Expected re-applying to be a no-op. Got %s", err)
 		}
-		err = migrator.Apply(db, migrationSet2)
+	})
+}
+
+func TestApplyWithRequiredExtensions(t *testing.T) {
+	withLatestDB(t, func(db *pgxpool.Pool) {
+		migrator := NewMigrator(
+			WithTableName(time.Now().Format(time.RFC3339Nano)),
+			WithRequiredExtensions("pgcrypto"),
+		)
+		err := migrator.Apply(db, testMigrations(t, "useless-ansi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var installed bool
+		err = db.QueryRow(context.Background(),
+			"SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'pgcrypto')",
+		).Scan(&installed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !installed {
+			t.Error("Expected the pgcrypto extension to be installed")
+		}
+	})
+}
+
+func TestPendingCount(t *testing.T) {
+	withEachDB(t, func(db *pgxpool.Pool) {
+		migrator := makeTestMigrator()
+		migrations := testMigrations(t, "useless-ansi")
+		err := migrator.Apply(db, migrations[:1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		count, err := migrator.PendingCount(db, migrations)
 		if err != nil {
 			t.Error(err)
 		}
+		if count != 1 {
+			t.Errorf("Expected 1 pending migration. Got %d", count)
+		}
 	})
 }
 
-// makeTestMigrator is a utility function which produces a migrator with an
-// isolated environment (isolated due to a unique name for the migration
-// tracking table).
-func makeTestMigrator() *Migrator {
-	tableName := time.Now().Format(time.RFC3339Nano)
-	return NewMigrator(WithTableName(tableName))
+func TestTrackingInfo(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^SELECT to_regclass\\(\\$1\\) IS NOT NULL$").
+		WithArgs(`"schema_migrations"`).
+		WillReturnRows(pgxmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery("^SELECT COUNT\\(DISTINCT id\\) FROM \"schema_migrations\" WHERE rolled_back_at IS NULL$").
+		WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectQuery("^SELECT to_regclass").
+		WillReturnRows(pgxmock.NewRows([]string{"exists"}).AddRow(false))
+
+	exists, count, err := NewMigrator().TrackingInfo(mock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists || count != 3 {
+		t.Errorf("Expected the table to exist with 3 migrations. Got %t, %d", exists, count)
+	}
+
+	exists, count, err = NewMigrator().TrackingInfo(mock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists || count != 0 {
+		t.Errorf("Expected the table not to exist. Got %t, %d", exists, count)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
 }
 
-func testMigrations(t *testing.T, dirName string) []*Migration {
-	path := fmt.Sprintf("test-migrations/%s", dirName)
-	migrations, err := MigrationsFromDirectoryPath(path)
+func TestBlockingQueries(t *testing.T) {
+	mock, err := pgxmock.NewConn()
 	if err != nil {
-		t.Fatalf("Failed to load test migrations from '%s'", path)
+		t.Fatal(err)
 	}
-	return migrations
+	mock.ExpectQuery("^\\s*SELECT blocking.pid").
+		WithArgs(LockIdentifierForTable(DefaultTableName)).
+		WillReturnRows(pgxmock.NewRows([]string{"pid", "query", "state", "pid", "waited"}).
+			AddRow(int32(101), "ALTER TABLE users ADD COLUMN email TEXT", "idle in transaction", int32(202), int64(1500)))
+
+	blocking, err := NewMigrator().BlockingQueries(mock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []BlockingInfo{{PID: 101, Query: "ALTER TABLE users ADD COLUMN email TEXT", State: "idle in transaction", BlockedPID: 202, Waited: 1500 * time.Millisecond}}
+	if !reflect.DeepEqual(blocking, expected) {
+		t.Errorf("Expected %+v. Got %+v", expected, blocking)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	_, err = NewMigrator().BlockingQueries(nil)
+	if !errors.Is(err, ErrNilDB) {
+		t.Errorf("Expected %v, got %v", ErrNilDB, err)
+	}
+	_, err = NewMigrator().BlockingQueries(BadQueryer{})
+	expectErrorContains(t, err, "FAIL")
 }
 
-// assertZonesMatch accepts two Times and fails the test if their time zones
-// don't match.
-func assertZonesMatch(t *testing.T, expected, actual time.Time) {
-	t.Helper()
-	expectedName, expectedOffset := expected.Zone()
-	actualName, actualOffset := actual.Zone()
-	if expectedOffset != actualOffset {
-		t.Errorf("Expected Zone '%s' with offset %d. Got Zone '%s' with offset %d", expectedName, expectedOffset, actualName, actualOffset)
+func TestTrackingInfoFailure(t *testing.T) {
+	_, _, err := NewMigrator().TrackingInfo(nil)
+	if !errors.Is(err, ErrNilDB) {
+		t.Errorf("Expected %v, got %v", ErrNilDB, err)
+	}
+	_, _, err = NewMigrator().TrackingInfo(BadQueryer{})
+	expectErrorContains(t, err, "FAIL: SELECT to_regclass")
+
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^SELECT to_regclass").
+		WillReturnRows(pgxmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery("^SELECT COUNT\\(\\*\\)").WillReturnError(fmt.Errorf("Count Failed"))
+	exists, _, err := NewMigrator(WithSingleVersionMode()).TrackingInfo(mock)
+	expectErrorContains(t, err, "Count Failed")
+	if !exists {
+		t.Error("Expected the table to be reported as existing")
+	}
+}
+
+func TestIsApplied(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^SELECT EXISTS\\(SELECT 1 FROM \"schema_migrations\" WHERE id = \\$1 AND rolled_back_at IS NULL\\)$").
+		WithArgs("2021-01-01 001").
+		WillReturnRows(pgxmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery("^SELECT EXISTS").
+		WithArgs("2021-01-01 002").
+		WillReturnRows(pgxmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectQuery("^SELECT EXISTS").
+		WillReturnError(&pgconn.PgError{Code: undefinedTable})
+
+	migrator := NewMigrator()
+	for _, tc := range []struct {
+		id       string
+		expected bool
+	}{{"2021-01-01 001", true}, {"2021-01-01 002", false}} {
+		applied, err := migrator.IsApplied(mock, tc.id)
+		if err != nil {
+			t.Error(err)
+		}
+		if applied != tc.expected {
+			t.Errorf("Expected IsApplied('%s') to be %t. Got %t", tc.id, tc.expected, applied)
+		}
+	}
+	applied, err := migrator.IsApplied(mock, "2021-01-01 001")
+	if err != nil || applied {
+		t.Errorf("Expected false without an error when the table is missing. Got %t, %v", applied, err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIsAppliedInSingleVersionMode(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^SELECT version FROM").
+		WillReturnRows(pgxmock.NewRows([]string{"version"}).AddRow("2021-01-01 002"))
+
+	applied, err := NewMigrator(WithSingleVersionMode()).IsApplied(mock, "2021-01-01 001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !applied {
+		t.Error("Expected a migration below the version to be applied")
+	}
+}
+
+func TestIsAppliedFailure(t *testing.T) {
+	_, err := NewMigrator().IsApplied(nil, "2021-01-01 001")
+	if !errors.Is(err, ErrNilDB) {
+		t.Errorf("Expected %v, got %v", ErrNilDB, err)
+	}
+	_, err = NewMigrator().IsApplied(BadQueryer{}, "2021-01-01 001")
+	expectErrorContains(t, err, "FAIL")
+}
+
+func TestPlanToTarget(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow("2021-01-01 001"))
+
+	migrations := []*Migration{
+		{ID: "2021-01-01 004", Script: "SELECT 4"},
+		{ID: "2021-01-01 002", Script: "SELECT 2"},
+		{ID: "2021-01-01 001", Script: "SELECT 1"},
+		{ID: "2021-01-01 003", Script: "SELECT 3"},
+	}
+	plan, err := NewMigrator().PlanToTarget(mock, migrations, "2021-01-01 003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan) != 2 {
+		t.Fatalf("Expected 2 migrations in the plan. Got %d", len(plan))
+	}
+	expectID(t, plan[0], "2021-01-01 002")
+	expectID(t, plan[1], "2021-01-01 003")
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPlanToTargetAlreadyApplied(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow("2021-01-01 001"))
+
+	plan, err := NewMigrator().PlanToTarget(mock, []*Migration{
+		{ID: "2021-01-01 001", Script: "SELECT 1"},
+		{ID: "2021-01-01 002", Script: "SELECT 2"},
+	}, "2021-01-01 001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan) != 0 {
+		t.Errorf("Expected an empty plan. Got %d migrations", len(plan))
+	}
+}
+
+func TestPlanToTargetWithoutTrackingTable(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").
+		WillReturnError(&pgconn.PgError{Code: undefinedTable})
+
+	plan, err := NewMigrator().PlanToTarget(mock, []*Migration{
+		{ID: "2021-01-01 002", Script: "SELECT 2"},
+		{ID: "2021-01-01 001", Script: "SELECT 1"},
+	}, "2021-01-01 002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan) != 2 {
+		t.Fatalf("Expected 2 migrations in the plan. Got %d", len(plan))
+	}
+	expectID(t, plan[0], "2021-01-01 001")
+}
+
+func TestPlanToTargetFailure(t *testing.T) {
+	migrations := []*Migration{{ID: "2021-01-01 001", Script: "SELECT 1"}}
+	_, err := NewMigrator().PlanToTarget(nil, migrations, "2021-01-01 001")
+	if !errors.Is(err, ErrNilDB) {
+		t.Errorf("Expected %v, got %v", ErrNilDB, err)
+	}
+	_, err = NewMigrator().PlanToTarget(BadQueryer{}, migrations, "2021-01-01 999")
+	if !errors.Is(err, ErrUnknownTarget) {
+		t.Errorf("Expected %v, got %v", ErrUnknownTarget, err)
+	}
+	_, err = NewMigrator().PlanToTarget(BadQueryer{}, migrations, "2021-01-01 001")
+	expectErrorContains(t, err, "FAIL")
+}
+
+// TestApplyWithBaselineVersion ensures that migrations at or below the
+// baseline are recorded without being run, while later ones are run.
+func TestApplyWithBaselineVersion(t *testing.T) {
+	withEachDB(t, func(db *pgxpool.Pool) {
+		migrator := NewMigrator(
+			WithTableName(time.Now().Format(time.RFC3339Nano)),
+			WithBaselineVersion("0000-00-00 000 Existing Schema"),
+		)
+		migrations := append(testMigrations(t, "useless-ansi"), &Migration{
+			ID:     "0000-00-00 000 Existing Schema",
+			Script: "SELECT * FROM table_which_does_not_exist",
+		})
+		changed, err := migrator.ApplyReportingChanges(db, migrations)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !changed {
+			t.Error("Expected the migrations after the baseline to be applied")
+		}
+
+		applied, err := migrator.GetAppliedMigrations(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(applied) != 3 {
+			t.Errorf("Expected 3 applied migrations. Got %d", len(applied))
+		}
+		if _, exists := applied["0000-00-00 000 Existing Schema"]; !exists {
+			t.Error("Expected the baselined migration to be recorded")
+		}
+	})
+}
+
+// TestApplyWithHoldConnection ensures that the connection a migration ran on
+// is handed back, so temporary tables it created can still be queried.
+func TestApplyWithHoldConnection(t *testing.T) {
+	withLatestDB(t, func(db *pgxpool.Pool) {
+		migrator := NewMigrator(WithTableName(time.Now().Format(time.RFC3339Nano)), WithHoldConnection())
+		err := migrator.Apply(db, []*Migration{
+			{ID: "2021-01-01 Temp Table", Script: "CREATE TEMP TABLE held_results AS SELECT 42 AS answer"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn := migrator.HeldConnection()
+		if conn == nil {
+			t.Fatal("Expected the connection to be held")
+		}
+		defer conn.Release()
+
+		var answer int
+		err = conn.QueryRow(context.Background(), "SELECT answer FROM held_results").Scan(&answer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if answer != 42 {
+			t.Errorf("Expected 42. Got %d", answer)
+		}
+		if migrator.HeldConnection() != nil {
+			t.Error("Expected the connection to be released to the caller only once")
+		}
+	})
+}
+
+// TestTrialApply ensures that migrations are run, and their errors reported,
+// without anything being persisted.
+func TestTrialApply(t *testing.T) {
+	withEachDB(t, func(db *pgxpool.Pool) {
+		migrator := makeTestMigrator()
+		dataTable := fmt.Sprintf("trial%d", rand.Int()) // #nosec don't need a strong RNG here
+		migrations := []*Migration{
+			{ID: "2021-01-01 001 Create", Script: fmt.Sprintf("CREATE TABLE %s (id INTEGER)", dataTable)},
+		}
+		err := migrator.TrialApply(db, migrations)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var exists bool
+		err = db.QueryRow(context.Background(), "SELECT to_regclass($1) IS NOT NULL", dataTable).Scan(&exists)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists {
+			t.Error("Expected the trial's table to be rolled back")
+		}
+		err = db.QueryRow(context.Background(), "SELECT to_regclass($1) IS NOT NULL", migrator.QuotedTableName()).Scan(&exists)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists {
+			t.Error("Expected the tracking table to be rolled back")
+		}
+
+		migrations = append(migrations, &Migration{
+			ID:     "2021-01-01 002 Broken",
+			Script: fmt.Sprintf("INSERT INTO %s (missing_column) VALUES (1)", dataTable),
+		})
+		err = migrator.TrialApply(db, migrations)
+		expectErrorContains(t, err, "2021-01-01 002 Broken")
+	})
+}
+
+func TestTrialApplyAlwaysRollsBack(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectBegin()
+	mock.ExpectExec("^\\s*CREATE TABLE").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectQuery("^\\s*SELECT COALESCE\\(character_maximum_length").WillReturnRows(pgxmock.NewRows([]string{"character_maximum_length"}).AddRow(int32(32)))
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^SELECT 1").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^SELECT 2").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectRollback()
+	mock.ExpectQuery("^SELECT pg_advisory_unlock").WillReturnRows(pgxmock.NewRows([]string{"pg_advisory_unlock"}).AddRow(true))
+
+	err = NewMigrator().TrialApply(mock, testMigrations(t, "useless-ansi"))
+	if err != nil {
+		t.Error(err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestApplyWithDeferredConstraints(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectBegin()
+	mock.ExpectExec("^\\s*CREATE TABLE").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectQuery("^\\s*SELECT COALESCE\\(character_maximum_length").WillReturnRows(pgxmock.NewRows([]string{"character_maximum_length"}).AddRow(int32(32)))
+	mock.ExpectExec("^SET CONSTRAINTS ALL DEFERRED$").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^SELECT 1").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^SELECT 2").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectCommit().WillReturnError(&pgconn.PgError{Code: "23503", Message: "violates foreign key constraint"})
+	mock.ExpectQuery("^SELECT pg_advisory_unlock").WillReturnRows(pgxmock.NewRows([]string{"pg_advisory_unlock"}).AddRow(true))
+
+	err = NewMigrator(WithDeferredConstraints()).Apply(mock, testMigrations(t, "useless-ansi"))
+	expectErrorContains(t, err, "violates foreign key constraint")
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTrialApplyChecksDeferredConstraints(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectBegin()
+	mock.ExpectExec("^\\s*CREATE TABLE").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectQuery("^\\s*SELECT COALESCE\\(character_maximum_length").WillReturnRows(pgxmock.NewRows([]string{"character_maximum_length"}).AddRow(int32(32)))
+	mock.ExpectExec("^SET CONSTRAINTS ALL DEFERRED$").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^SELECT 1").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^SELECT 2").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^SET CONSTRAINTS ALL IMMEDIATE$").WillReturnError(&pgconn.PgError{Code: "23503", Message: "violates foreign key constraint"})
+	mock.ExpectRollback()
+	mock.ExpectQuery("^SELECT pg_advisory_unlock").WillReturnRows(pgxmock.NewRows([]string{"pg_advisory_unlock"}).AddRow(true))
+
+	err = NewMigrator(WithDeferredConstraints()).TrialApply(mock, testMigrations(t, "useless-ansi"))
+	expectErrorContains(t, err, "violates foreign key constraint")
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestApplyThen ensures that the callback's changes are committed along with
+// the migrations, and that its failure rolls everything back.
+func TestApplyThen(t *testing.T) {
+	withEachDB(t, func(db *pgxpool.Pool) {
+		migrator := makeTestMigrator()
+		dataTable := fmt.Sprintf("then%d", rand.Int()) // #nosec don't need a strong RNG here
+		migrations := []*Migration{
+			{ID: "2021-01-01 001 Create", Script: fmt.Sprintf("CREATE TABLE %s (id INTEGER)", dataTable)},
+		}
+		seed := func(ctx context.Context, tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, fmt.Sprintf("INSERT INTO %s (id) VALUES (1)", dataTable))
+			return err
+		}
+		err := migrator.ApplyThen(db, migrations, seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var count int
+		err = db.QueryRow(context.Background(), fmt.Sprintf("SELECT COUNT(*) FROM %s", dataTable)).Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 1 {
+			t.Errorf("Expected the seeded row to be committed. Got %d rows", count)
+		}
+
+		migrations = append(migrations, &Migration{
+			ID:     "2021-01-01 002 Insert",
+			Script: fmt.Sprintf("INSERT INTO %s (id) VALUES (2)", dataTable),
+		})
+		err = migrator.ApplyThen(db, migrations, func(ctx context.Context, tx pgx.Tx) error {
+			return fmt.Errorf("Seed Failed")
+		})
+		expectErrorContains(t, err, "Seed Failed")
+
+		applied, err := migrator.GetAppliedMigrations(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, exists := applied["2021-01-01 002 Insert"]; exists {
+			t.Error("Expected the second migration to be rolled back")
+		}
+	})
+}
+
+// TestApplyFuncMigration ensures that Go migrations run in the same
+// transaction as SQL migrations.
+func TestApplyFuncMigration(t *testing.T) {
+	withEachDB(t, func(db *pgxpool.Pool) {
+		migrator := makeTestMigrator()
+		dataTable := fmt.Sprintf("func%d", rand.Int()) // #nosec don't need a strong RNG here
+		migrations := []*Migration{
+			{ID: "2021-01-01 001 Create", Script: fmt.Sprintf("CREATE TABLE %s (id INTEGER)", dataTable)},
+			{
+				ID:          "2021-01-01 002 Seed",
+				FuncVersion: "v1",
+				Func: func(ctx context.Context, tx pgx.Tx) error {
+					for id := 1; id <= 3; id++ {
+						_, err := tx.Exec(ctx, fmt.Sprintf("INSERT INTO %s (id) VALUES ($1)", dataTable), id)
+						if err != nil {
+							return err
+						}
+					}
+					return nil
+				},
+			},
+		}
+		err := migrator.Apply(db, migrations)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var count int
+		err = db.QueryRow(context.Background(), fmt.Sprintf("SELECT COUNT(*) FROM %s", dataTable)).Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 3 {
+			t.Errorf("Expected the Go migration to insert 3 rows. Got %d", count)
+		}
+
+		err = migrator.Validate(db, migrations)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+// TestApplyWithServerSideQuotingPreservesWhitespace ensures that whitespace in the tracking
+// table's name is preserved when the server quotes it.
+func TestApplyWithServerSideQuotingPreservesWhitespace(t *testing.T) {
+	withEachDB(t, func(db *pgxpool.Pool) {
+		tableName := fmt.Sprintf("quoted migrations %d", rand.Int()) // #nosec don't need a strong RNG here
+		migrator := NewMigrator(WithTableName(tableName), WithServerSideQuoting())
+		err := migrator.Apply(db, testMigrations(t, "useless-ansi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var exists bool
+		err = db.QueryRow(context.Background(), "SELECT to_regclass(quote_ident($1)) IS NOT NULL", tableName).Scan(&exists)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !exists {
+			t.Errorf("Expected a table named '%s' to be created", tableName)
+		}
+
+		applied, err := NewMigrator(WithTableName(tableName), WithServerSideQuoting()).GetAppliedMigrations(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(applied) != 2 {
+			t.Errorf("Expected 2 applied migrations. Got %d", len(applied))
+		}
+	})
+}
+
+// TestUpgradeTrackingTable ensures that a tracking table in the original
+// four-column format is upgraded without losing its rows.
+// TestSquash ensures that a squashed history is replaced by the baseline, and
+// that Apply then treats the baseline as applied
+func TestSquash(t *testing.T) {
+	withEachDB(t, func(db *pgxpool.Pool) {
+		migrator := makeTestMigrator()
+		err := migrator.Apply(db, testMigrations(t, "useless-ansi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		baseline := &Migration{ID: "2022-01-01 Baseline", Script: "CREATE TABLE never_created (id INTEGER)"}
+		err = migrator.Squash(db, baseline)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		applied, err := migrator.GetAppliedMigrations(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(applied) != 1 || applied[baseline.ID] == nil {
+			t.Fatalf("Expected only the baseline to be recorded. Got %v", applied)
+		}
+		if applied[baseline.ID].Checksum != baseline.MD5() {
+			t.Errorf("Expected the baseline's checksum to be recorded. Got '%s'", applied[baseline.ID].Checksum)
+		}
+
+		count, err := migrator.PendingCount(db, []*Migration{baseline})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 0 {
+			t.Errorf("Expected the baseline to be considered applied. Got %d pending", count)
+		}
+	})
+}
+
+func TestUpgradeTrackingTable(t *testing.T) {
+	withEachDB(t, func(db *pgxpool.Pool) {
+		migrator := makeTestMigrator()
+		_, err := db.Exec(context.Background(), fmt.Sprintf(`
+			CREATE TABLE %s (
+				id VARCHAR(255) NOT NULL,
+				checksum VARCHAR(32) NOT NULL DEFAULT '',
+				execution_time_in_millis INTEGER NOT NULL DEFAULT 0,
+				applied_at TIMESTAMP WITH TIME ZONE NOT NULL
+			);
+			INSERT INTO %s (id, checksum, applied_at) VALUES ('2021-01-01 001', 'abc', now())
+		`, migrator.QuotedTableName(), migrator.QuotedTableName()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = migrator.UpgradeTrackingTable(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		applied, err := migrator.GetAppliedMigrations(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		record, exists := applied["2021-01-01 001"]
+		if !exists {
+			t.Fatal("Expected the existing row to be preserved")
+		}
+		if record.Checksum != "abc" || record.ChecksumAlgorithm != ChecksumAlgorithmMD5 {
+			t.Errorf("Expected the existing row's values to be preserved. Got %+v", record)
+		}
+	})
+}
+
+// TestSingleVersionModeTracksLatestVersion ensures that only the most recent version is
+// tracked, and that migrations at or below it aren't run again.
+func TestSingleVersionModeTracksLatestVersion(t *testing.T) {
+	withEachDB(t, func(db *pgxpool.Pool) {
+		migrator := NewMigrator(
+			WithTableName(time.Now().Format(time.RFC3339Nano)),
+			WithSingleVersionMode(),
+		)
+		migrations := testMigrations(t, "useless-ansi")
+		err := migrator.Apply(db, migrations)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var count int
+		var version string
+		err = db.QueryRow(context.Background(), fmt.Sprintf("SELECT COUNT(*), MAX(version) FROM %s", migrator.QuotedTableName())).Scan(&count, &version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 1 || version != "0000-00-00 002 Select 2" {
+			t.Errorf("Expected a single row holding the latest version. Got %d rows, version '%s'", count, version)
+		}
+
+		pending, err := migrator.PendingCount(db, append(migrations, &Migration{ID: "0000-00-00 003 Select 3", Script: "SELECT 3"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pending != 1 {
+			t.Errorf("Expected 1 pending migration. Got %d", pending)
+		}
+	})
+}
+
+func TestApplyWithSingleVersionMode(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectBegin()
+	mock.ExpectExec(`^\s*CREATE TABLE IF NOT EXISTS "schema_migrations" \(\s*id INTEGER NOT NULL PRIMARY KEY,\s*version`).WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectQuery("^\\s*SELECT COALESCE\\(character_maximum_length").WillReturnRows(pgxmock.NewRows([]string{"character_maximum_length"}))
+	mock.ExpectQuery(`^SELECT version FROM "schema_migrations" WHERE id = 1`).
+		WillReturnRows(pgxmock.NewRows([]string{"version"}).AddRow("0000-00-00 001 Select 1"))
+	mock.ExpectExec("^SELECT 2").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO \"schema_migrations\" \\(id, version, applied_at\\)").
+		WithArgs("0000-00-00 002 Select 2", pgxmock.AnyArg()).
+		WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectCommit()
+	mock.ExpectQuery("^SELECT pg_advisory_unlock").WillReturnRows(pgxmock.NewRows([]string{"pg_advisory_unlock"}).AddRow(true))
+
+	err = NewMigrator(WithSingleVersionMode()).Apply(mock, testMigrations(t, "useless-ansi"))
+	if err != nil {
+		t.Error(err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestApplyInteractive ensures that a skipped migration's changes are rolled
+// back to its savepoint while the others are committed.
+func TestApplyInteractive(t *testing.T) {
+	withEachDB(t, func(db *pgxpool.Pool) {
+		migrator := makeTestMigrator()
+		dataTable := fmt.Sprintf("interactive%d", rand.Int()) // #nosec don't need a strong RNG here
+		migrations := []*Migration{
+			{ID: "2021-01-01 001 Create", Script: fmt.Sprintf("CREATE TABLE %s (id INTEGER)", dataTable)},
+			{ID: "2021-01-01 002 Broken", Script: fmt.Sprintf("INSERT INTO %s (id) VALUES (1); SELECT 1/0", dataTable)},
+			{ID: "2021-01-01 003 Insert", Script: fmt.Sprintf("INSERT INTO %s (id) VALUES (3)", dataTable)},
+		}
+		err := migrator.ApplyInteractive(db, migrations, func(m *Migration, err error) Decision {
+			return Skip
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		applied, err := migrator.GetAppliedMigrations(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, exists := applied["2021-01-01 002 Broken"]; exists || len(applied) != 2 {
+			t.Errorf("Expected all but the skipped migration to be applied. Got %v", applied)
+		}
+
+		var ids []int32
+		rows, err := db.Query(context.Background(), fmt.Sprintf("SELECT id FROM %s", dataTable))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id int32
+			if err = rows.Scan(&id); err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, id)
+		}
+		if len(ids) != 1 || ids[0] != 3 {
+			t.Errorf("Expected only the row from the third migration. Got %v", ids)
+		}
+	})
+}
+
+// TestApplyWithClockTimestamp ensures that migrations run in the same
+// transaction record distinct server times.
+func TestApplyWithClockTimestamp(t *testing.T) {
+	withEachDB(t, func(db *pgxpool.Pool) {
+		migrator := NewMigrator(
+			WithTableName(time.Now().Format(time.RFC3339Nano)),
+			WithAppliedAtSource(AppliedAtClockTimestamp),
+		)
+		err := migrator.Apply(db, testMigrations(t, "useless-ansi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		applied, err := migrator.GetAppliedMigrations(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		first, second := applied["0000-00-00 001 Select 1"], applied["0000-00-00 002 Select 2"]
+		if !second.AppliedAt.After(first.AppliedAt) {
+			t.Errorf("Expected distinct applied times. Got %s and %s", first.AppliedAt, second.AppliedAt)
+		}
+	})
+}
+
+// TestApplyToAll ensures that each database is migrated independently, and
+// that errors are reported at the index of the database which caused them.
+func TestApplyToAll(t *testing.T) {
+	withLatestDB(t, func(db *pgxpool.Pool) {
+		migrator := makeTestMigrator()
+		errs := migrator.ApplyToAll([]Connection{db, nil, db}, testMigrations(t, "useless-ansi"), 2)
+		if len(errs) != 3 {
+			t.Fatalf("Expected 3 errors. Got %d", len(errs))
+		}
+		if errs[0] != nil || errs[2] != nil {
+			t.Errorf("Expected no errors for the valid databases. Got %v, %v", errs[0], errs[2])
+		}
+		if !errors.Is(errs[1], ErrNilDB) {
+			t.Errorf("Expected %v for the nil database. Got %v", ErrNilDB, errs[1])
+		}
+
+		applied, err := migrator.GetAppliedMigrations(db)
+		if err != nil {
+			t.Error(err)
+		}
+		if len(applied) != 2 {
+			t.Errorf("Expected 2 applied migrations. Got %d", len(applied))
+		}
+	})
+}
+
+// TestApplyWithMinServerVersion ensures that Apply proceeds on servers which
+// meet the required version, and refuses to on ones which don't.
+func TestApplyWithMinServerVersion(t *testing.T) {
+	withEachDB(t, func(db *pgxpool.Pool) {
+		tableName := time.Now().Format(time.RFC3339Nano)
+		err := NewMigrator(WithTableName(tableName), WithMinServerVersion(10)).Apply(db, testMigrations(t, "useless-ansi"))
+		if err != nil {
+			t.Error(err)
+		}
+
+		err = NewMigrator(WithTableName(tableName), WithMinServerVersion(999)).Apply(db, testMigrations(t, "useless-ansi"))
+		if !errors.Is(err, ErrServerVersionTooOld) {
+			t.Errorf("Expected %v, got %v", ErrServerVersionTooOld, err)
+		}
+	})
+}
+
+// TestApplyWithVerify ensures that a migration's Verify query is run after
+// its Script, and that a falsy result fails the migration and rolls it back.
+func TestApplyWithVerify(t *testing.T) {
+	withEachDB(t, func(db *pgxpool.Pool) {
+		migrator := makeTestMigrator()
+		dataTable := fmt.Sprintf("verified%d", rand.Int()) // #nosec don't need a strong RNG here
+		err := migrator.Apply(db, []*Migration{
+			{
+				ID:     "2022-01-01 Create Verified Table",
+				Script: fmt.Sprintf("CREATE TABLE %s (name VARCHAR(255))", dataTable),
+				Verify: fmt.Sprintf("SELECT COUNT(*) FROM information_schema.columns WHERE table_name = '%s' AND column_name = 'name'", dataTable),
+			},
+		})
+		if err != nil {
+			t.Error(err)
+		}
+
+		err = migrator.Apply(db, []*Migration{
+			{
+				ID:     "2022-01-02 Add Column Badly",
+				Script: fmt.Sprintf("ALTER TABLE %s ADD COLUMN nmae VARCHAR(255)", dataTable),
+				Verify: fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = '%s' AND column_name = 'email')", dataTable),
+			},
+		})
+		if !errors.Is(err, ErrVerificationFailed) {
+			t.Errorf("Expected %v, got %v", ErrVerificationFailed, err)
+		}
+
+		applied, err := migrator.GetAppliedMigrations(db)
+		if err != nil {
+			t.Error(err)
+		}
+		if len(applied) != 1 {
+			t.Errorf("Expected only the verified migration to be applied. Got %d", len(applied))
+		}
+	})
+}
+
+// TestApplyWithHealthCheck ensures that the health check is run after each
+// migration, and that a falsy result fails the migration and rolls it back.
+func TestApplyWithHealthCheck(t *testing.T) {
+	withEachDB(t, func(db *pgxpool.Pool) {
+		dataTable := fmt.Sprintf("healthy%d", rand.Int()) // #nosec don't need a strong RNG here
+		migrator := NewMigrator(
+			WithTableName(time.Now().Format(time.RFC3339Nano)),
+			WithHealthCheck(fmt.Sprintf("SELECT NOT EXISTS (SELECT 1 FROM %s WHERE name IS NULL)", dataTable)),
+		)
+		err := migrator.Apply(db, []*Migration{
+			{ID: "2022-01-01 Create Healthy Table", Script: fmt.Sprintf("CREATE TABLE %s (name VARCHAR(255))", dataTable)},
+		})
+		if err != nil {
+			t.Error(err)
+		}
+
+		err = migrator.Apply(db, []*Migration{
+			{ID: "2022-01-02 Insert Unhealthy Row", Script: fmt.Sprintf("INSERT INTO %s (name) VALUES (NULL)", dataTable)},
+		})
+		if !errors.Is(err, ErrHealthCheckFailed) {
+			t.Errorf("Expected %v, got %v", ErrHealthCheckFailed, err)
+		}
+
+		applied, err := migrator.GetAppliedMigrations(db)
+		if err != nil {
+			t.Error(err)
+		}
+		if len(applied) != 1 {
+			t.Errorf("Expected only the healthy migration to be applied. Got %d", len(applied))
+		}
+	})
+}
+
+func TestRunWithFailingHealthCheck(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^SELECT 1").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectQuery("^SELECT healthy FROM probe$").WillReturnError(fmt.Errorf("FAIL: health"))
+
+	migrator := NewMigrator(WithHealthCheck("SELECT healthy FROM probe"))
+	_, err = migrator.run(mock, []*Migration{{ID: "2021-01-01 001", Script: "SELECT 1"}}, nil)
+	expectErrorContains(t, err, "health check failed")
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestFailedMigration ensures that a migration with a syntax error triggers
+// an expected error when Apply() is run. This test is run on every test database
+func TestFailedMigration(t *testing.T) {
+	withEachDB(t, func(db *pgxpool.Pool) {
+		tableName := time.Now().Format(time.RFC3339Nano)
+		migrator := NewMigrator(WithTableName(tableName))
+		migrations := []*Migration{
+			{
+				ID:     "2019-01-01 Bad Migration",
+				Script: "CREATE TIBBLE bad_table_name (id INTEGER NOT NULL PRIMARY KEY)",
+			},
+		}
+		err := migrator.Apply(db, migrations)
+		expectErrorContains(t, err, "TIBBLE")
+
+		query := "SELECT * FROM " + migrator.QuotedTableName()
+		rows, _ := db.Query(context.Background(), query)
+		defer rows.Close()
+
+		// We expect either an error (because the transaction was rolled back
+		// and the table no longer exists)... or  a query with no results
+		if rows != nil {
+			if rows.Next() {
+				t.Error("Record was inserted in tracking table even though the migration failed")
+			}
+		}
+	})
+}
+
+// TestFailedMigrationWithTableOutsideTransaction ensures that the tracking
+// table survives a failed migration when it was created outside of the
+// migration transaction.
+func TestFailedMigrationWithTableOutsideTransaction(t *testing.T) {
+	withEachDB(t, func(db *pgxpool.Pool) {
+		tableName := time.Now().Format(time.RFC3339Nano)
+		migrator := NewMigrator(WithTableName(tableName), WithTableOutsideTransaction())
+		migrations := []*Migration{
+			{
+				ID:     "2019-01-01 Bad Migration",
+				Script: "CREATE TIBBLE bad_table_name (id INTEGER NOT NULL PRIMARY KEY)",
+			},
+		}
+		err := migrator.Apply(db, migrations)
+		expectErrorContains(t, err, "TIBBLE")
+
+		applied, err := migrator.GetAppliedMigrations(db)
+		if err != nil {
+			t.Errorf("Expected the tracking table to exist after the failure. Got %s", err)
+		}
+		if len(applied) > 0 {
+			t.Error("Record was inserted in tracking table even though the migration failed")
+		}
+	})
+}
+
+// TestRepairConcurrentIndexes creates an invalid index by interrupting a
+// CREATE UNIQUE INDEX CONCURRENTLY with duplicate data, and ensures it is
+// reported, and then dropped when the Migrator is configured to do so.
+func TestRepairConcurrentIndexes(t *testing.T) {
+	withEachDB(t, func(db *pgxpool.Pool) {
+		dataTable := fmt.Sprintf("dupes%d", rand.Int()) // #nosec don't need a strong RNG here
+		_, err := db.Exec(context.Background(), fmt.Sprintf(`
+			CREATE TABLE %s (name VARCHAR(255));
+			INSERT INTO %s (name) VALUES ('dupe'), ('dupe')
+		`, dataTable, dataTable))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(context.Background(), fmt.Sprintf("CREATE UNIQUE INDEX CONCURRENTLY idx_%s ON %s (name)", dataTable, dataTable))
+		if err == nil {
+			t.Fatal("Expected the unique index to fail to build")
+		}
+
+		err = makeTestMigrator().RepairConcurrentIndexes(db)
+		if !errors.Is(err, ErrInvalidIndexes) {
+			t.Errorf("Expected %v, got %v", ErrInvalidIndexes, err)
+		}
+		expectErrorContains(t, err, "idx_"+dataTable)
+
+		err = NewMigrator(WithDropInvalidIndexes()).RepairConcurrentIndexes(db)
+		if err != nil {
+			t.Error(err)
+		}
+
+		err = makeTestMigrator().RepairConcurrentIndexes(db)
+		if err != nil {
+			t.Errorf("Expected no invalid indexes to remain. Got %s", err)
+		}
+	})
+}
+
+// TestRepairConcurrentIndexesSkipsIndexesBeingBuilt ensures that an invalid
+// index on a table another session holds CREATE INDEX CONCURRENTLY's lock on
+// isn't reported or dropped, since it may still be being built
+func TestRepairConcurrentIndexesSkipsIndexesBeingBuilt(t *testing.T) {
+	withLatestDB(t, func(db *pgxpool.Pool) {
+		ctx := context.Background()
+		dataTable := fmt.Sprintf("building%d", rand.Int()) // #nosec don't need a strong RNG here
+		_, err := db.Exec(ctx, fmt.Sprintf(`
+			CREATE TABLE %s (name VARCHAR(255));
+			INSERT INTO %s (name) VALUES ('dupe'), ('dupe')
+		`, dataTable, dataTable))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(ctx, fmt.Sprintf("CREATE UNIQUE INDEX CONCURRENTLY idx_%s ON %s (name)", dataTable, dataTable))
+		if err == nil {
+			t.Fatal("Expected the unique index to fail to build")
+		}
+
+		// Simulate a build in progress by holding the lock it would hold
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = tx.Rollback(ctx) }()
+		_, err = tx.Exec(ctx, fmt.Sprintf("LOCK TABLE %s IN SHARE UPDATE EXCLUSIVE MODE", dataTable))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = NewMigrator(WithDropInvalidIndexes()).RepairConcurrentIndexes(db)
+		if err != nil {
+			t.Error(err)
+		}
+		_ = tx.Rollback(ctx)
+
+		err = makeTestMigrator().RepairConcurrentIndexes(db)
+		expectErrorContains(t, err, "idx_"+dataTable)
+		err = NewMigrator(WithDropInvalidIndexes()).RepairConcurrentIndexes(db)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+// TestSimultaneousApply creates multiple Migrators and multiple distinct
+// connections to each test database and attempts to call .Apply() on them all
+// concurrently. The migrations include an INSERT statement, which allows us
+// to count to ensure that each unique migration was only run once.
+//
+func TestSimultaneousApply(t *testing.T) {
+	concurrency := 4
+	dataTable := fmt.Sprintf("data%d", rand.Int()) // #nosec don't need a strong RNG here
+	migrationsTable := fmt.Sprintf("Migrations %s", time.Now().Format(time.RFC3339Nano))
+	sharedMigrations := []*Migration{
+		{
+			ID:     "2020-05-01 Sleep",
+			Script: "SELECT pg_sleep(1)",
+		},
+		{
+			ID: "2020-05-02 Create Data Table",
+			Script: fmt.Sprintf(`CREATE TABLE %s (
+				id INTEGER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+				created_at TIMESTAMP WITH TIME ZONE NOT NULL
+			)`, dataTable),
+		},
+		{
+			ID:     "2020-05-03 Add Initial Record",
+			Script: fmt.Sprintf(`INSERT INTO %s (created_at) VALUES (NOW())`, dataTable),
+		},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			db := connectDB(t, "postgres:latest")
+			migrator := NewMigrator(WithTableName(migrationsTable))
+			err := migrator.Apply(db, sharedMigrations)
+			if err != nil {
+				t.Error(err)
+			}
+			_, err = db.Exec(context.Background(), fmt.Sprintf("INSERT INTO %s (created_at) VALUES (NOW())", dataTable))
+			if err != nil {
+				t.Error(err)
+			}
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+
+	// We expect concurrency + 1 rows in the data table
+	// (1 from the migration, and one each for the
+	// goroutines which ran Apply and then did an
+	// insert afterwards)
+	db := connectDB(t, "postgres:latest")
+	count := 0
+	row := db.QueryRow(context.Background(), fmt.Sprintf("SELECT COUNT(*) FROM %s", dataTable))
+	err := row.Scan(&count)
+	if err != nil {
+		t.Error(err)
+	}
+	if count != concurrency+1 {
+		t.Errorf("Expected to get %d rows in %s table. Instead got %d", concurrency+1, dataTable, count)
+	}
+}
+
+func TestApplyMultistatementMigrations(t *testing.T) {
+	withEachDB(t, func(db *pgxpool.Pool) {
+		migrator := makeTestMigrator()
+		migrationSet1 := []*Migration{
+			{
+				ID: "2019-09-23 Create Artists and Albums",
+				Script: `
+		CREATE TABLE artists (
+			id SERIAL PRIMARY KEY,
+			name CHARACTER VARYING (255) NOT NULL DEFAULT ''
+		);
+		CREATE UNIQUE INDEX idx_artists_name ON artists (name);
+		CREATE TABLE albums (
+			id SERIAL PRIMARY KEY,
+			title CHARACTER VARYING (255) NOT NULL DEFAULT '',
+			artist_id INTEGER NOT NULL REFERENCES artists(id)
+		);
+		`,
+			},
+		}
+		err := migrator.Apply(db, migrationSet1)
+		if err != nil {
+			t.Error(err)
+		}
+
+		err = migrator.Apply(db, migrationSet1)
+		if err != nil {
+			t.Error(err)
+		}
+
+		migrationSet2 := []*Migration{
+			{
+				ID: "2019-09-24 Create Tracks",
+				Script: `
+		CREATE TABLE tracks (
+			id SERIAL PRIMARY KEY,
+			name CHARACTER VARYING (255) NOT NULL DEFAULT '',
+			artist_id INTEGER NOT NULL REFERENCES artists(id),
+			album_id INTEGER NOT NULL REFERENCES albums(id)
+		);`,
+			},
+		}
+		err = migrator.Apply(db, migrationSet2)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+// TestApplyDataMigration ensures that a Migration with Data is bulk-loaded
+// via CopyFrom and recorded in the tracking table.
+func TestApplyDataMigration(t *testing.T) {
+	withEachDB(t, func(db *pgxpool.Pool) {
+		migrator := makeTestMigrator()
+		dataTable := fmt.Sprintf("colors%d", rand.Int()) // #nosec don't need a strong RNG here
+		migrations := []*Migration{
+			{
+				ID:     "2022-01-01 Create Colors",
+				Script: fmt.Sprintf("CREATE TABLE %s (id INTEGER NOT NULL, name VARCHAR(255) NOT NULL)", dataTable),
+			},
+			{
+				ID: "2022-01-02 Seed Colors",
+				Data: &DataMigration{
+					TableName: pgx.Identifier{dataTable},
+					Columns:   []string{"id", "name"},
+					Source: pgx.CopyFromRows([][]interface{}{
+						{1, "red"},
+						{2, "green"},
+						{3, "blue"},
+					}),
+				},
+			},
+		}
+		err := migrator.Apply(db, migrations)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		count := 0
+		err = db.QueryRow(context.Background(), fmt.Sprintf("SELECT COUNT(*) FROM %s", dataTable)).Scan(&count)
+		if err != nil {
+			t.Error(err)
+		}
+		if count != 3 {
+			t.Errorf("Expected 3 rows to be copied. Got %d", count)
+		}
+
+		applied, err := migrator.GetAppliedMigrations(db)
+		if err != nil {
+			t.Error(err)
+		}
+		seed := applied["2022-01-02 Seed Colors"]
+		if seed == nil {
+			t.Fatal("Expected the data migration to be recorded")
+		}
+		if seed.Checksum == "" || seed.Checksum == (&Migration{}).MD5() {
+			t.Errorf("Expected the checksum to be computed from the copied rows. Got '%s'", seed.Checksum)
+		}
+	})
+}
+
+func TestComputeMigrationPlanWithPreserveOrder(t *testing.T) {
+	for _, preserve := range []bool{false, true} {
+		mock, err := pgxmock.NewConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(
+			pgxmock.NewRows([]string{"id"}).AddRow("2021-01-01 001"),
+		)
+
+		migrator := NewMigrator()
+		expectedOrder := []string{"2021-01-01 002", "2021-01-01 003"}
+		if preserve {
+			migrator = NewMigrator(WithPreserveOrder())
+			expectedOrder = []string{"2021-01-01 003", "2021-01-01 002"}
+		}
+		migrations := []*Migration{
+			{ID: "2021-01-01 003"},
+			{ID: "2021-01-01 001"},
+			{ID: "2021-01-01 002"},
+		}
+		plan, err := migrator.computeMigrationPlan(mock, migrations)
+		if err != nil {
+			t.Error(err)
+		}
+		if len(plan) != len(expectedOrder) {
+			t.Fatalf("Expected %d migrations in the plan, got %d", len(expectedOrder), len(plan))
+		}
+		for i, migration := range plan {
+			expectID(t, migration, expectedOrder[i])
+		}
+	}
+}
+
+func TestComputeMigrationPlanExcludesRolledBackMigrations(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id\\s+FROM \\S+\\s+WHERE rolled_back_at IS NULL").WillReturnRows(
+		pgxmock.NewRows([]string{"id"}).AddRow("2021-01-01 001"),
+	)
+
+	plan, err := NewMigrator().computeMigrationPlan(mock, []*Migration{
+		{ID: "2021-01-01 001"},
+		{ID: "2021-01-01 002"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan) != 1 || plan[0].ID != "2021-01-01 002" {
+		t.Errorf("Expected only the rolled back migration to be planned. Got %v", plan)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestApplyReappliesRolledBackMigrations ensures that a migration whose
+// tracking row is marked as rolled back is applied again, and that the new
+// record is reported while the old one is kept for history.
+func TestApplyReappliesRolledBackMigrations(t *testing.T) {
+	withEachDB(t, func(db *pgxpool.Pool) {
+		migrator := makeTestMigrator()
+		err := migrator.Apply(db, testMigrations(t, "useless-ansi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = db.Exec(context.Background(), fmt.Sprintf(
+			"UPDATE %s SET rolled_back_at = now() WHERE id = $1", migrator.QuotedTableName(),
+		), "0000-00-00 002 Select 2")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		changed, err := migrator.ApplyReportingChanges(db, testMigrations(t, "useless-ansi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !changed {
+			t.Error("Expected the rolled back migration to be applied again")
+		}
+
+		applied, err := migrator.GetAppliedMigrations(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if applied["0000-00-00 002 Select 2"].RolledBackAt != nil {
+			t.Error("Expected the most recent record of the re-applied migration to be returned")
+		}
+
+		var count int
+		err = db.QueryRow(context.Background(), fmt.Sprintf(
+			"SELECT COUNT(*) FROM %s WHERE id = $1", migrator.QuotedTableName(),
+		), "0000-00-00 002 Select 2").Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 2 {
+			t.Errorf("Expected the rolled back record to be kept. Got %d records", count)
+		}
+	})
+}
+
+func TestApplyWithTimingLog(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectBegin()
+	mock.ExpectExec("^\\s*CREATE TABLE").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectQuery("^\\s*SELECT COALESCE\\(character_maximum_length").WillReturnRows(pgxmock.NewRows([]string{"character_maximum_length"}).AddRow(int32(32)))
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(
+		pgxmock.NewRows([]string{"id"}),
+	)
+	mock.ExpectExec("^SELECT 1").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectCommit()
+	mock.ExpectQuery("^SELECT pg_advisory_unlock").WillReturnRows(pgxmock.NewRows([]string{"pg_advisory_unlock"}).AddRow(true))
+
+	var logged sliceLog
+	migrator := NewMigrator(WithLogger(&logged), WithTimingLog())
+	err = migrator.Apply(mock, []*Migration{{ID: "2021-01-01 001", Script: "SELECT 1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	timing := regexp.MustCompile(`^Timing: lock: \S+, create: \S+, plan: \S+, migrations: \S+\n$`)
+	last := logged.msgs[len(logged.msgs)-1]
+	if !timing.MatchString(last) {
+		t.Errorf("Expected a timing breakdown to be logged last. Got '%s'", last)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	matching := &Migration{ID: "2021-01-01 001 Matching", Script: "SELECT 1"}
+	edited := &Migration{ID: "2021-01-01 002 Edited", Script: "SELECT 2 -- edited"}
+	withID := &Migration{ID: "2021-01-01 003 With ID", Script: "SELECT 3"}
+	unknown := &Migration{ID: "2021-01-01 004 Unknown", Script: "SELECT 4"}
+	pending := &Migration{ID: "2021-01-01 006 Pending", Script: "SELECT 6"}
+
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	mock.ExpectQuery("^\\s*SELECT id, checksum").WillReturnRows(
+		pgxmock.NewRows(strings.Split(AppliedMigrationColumns, ", ")).
+			AddRow(matching.ID, matching.MD5(), 0, now, ChecksumAlgorithmMD5, "", "", nil).
+			AddRow(edited.ID, (&Migration{Script: "SELECT 2"}).MD5(), 0, now, ChecksumAlgorithmMD5, "", "", nil).
+			AddRow(withID.ID, withID.MD5WithID(), 0, now, ChecksumAlgorithmMD5WithID, "", "", nil).
+			AddRow(unknown.ID, "abc", 0, now, "sha3", "", "", nil).
+			AddRow("2021-01-01 005 Missing", "abc", 0, now, ChecksumAlgorithmMD5, "", "", nil),
+	)
+
+	err = NewMigrator().Validate(mock, []*Migration{matching, edited, withID, unknown, pending})
+	if !errors.Is(err, ErrDrift) {
+		t.Fatalf("Expected %v, got %v", ErrDrift, err)
+	}
+	expectErrorContains(t, err, "'2021-01-01 002 Edited' was applied with checksum")
+	expectErrorContains(t, err, "'2021-01-01 004 Unknown' has unknown checksum algorithm 'sha3'")
+	expectErrorContains(t, err, "'2021-01-01 005 Missing' was applied, but is missing")
+	for _, id := range []string{matching.ID, withID.ID, pending.ID} {
+		if strings.Contains(err.Error(), id) {
+			t.Errorf("Expected no drift for '%s'. Got %s", id, err)
+		}
+	}
+}
+
+func TestValidateWithChecksumSigner(t *testing.T) {
+	signer := func(checksum string) string { return "signed:" + checksum }
+	signed := &Migration{ID: "2021-01-01 001 Signed", Script: "SELECT 1"}
+	tampered := &Migration{ID: "2021-01-01 002 Tampered", Script: "SELECT 2"}
+	unsigned := &Migration{ID: "2021-01-01 003 Unsigned", Script: "SELECT 3"}
+
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	columns := append(strings.Split(AppliedMigrationColumns, ", "), "checksum_signature")
+	mock.ExpectQuery("^\\s*SELECT id, checksum.*checksum_signature").WillReturnRows(
+		pgxmock.NewRows(columns).
+			AddRow(signed.ID, signed.MD5(), 0, now, ChecksumAlgorithmMD5, "", "", nil, signer(signed.MD5())).
+			AddRow(tampered.ID, tampered.MD5(), 0, now, ChecksumAlgorithmMD5, "", "", nil, signer("abc")).
+			AddRow(unsigned.ID, unsigned.MD5(), 0, now, ChecksumAlgorithmMD5, "", "", nil, ""),
+	)
+
+	err = NewMigrator(WithChecksumSigner(signer)).Validate(mock, []*Migration{signed, tampered, unsigned})
+	if !errors.Is(err, ErrDrift) {
+		t.Fatalf("Expected %v, got %v", ErrDrift, err)
+	}
+	expectErrorContains(t, err, "'2021-01-01 002 Tampered' has an invalid checksum signature")
+	expectErrorContains(t, err, "'2021-01-01 003 Unsigned' has an invalid checksum signature")
+	if strings.Contains(err.Error(), signed.ID) {
+		t.Errorf("Expected no drift for '%s'. Got %s", signed.ID, err)
+	}
+}
+
+func TestCompareWith(t *testing.T) {
+	now := time.Now()
+	rows := func(checksums map[string]string) *pgxmock.Rows {
+		ids := make([]string, 0, len(checksums))
+		for id := range checksums {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		rows := pgxmock.NewRows(strings.Split(AppliedMigrationColumns, ", "))
+		for _, id := range ids {
+			rows.AddRow(id, checksums[id], 0, now, ChecksumAlgorithmMD5, "", "", nil)
+		}
+		return rows
+	}
+
+	dbA, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbA.ExpectQuery("^\\s*SELECT id, checksum").WillReturnRows(
+		rows(map[string]string{"001 Both": "aaa", "002 Only A": "bbb", "004 Different": "ccc"}).
+			AddRow("005 Rolled Back", "ddd", 0, now, ChecksumAlgorithmMD5, "", "", &now),
+	)
+	dbB, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbB.ExpectQuery("^\\s*SELECT id, checksum").WillReturnRows(
+		rows(map[string]string{"001 Both": "aaa", "003 Only B": "bbb", "004 Different": "xxx"}),
+	)
+
+	onlyInA, onlyInB, checksumDiffs, err := NewMigrator().CompareWith(dbA, dbB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(onlyInA, ",") != "002 Only A" {
+		t.Errorf("Expected only '002 Only A' in A. Got %v", onlyInA)
+	}
+	if strings.Join(onlyInB, ",") != "003 Only B" {
+		t.Errorf("Expected only '003 Only B' in B. Got %v", onlyInB)
+	}
+	if strings.Join(checksumDiffs, ",") != "004 Different" {
+		t.Errorf("Expected a checksum difference for '004 Different'. Got %v", checksumDiffs)
+	}
+}
+
+func TestCompareWithFailure(t *testing.T) {
+	_, _, _, err := NewMigrator().CompareWith(BadQueryer{}, nil)
+	if !errors.Is(err, ErrNilDB) {
+		t.Errorf("Expected %v, got %v", ErrNilDB, err)
+	}
+
+	dbA, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbA.ExpectQuery("^\\s*SELECT id, checksum").
+		WillReturnRows(pgxmock.NewRows(strings.Split(AppliedMigrationColumns, ", ")))
+	_, _, _, err = NewMigrator().CompareWith(dbA, BadQueryer{})
+	expectErrorContains(t, err, "reading applied migrations from dbB: FAIL")
+}
+
+func TestVerifyOrder(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	mock.ExpectQuery("^\\s*SELECT id, checksum.*ORDER BY applied_at ASC, id ASC").WillReturnRows(
+		pgxmock.NewRows(strings.Split(AppliedMigrationColumns, ", ")).
+			AddRow("2021-01-01 001", "abc", 0, now, ChecksumAlgorithmMD5, "", "", nil).
+			AddRow("2021-01-01 003", "abc", 0, now.Add(time.Second), ChecksumAlgorithmMD5, "", "", nil).
+			AddRow("2021-01-01 002", "abc", 0, now.Add(2*time.Second), ChecksumAlgorithmMD5, "", "", nil).
+			AddRow("2021-01-01 004", "abc", 0, now.Add(3*time.Second), ChecksumAlgorithmMD5, "", "", nil),
+	)
+
+	err = NewMigrator().VerifyOrder(mock)
+	if !errors.Is(err, ErrOutOfOrder) {
+		t.Fatalf("Expected %v, got %v", ErrOutOfOrder, err)
+	}
+	expectErrorContains(t, err, "'2021-01-01 002' was applied after '2021-01-01 003'")
+	if strings.Contains(err.Error(), "'2021-01-01 004' was applied") {
+		t.Errorf("Expected only one out of order migration. Got %s", err)
+	}
+}
+
+func TestVerifyOrderInOrder(t *testing.T) {
+	withEachDB(t, func(db *pgxpool.Pool) {
+		migrator := makeTestMigrator()
+		err := migrator.Apply(db, testMigrations(t, "useless-ansi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = migrator.VerifyOrder(db)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestVerifyOrderFailure(t *testing.T) {
+	err := NewMigrator().VerifyOrder(nil)
+	if !errors.Is(err, ErrNilDB) {
+		t.Errorf("Expected %v, got %v", ErrNilDB, err)
+	}
+	err = NewMigrator().VerifyOrder(BadQueryer{})
+	expectErrorContains(t, err, "FAIL")
+}
+
+func TestJoinErrs(t *testing.T) {
+	if err := joinErrs(nil, nil); err != nil {
+		t.Errorf("Expected nil, got %v", err)
+	}
+	if err := joinErrs(nil, ErrNilDB); err != ErrNilDB {
+		t.Errorf("Expected a single error to be returned as it is. Got %v", err)
+	}
+
+	pgErr := &pgconn.PgError{Code: "42P01", Message: "relation does not exist"}
+	err := joinErrs(fmt.Errorf("migration failed: %w", pgErr), nil, ErrLockNotHeld)
+	if !errors.Is(err, ErrLockNotHeld) {
+		t.Errorf("Expected errors.Is to match the second error. Got %v", err)
+	}
+	var target *pgconn.PgError
+	if !errors.As(err, &target) || target.Code != "42P01" {
+		t.Errorf("Expected errors.As to find the first error. Got %v", err)
+	}
+	if errors.Is(err, ErrNilDB) {
+		t.Error("Expected errors.Is not to match an error which wasn't joined")
+	}
+	expectErrorContains(t, err, "migration failed")
+	expectErrorContains(t, err, ErrLockNotHeld.Error())
+}
+
+func TestApplyReportsMigrationAndUnlockErrors(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectBegin()
+	mock.ExpectExec("^\\s*CREATE TABLE").WillReturnError(fmt.Errorf("Create Failed"))
+	mock.ExpectRollback()
+	mock.ExpectQuery("^SELECT pg_advisory_unlock").WillReturnRows(pgxmock.NewRows([]string{"pg_advisory_unlock"}).AddRow(false))
+
+	err = NewMigrator().Apply(mock, testMigrations(t, "useless-ansi"))
+	expectErrorContains(t, err, "Create Failed")
+	if !errors.Is(err, ErrLockNotHeld) {
+		t.Errorf("Expected the unlock failure to be reported too. Got %v", err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOutOfOrderMigrations(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(
+		pgxmock.NewRows([]string{"id"}).AddRow("2021-01-01 001").AddRow("2021-01-01 003"),
+	)
+
+	migrations := []*Migration{
+		{ID: "2021-01-01 004", Script: "SELECT 4"},
+		{ID: "2021-01-01 003", Script: "SELECT 3"},
+		{ID: "2021-01-01 002b", Script: "SELECT 2"},
+		{ID: "2021-01-01 002a", Script: "SELECT 2"},
+		{ID: "2021-01-01 001", Script: "SELECT 1"},
+	}
+	outOfOrder, err := NewMigrator().OutOfOrderMigrations(mock, migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outOfOrder) != 2 {
+		t.Fatalf("Expected 2 out of order migrations. Got %d", len(outOfOrder))
+	}
+	expectID(t, outOfOrder[0], "2021-01-01 002a")
+	expectID(t, outOfOrder[1], "2021-01-01 002b")
+}
+
+func TestOutOfOrderMigrationsFailure(t *testing.T) {
+	_, err := NewMigrator().OutOfOrderMigrations(nil, nil)
+	if !errors.Is(err, ErrNilDB) {
+		t.Errorf("Expected %v, got %v", ErrNilDB, err)
+	}
+	_, err = NewMigrator().OutOfOrderMigrations(BadQueryer{}, nil)
+	expectErrorContains(t, err, "FAIL")
+}
+
+func TestPlanSummary(t *testing.T) {
+	table := map[string][]*Migration{
+		"No migrations to apply\n":         {},
+		"Applying 1 migration: a\n":        {{ID: "a"}},
+		"Applying 3 migrations: a, b, c\n": {{ID: "a"}, {ID: "b"}, {ID: "c"}},
+	}
+	for expected, plan := range table {
+		if actual := planSummary(plan); actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	}
+}
+
+func TestRunWithLogPlan(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow("0000-00-00 001 Select 1"))
+	mock.ExpectExec("^SELECT 2").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO").WillReturnResult(pgconn.CommandTag{})
+
+	logger := &sliceLog{}
+	_, err = NewMigrator(WithLogPlan(), WithLogger(logger)).run(mock, testMigrations(t, "useless-ansi"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logger.msgs) == 0 || logger.msgs[0] != "Applying 1 migration: 0000-00-00 002 Select 2\n" {
+		t.Errorf("Expected the plan to be logged first. Got %v", logger.msgs)
+	}
+}
+
+func TestDetailedStatus(t *testing.T) {
+	matching := &Migration{ID: "2021-01-01 001 Matching", Script: "SELECT 1"}
+	edited := &Migration{ID: "2021-01-01 002 Edited", Script: "SELECT 2 -- edited"}
+	pending := &Migration{ID: "2021-01-01 004 Pending", Script: "SELECT 4"}
+
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	mock.ExpectQuery("^\\s*SELECT id, checksum").WillReturnRows(
+		pgxmock.NewRows(strings.Split(AppliedMigrationColumns, ", ")).
+			AddRow(matching.ID, matching.MD5(), 0, now, ChecksumAlgorithmMD5, "", "", nil).
+			AddRow(edited.ID, (&Migration{Script: "SELECT 2"}).MD5(), 0, now, ChecksumAlgorithmMD5, "", "", nil).
+			AddRow("2021-01-01 003 Missing", "abc", 0, now, ChecksumAlgorithmMD5, "", "", nil),
+	)
+
+	statuses, err := NewMigrator().DetailedStatus(mock, []*Migration{pending, edited, matching})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 4 {
+		t.Fatalf("Expected 4 statuses. Got %d", len(statuses))
+	}
+	if s := statuses[0]; s.ID != matching.ID || s.State != StateApplied || !s.ChecksumMatches || s.ExpectedChecksum != matching.MD5() || !s.AppliedAt.Equal(now) {
+		t.Errorf("Expected a matching status for '%s'. Got %+v", matching.ID, s)
+	}
+	if s := statuses[1]; s.ID != edited.ID || s.State != StateDrifted || s.ChecksumMatches || s.ExpectedChecksum != edited.MD5() {
+		t.Errorf("Expected a checksum mismatch for '%s'. Got %+v", edited.ID, s)
+	}
+	if s := statuses[2]; s.ID != "2021-01-01 003 Missing" || s.State != StateOrphaned || !s.Missing || s.ChecksumMatches {
+		t.Errorf("Expected '2021-01-01 003 Missing' to be missing. Got %+v", s)
+	}
+	if s := statuses[3]; s.ID != pending.ID || s.State != StatePending || !s.Pending || !s.AppliedAt.IsZero() {
+		t.Errorf("Expected '%s' to be pending. Got %+v", pending.ID, s)
+	}
+}
+
+func TestDetailedStatusRolledBack(t *testing.T) {
+	migration := &Migration{ID: "2021-01-01 001 Rolled Back", Script: "SELECT 1"}
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	mock.ExpectQuery("^\\s*SELECT id, checksum").WillReturnRows(
+		pgxmock.NewRows(strings.Split(AppliedMigrationColumns, ", ")).
+			AddRow(migration.ID, migration.MD5(), 0, now, ChecksumAlgorithmMD5, "", "", &now),
+	)
+
+	statuses, err := NewMigrator().DetailedStatus(mock, []*Migration{migration})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 || statuses[0].State != StateRolledBack || !statuses[0].Pending {
+		t.Errorf("Expected '%s' to be rolled back. Got %+v", migration.ID, statuses)
+	}
+}
+
+func TestDetailedStatusFailure(t *testing.T) {
+	_, err := NewMigrator().DetailedStatus(nil, nil)
+	if !errors.Is(err, ErrNilDB) {
+		t.Errorf("Expected %v, got %v", ErrNilDB, err)
+	}
+	_, err = NewMigrator().DetailedStatus(BadQueryer{}, nil)
+	expectErrorContains(t, err, "FAIL")
+}
+
+func TestWithinReadTx(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectBegin()
+	mock.ExpectExec("^SET TRANSACTION ISOLATION LEVEL REPEATABLE READ, READ ONLY").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow("0000-00-00 001 Select 1"))
+	mock.ExpectRollback()
+
+	migrator := NewMigrator()
+	pending := 0
+	err = migrator.WithinReadTx(mock, func(tx Queryer) error {
+		pending, err = migrator.PendingCount(tx, testMigrations(t, "useless-ansi"))
+		return err
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if pending != 1 {
+		t.Errorf("Expected 1 pending migration. Got %d", pending)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIsTruthy(t *testing.T) {
+	truthy := []interface{}{true, int16(1), int32(-1), int64(2), 1, 0.5, "t", "true", time.Now()}
+	for _, v := range truthy {
+		if !isTruthy(v) {
+			t.Errorf("Expected %#v to be truthy", v)
+		}
+	}
+	falsy := []interface{}{nil, false, int16(0), int32(0), int64(0), 0, 0.0, "", "f", "false", "nope"}
+	for _, v := range falsy {
+		if isTruthy(v) {
+			t.Errorf("Expected %#v to be falsy", v)
+		}
+	}
+}
+
+// makeTestMigrator is a utility function which produces a migrator with an
+// isolated environment (isolated due to a unique name for the migration
+// tracking table).
+func makeTestMigrator() *Migrator {
+	tableName := time.Now().Format(time.RFC3339Nano)
+	return NewMigrator(WithTableName(tableName))
+}
+
+func testMigrations(t *testing.T, dirName string) []*Migration {
+	path := fmt.Sprintf("test-migrations/%s", dirName)
+	migrations, err := MigrationsFromDirectoryPath(path)
+	if err != nil {
+		t.Fatalf("Failed to load test migrations from '%s'", path)
+	}
+	return migrations
+}
+
+// assertZonesMatch accepts two Times and fails the test if their time zones
+// don't match.
+func assertZonesMatch(t *testing.T, expected, actual time.Time) {
+	t.Helper()
+	expectedName, expectedOffset := expected.Zone()
+	actualName, actualOffset := actual.Zone()
+	if expectedOffset != actualOffset {
+		t.Errorf("Expected Zone '%s' with offset %d. Got Zone '%s' with offset %d", expectedName, expectedOffset, actualName, actualOffset)
+	}
+}
+
+func TestExecutionMillis(t *testing.T) {
+	table := map[time.Duration]int64{
+		0:                       0,
+		time.Nanosecond:         1,
+		999 * time.Microsecond:  1,
+		time.Millisecond:        1,
+		1500 * time.Microsecond: 1,
+		2 * time.Second:         2000,
+	}
+	for executionTime, expected := range table {
+		if actual := executionMillis(executionTime); actual != expected {
+			t.Errorf("Expected %s to be recorded as %dms. Got %d", executionTime, expected, actual)
+		}
+	}
+}
+
+// atLeastOneMilli matches an execution_time_in_millis argument of 1 or more
+type atLeastOneMilli struct{}
+
+func (atLeastOneMilli) Match(v interface{}) bool {
+	ms, ok := v.(int64)
+	return ok && ms >= 1
+}
+
+func TestFastMigrationRecordsAtLeastOneMilli(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^SELECT 1").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO").
+		WithArgs("2021-01-01 001", pgxmock.AnyArg(), atLeastOneMilli{}, pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnResult(pgconn.CommandTag{})
+
+	_, err = NewMigrator().run(mock, []*Migration{{ID: "2021-01-01 001", Script: "SELECT 1"}}, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestApplyWithSettings ensures that a migration's Settings are in effect
+// while it runs, and restored afterwards
+func TestApplyWithSettings(t *testing.T) {
+	withEachDB(t, func(db *pgxpool.Pool) {
+		migrator := makeTestMigrator()
+		tableName := migrator.tableName + "_settings"
+		err := migrator.Apply(db, []*Migration{
+			{
+				ID:       "2021-01-01 001 Record Setting",
+				Script:   fmt.Sprintf(`CREATE TABLE %s AS SELECT current_setting('work_mem') AS value`, QuotedIdent(tableName)),
+				Settings: map[string]string{"work_mem": "12345kB"},
+			},
+			{
+				ID:     "2021-01-01 002 Record Restored Setting",
+				Script: fmt.Sprintf(`INSERT INTO %s SELECT current_setting('work_mem')`, QuotedIdent(tableName)),
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rows, err := db.Query(context.Background(), fmt.Sprintf("SELECT value FROM %s", QuotedIdent(tableName)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		values := []string{}
+		for rows.Next() {
+			var value string
+			if err = rows.Scan(&value); err != nil {
+				t.Fatal(err)
+			}
+			values = append(values, value)
+		}
+		if len(values) != 2 || values[0] != "12345kB" || values[1] == "12345kB" {
+			t.Errorf("Expected work_mem to be set only for the first migration. Got %v", values)
+		}
+	})
+}
+
+// TestApplyWithCustomSettings ensures that custom (placeholder) settings which
+// haven't been set before can be used, and are restored as empty
+func TestApplyWithCustomSettings(t *testing.T) {
+	withEachDB(t, func(db *pgxpool.Pool) {
+		migrator := makeTestMigrator()
+		tableName := migrator.tableName + "_custom_settings"
+		err := migrator.Apply(db, []*Migration{
+			{
+				ID:       "2021-01-01 001 Record Setting",
+				Script:   fmt.Sprintf(`CREATE TABLE %s AS SELECT current_setting('pgxschema_test.tenant') AS value`, QuotedIdent(tableName)),
+				Settings: map[string]string{"pgxschema_test.tenant": "acme"},
+			},
+			{
+				ID:     "2021-01-01 002 Record Restored Setting",
+				Script: fmt.Sprintf(`INSERT INTO %s SELECT COALESCE(current_setting('pgxschema_test.tenant', true), '')`, QuotedIdent(tableName)),
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rows, err := db.Query(context.Background(), fmt.Sprintf("SELECT value FROM %s", QuotedIdent(tableName)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		values := []string{}
+		for rows.Next() {
+			var value string
+			if err = rows.Scan(&value); err != nil {
+				t.Fatal(err)
+			}
+			values = append(values, value)
+		}
+		if len(values) != 2 || values[0] != "acme" || values[1] != "" {
+			t.Errorf("Expected the custom setting to be set only for the first migration. Got %v", values)
+		}
+	})
+}
+
+func TestRunWithSettings(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectQuery("^SELECT COALESCE\\(current_setting\\(\\$1, true\\), ''\\), set_config\\(\\$1, \\$2, true\\)").
+		WithArgs("maintenance_work_mem", "1GB").
+		WillReturnRows(pgxmock.NewRows([]string{"current_setting", "set_config"}).AddRow("64MB", "1GB"))
+	mock.ExpectQuery("^SELECT COALESCE\\(current_setting").
+		WithArgs("work_mem", "32MB").
+		WillReturnRows(pgxmock.NewRows([]string{"current_setting", "set_config"}).AddRow("4MB", "32MB"))
+	mock.ExpectExec("^CREATE INDEX").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectQuery("^SELECT COALESCE\\(current_setting").
+		WithArgs("maintenance_work_mem", "64MB").
+		WillReturnRows(pgxmock.NewRows([]string{"current_setting", "set_config"}).AddRow("1GB", "64MB"))
+	mock.ExpectQuery("^SELECT COALESCE\\(current_setting").
+		WithArgs("work_mem", "4MB").
+		WillReturnRows(pgxmock.NewRows([]string{"current_setting", "set_config"}).AddRow("32MB", "4MB"))
+	mock.ExpectExec("^\\s*INSERT INTO").WillReturnResult(pgconn.CommandTag{})
+
+	_, err = NewMigrator().run(mock, []*Migration{{
+		ID:       "2021-01-01 001",
+		Script:   "CREATE INDEX events_created_at ON events (created_at)",
+		Settings: map[string]string{"work_mem": "32MB", "maintenance_work_mem": "1GB"},
+	}}, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCreateMigrationsTableInTablespace(t *testing.T) {
+	withEachDB(t, func(db *pgxpool.Pool) {
+		migrator := NewMigrator(
+			WithTableName(time.Now().Format(time.RFC3339Nano)),
+			WithTablespace("pg_default"),
+		)
+		for i := 0; i < 2; i++ {
+			err := migrator.createMigrationsTable(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestTrackingTableDDL(t *testing.T) {
+	ddl := NewMigrator(WithTableName("migrations", "ops")).TrackingTableDDL()
+	if !strings.HasPrefix(ddl, `CREATE TABLE IF NOT EXISTS "migrations"."ops" (`) || !strings.HasSuffix(ddl, ";\n") {
+		t.Errorf("Expected the DDL to create the quoted table. Got:\n%s", ddl)
+	}
+	if strings.Contains(ddl, "ordinal") || strings.Contains(ddl, "TABLESPACE") {
+		t.Errorf("Expected no optional columns or tablespace by default. Got:\n%s", ddl)
+	}
+
+	ddl = NewMigrator(WithOrdinalColumn(), WithTablespace("fast")).TrackingTableDDL()
+	expectedSuffix := fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s;\n",
+		QuotedTableName("", DefaultTableName), ordinalColumnDefinition)
+	if !strings.HasSuffix(ddl, expectedSuffix) {
+		t.Errorf("Expected the DDL to end with:\n%s\nGot:\n%s", expectedSuffix, ddl)
+	}
+	if !strings.Contains(ddl, `) TABLESPACE "fast";`) || strings.Contains(ddl, "SET TABLESPACE") {
+		t.Errorf("Expected the table to be created in the tablespace. Got:\n%s", ddl)
+	}
+
+	ddl = NewMigrator(WithSingleVersionMode()).TrackingTableDDL()
+	if ddl != strings.TrimSpace(singleVersionCreateSQL(QuotedTableName("", DefaultTableName), ""))+";\n" {
+		t.Errorf("Expected the single version table's DDL. Got:\n%s", ddl)
+	}
+}
+
+func TestTrackingTableDDLWithoutTablespaceCreator(t *testing.T) {
+	// Embedding the interface hides Postgres' CreateInTablespaceSQL
+	dialect := struct{ Dialect }{Postgres}
+	ddl := NewMigrator(WithDialect(dialect), WithTablespace("fast")).TrackingTableDDL()
+	expectedSuffix := fmt.Sprintf("ALTER TABLE %s SET TABLESPACE \"fast\";\n", QuotedTableName("", DefaultTableName))
+	if !strings.HasSuffix(ddl, expectedSuffix) {
+		t.Errorf("Expected the DDL to end with:\n%s\nGot:\n%s", expectedSuffix, ddl)
+	}
+}
+
+func TestValidateMigrations(t *testing.T) {
+	migrations := []*Migration{
+		{ID: "2024_users", Script: "SELECT 1"},
+		{ID: "2024_Users", Script: "SELECT 2"},
+		{ID: "2024_posts", Script: "SELECT 3"},
+		{ID: "2024_posts", Script: "SELECT 4"},
+		{ID: "2024_comments", Script: "SELECT 5"},
+	}
+
+	err := NewMigrator().ValidateMigrations(migrations)
+	if !errors.Is(err, ErrDuplicateIDs) {
+		t.Fatalf("Expected %v, got %v", ErrDuplicateIDs, err)
+	}
+	expectErrorContains(t, err, "'2024_posts' and '2024_posts'")
+	if strings.Contains(err.Error(), "users") {
+		t.Errorf("Expected IDs differing by case to be allowed by default. Got %s", err)
+	}
+
+	err = NewMigrator(WithCaseInsensitiveIDs()).ValidateMigrations(migrations)
+	expectErrorContains(t, err, "Migrations have duplicate IDs: '2024_posts' and '2024_posts'; '2024_users' and '2024_Users'")
+
+	err = NewMigrator(WithCaseInsensitiveIDs()).ValidateMigrations(migrations[1:3])
+	if err != nil {
+		t.Errorf("Expected no duplicates. Got %v", err)
+	}
+}
+
+func TestApplyWithCaseInsensitiveIDs(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrator := NewMigrator(WithCaseInsensitiveIDs())
+	err = migrator.Apply(mock, []*Migration{
+		{ID: "2024_users", Script: "SELECT 1"},
+		{ID: "2024_Users", Script: "SELECT 2"},
+	})
+	if !errors.Is(err, ErrDuplicateIDs) {
+		t.Errorf("Expected %v before anything was run, got %v", ErrDuplicateIDs, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestApplyWithDuplicateIDs(t *testing.T) {
+	withEachDB(t, func(db *pgxpool.Pool) {
+		migrator := makeTestMigrator()
+		err := migrator.Apply(db, []*Migration{
+			{ID: "2021-01-01 001", Script: "SELECT 1"},
+			{ID: "2021-01-01 001", Script: "SELECT 1"},
+		})
+		if !errors.Is(err, ErrDuplicateIDs) {
+			t.Fatalf("Expected %v, got %v", ErrDuplicateIDs, err)
+		}
+		expectErrorContains(t, err, "'2021-01-01 001' and '2021-01-01 001'")
+
+		exists, count, err := migrator.TrackingInfo(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists || count != 0 {
+			t.Errorf("Expected nothing to be recorded. Got exists=%t, count=%d", exists, count)
+		}
+	})
+}
+
+func TestBlockingQueriesReportsLockHolder(t *testing.T) {
+	withLatestDB(t, func(db *pgxpool.Pool) {
+		ctx := context.Background()
+		migrator := makeTestMigrator()
+		key := LockIdentifierForTable(migrator.tableName)
+
+		holder, err := db.Acquire(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer holder.Release()
+		var holderPID int32
+		err = holder.QueryRow(ctx, "SELECT pg_backend_pid() FROM (SELECT pg_advisory_lock($1)) AS locked", key).Scan(&holderPID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		waiter, err := db.Acquire(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer waiter.Release()
+		waited := make(chan error, 1)
+		go func() {
+			_, err := waiter.Exec(ctx, "SELECT pg_advisory_lock($1)", key)
+			if err == nil {
+				_, err = waiter.Exec(ctx, "SELECT pg_advisory_unlock($1)", key)
+			}
+			waited <- err
+		}()
+
+		var blocking []BlockingInfo
+		for i := 0; i < 50 && len(blocking) == 0; i++ {
+			time.Sleep(20 * time.Millisecond)
+			blocking, err = migrator.BlockingQueries(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(blocking) != 1 || blocking[0].PID != holderPID {
+			t.Errorf("Expected pid %d to be reported as blocking. Got %+v", holderPID, blocking)
+		}
+
+		_, err = holder.Exec(ctx, "SELECT pg_advisory_unlock($1)", key)
+		if err != nil {
+			t.Error(err)
+		}
+		if err = <-waited; err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestTrackingInfoBeforeAndAfterApply(t *testing.T) {
+	withEachDB(t, func(db *pgxpool.Pool) {
+		migrator := makeTestMigrator()
+		exists, _, err := migrator.TrackingInfo(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists {
+			t.Error("Expected the tracking table not to exist yet")
+		}
+
+		err = migrator.Apply(db, testMigrations(t, "useless-ansi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		exists, count, err := migrator.TrackingInfo(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !exists || count != 2 {
+			t.Errorf("Expected the tracking table to record 2 migrations. Got %t, %d", exists, count)
+		}
+	})
+}
+
+func TestRunWithOrdinalColumn(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^SELECT 1").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*UPDATE \"schema_migrations\"\\s+SET ordinal").
+		WithArgs("2021-01-01 001").
+		WillReturnResult(pgconn.CommandTag{})
+
+	_, err = NewMigrator(WithOrdinalColumn()).run(mock, []*Migration{{ID: "2021-01-01 001", Script: "SELECT 1"}}, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunWithNotifyChannel(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^SELECT 2").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^SELECT 1").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^SELECT pg_notify").
+		WithArgs("schema_changed", "2021-01-01 002").
+		WillReturnResult(pgconn.CommandTag{})
+
+	migrator := NewMigrator(WithNotifyChannel("schema_changed"), WithPreserveOrder())
+	_, err = migrator.run(mock, []*Migration{
+		{ID: "2021-01-01 002", Script: "SELECT 2"},
+		{ID: "2021-01-01 001", Script: "SELECT 1"},
+	}, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunWithNotifyChannelWhenNothingRan(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow("2021-01-01 001"))
+
+	_, err = NewMigrator(WithNotifyChannel("schema_changed")).run(mock, []*Migration{{ID: "2021-01-01 001", Script: "SELECT 1"}}, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunStreamedMigration(t *testing.T) {
+	script := "CREATE TABLE events (id INTEGER);\nINSERT INTO events VALUES (1), (2);\n"
+	for _, includeID := range []bool{false, true} {
+		expected := &Migration{ID: "2021-01-01 001", Script: script}
+		checksum, algorithm := expected.MD5(), ChecksumAlgorithmMD5
+		options := []Option{}
+		if includeID {
+			checksum, algorithm = expected.MD5WithID(), ChecksumAlgorithmMD5WithID
+			options = append(options, WithChecksumIncludesID())
+		}
+
+		mock, err := pgxmock.NewConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+		mock.ExpectExec("^CREATE TABLE events \\(id INTEGER\\)$").WillReturnResult(pgconn.CommandTag{})
+		mock.ExpectExec("^INSERT INTO events VALUES \\(1\\), \\(2\\)$").WillReturnResult(pgconn.CommandTag{})
+		mock.ExpectExec("^\\s*INSERT INTO").
+			WithArgs(expected.ID, checksum, pgxmock.AnyArg(), pgxmock.AnyArg(), algorithm, "", "").
+			WillReturnResult(pgconn.CommandTag{})
+
+		_, err = NewMigrator(options...).run(mock, []*Migration{{ID: expected.ID, ScriptReader: strings.NewReader(script)}}, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestApplyWithPostApplyVacuum(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectBegin()
+	mock.ExpectExec("^\\s*CREATE TABLE").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectQuery("^\\s*SELECT COALESCE\\(character_maximum_length").
+		WillReturnRows(pgxmock.NewRows([]string{"width"}).AddRow(int32(32)))
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^DELETE FROM events").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectCommit()
+	mock.ExpectExec("^VACUUM \\(ANALYZE\\) \"events\"$").WillReturnError(fmt.Errorf("Vacuum Failed"))
+	mock.ExpectExec("^VACUUM \\(ANALYZE\\) \"audit\".\"log\"$").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectQuery("^SELECT pg_advisory_unlock").WillReturnRows(pgxmock.NewRows([]string{"pg_advisory_unlock"}).AddRow(true))
+
+	log := &sliceLog{}
+	migrator := NewMigrator(WithPostApplyVacuum("events", "audit.log"), WithLogger(log))
+	err = migrator.Apply(mock, []*Migration{{ID: "2021-01-01 001", Script: "DELETE FROM events"}})
+	if err != nil {
+		t.Error(err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+	if !strings.Contains(strings.Join(log.msgs, ""), "VACUUM of \"events\" failed: Vacuum Failed") {
+		t.Errorf("Expected the VACUUM failure to be logged. Got %v", log.msgs)
+	}
+}
+
+func TestApplyWithPostApplyVacuumWhenNothingRan(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectBegin()
+	mock.ExpectExec("^\\s*CREATE TABLE").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectQuery("^\\s*SELECT COALESCE\\(character_maximum_length").
+		WillReturnRows(pgxmock.NewRows([]string{"width"}).AddRow(int32(32)))
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow("2021-01-01 001"))
+	mock.ExpectCommit()
+	mock.ExpectQuery("^SELECT pg_advisory_unlock").WillReturnRows(pgxmock.NewRows([]string{"pg_advisory_unlock"}).AddRow(true))
+
+	err = NewMigrator(WithPostApplyVacuum("events")).Apply(mock, []*Migration{{ID: "2021-01-01 001", Script: "DELETE FROM events"}})
+	if err != nil {
+		t.Error(err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunWithScriptTransform(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^CREATE TABLE tenant_1.users").WillReturnResult(pgconn.CommandTag{})
+	migration := &Migration{ID: "2021-01-01 001", Script: "CREATE TABLE {{schema}}.users (id INTEGER)"}
+	mock.ExpectExec("^\\s*INSERT INTO").
+		WithArgs(migration.ID, migration.MD5(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnResult(pgconn.CommandTag{})
+
+	migrator := NewMigrator(WithScriptTransform(func(m *Migration, script string) (string, error) {
+		return strings.ReplaceAll(script, "{{schema}}", "tenant_1"), nil
+	}))
+	_, err = migrator.run(mock, []*Migration{migration}, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestApplyWithRole(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectBegin()
+	mock.ExpectExec(`^SET LOCAL ROLE "app_owner"$`).WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*CREATE TABLE").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectQuery("^\\s*SELECT COALESCE\\(character_maximum_length").WillReturnRows(pgxmock.NewRows([]string{"character_maximum_length"}).AddRow(int32(32)))
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectExec("^SELECT 1").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^SELECT 2").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectExec("^\\s*INSERT INTO").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectCommit()
+	mock.ExpectQuery("^SELECT pg_advisory_unlock").WillReturnRows(pgxmock.NewRows([]string{"pg_advisory_unlock"}).AddRow(true))
+
+	err = NewMigrator(WithRole("app_owner")).Apply(mock, testMigrations(t, "useless-ansi"))
+	if err != nil {
+		t.Error(err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReadOnlyMigrator(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrator := NewMigrator(WithReadOnly())
+	migrations := testMigrations(t, "useless-ansi")
+	bootstrap := []*Migration{{ID: "2020-01-01 000 Bootstrap", Script: "SELECT 0"}}
+	for name, method := range map[string]func() error{
+		"Apply":                   func() error { return migrator.Apply(mock, migrations) },
+		"ApplyWithBootstrap":      func() error { return migrator.ApplyWithBootstrap(mock, bootstrap, migrations) },
+		"Resume":                  func() error { return migrator.Resume(mock, migrations) },
+		"RunOnce":                 func() error { return migrator.RunOnce(mock, migrations, "deploy", time.Minute) },
+		"RemoveApplied":           func() error { return migrator.RemoveApplied(mock, migrations[0].ID) },
+		"TrialApply":              func() error { return migrator.TrialApply(mock, migrations) },
+		"Squash":                  func() error { return migrator.Squash(mock, bootstrap[0]) },
+		"RepairConcurrentIndexes": func() error { return migrator.RepairConcurrentIndexes(mock) },
+		"UpgradeTrackingTable":    func() error { return migrator.UpgradeTrackingTable(mock) },
+		"PruneFailures": func() error {
+			_, err := migrator.PruneFailures(mock, time.Hour)
+			return err
+		},
+	} {
+		err = method()
+		if !errors.Is(err, ErrReadOnlyMigrator) {
+			t.Errorf("Expected %s to return ErrReadOnlyMigrator, got %v", name, err)
+		}
+	}
+
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(migrations[0].ID))
+	count, err := migrator.PendingCount(mock, migrations)
+	if err != nil {
+		t.Error(err)
+	}
+	if count != 1 {
+		t.Errorf("Expected 1 pending migration. Got %d", count)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
 	}
 }
@@ -0,0 +1,73 @@
+package pgxschema
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+// noticeRouter tracks which migration is running on which connection, so that
+// NOTICE and WARNING messages can be logged with the ID of the migration which
+// raised them.
+type noticeRouter struct {
+	mu      sync.Mutex
+	running map[*pgconn.PgConn]string
+}
+
+func newNoticeRouter() *noticeRouter {
+	return &noticeRouter{running: make(map[*pgconn.PgConn]string)}
+}
+
+// start records that the migration with the provided ID is running on the
+// transaction's connection, and returns a function which clears that record.
+func (nr *noticeRouter) start(tx Queryer, id string) func() {
+	ptx, ok := tx.(pgx.Tx)
+	if !ok || ptx.Conn() == nil {
+		return func() {}
+	}
+	conn := ptx.Conn().PgConn()
+
+	nr.mu.Lock()
+	nr.running[conn] = id
+	nr.mu.Unlock()
+
+	return func() {
+		nr.mu.Lock()
+		delete(nr.running, conn)
+		nr.mu.Unlock()
+	}
+}
+
+// migrationID returns the ID of the migration running on the connection
+func (nr *noticeRouter) migrationID(conn *pgconn.PgConn) (id string, ok bool) {
+	nr.mu.Lock()
+	defer nr.mu.Unlock()
+	id, ok = nr.running[conn]
+	return id, ok
+}
+
+// OnNotice is a pgconn.NoticeHandler which logs the NOTICE and WARNING
+// messages raised by migrations (e.g. via RAISE NOTICE in PL/pgSQL) through
+// the Migrator's Logger, tagged with the ID of the running migration. It has
+// no effect unless the Migrator was created with the WithCaptureNotices()
+// option. pgx only accepts notice handlers when connecting, so it must be
+// installed in the connection's configuration:
+//
+//	config, err := pgxpool.ParseConfig(dsn)
+//	config.ConnConfig.OnNotice = migrator.OnNotice
+//	db, err := pgxpool.ConnectConfig(ctx, config)
+func (m *Migrator) OnNotice(conn *pgconn.PgConn, notice *pgconn.Notice) {
+	if m.notices == nil || notice == nil {
+		return
+	}
+	if notice.Severity != "NOTICE" && notice.Severity != "WARNING" {
+		return
+	}
+	id, ok := m.notices.migrationID(conn)
+	if !ok {
+		return
+	}
+	m.log(fmt.Sprintf("Migration '%s' %s: %s\n", id, notice.Severity, notice.Message))
+}
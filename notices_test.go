@@ -0,0 +1,89 @@
+package pgxschema
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+type sliceLog struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (sl *sliceLog) Print(msgs ...interface{}) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	sl.msgs = append(sl.msgs, fmt.Sprint(msgs...))
+}
+
+func TestOnNotice(t *testing.T) {
+	var logged sliceLog
+	m := NewMigrator(WithLogger(&logged), WithCaptureNotices())
+	running, idle := &pgconn.PgConn{}, &pgconn.PgConn{}
+	m.notices.running[running] = "2021-01-01 Raise Notice"
+
+	m.OnNotice(running, &pgconn.Notice{Severity: "NOTICE", Message: "hello"})
+	m.OnNotice(running, &pgconn.Notice{Severity: "INFO", Message: "ignored"})
+	m.OnNotice(idle, &pgconn.Notice{Severity: "WARNING", Message: "ignored"})
+
+	if len(logged.msgs) != 1 {
+		t.Fatalf("Expected 1 logged notice. Got %d: %v", len(logged.msgs), logged.msgs)
+	}
+	expected := "Migration '2021-01-01 Raise Notice' NOTICE: hello\n"
+	if logged.msgs[0] != expected {
+		t.Errorf("Expected '%s'. Got '%s'", expected, logged.msgs[0])
+	}
+}
+
+func TestOnNoticeWithoutCaptureNotices(t *testing.T) {
+	var logged sliceLog
+	m := NewMigrator(WithLogger(&logged))
+	m.OnNotice(&pgconn.PgConn{}, &pgconn.Notice{Severity: "NOTICE", Message: "hello"})
+	if len(logged.msgs) != 0 {
+		t.Errorf("Expected no logged notices. Got %v", logged.msgs)
+	}
+}
+
+func TestApplyWithCaptureNotices(t *testing.T) {
+	withLatestDB(t, func(_ *pgxpool.Pool) {
+		var logged sliceLog
+		tableName := fmt.Sprintf("notices%d", rand.Int()) // #nosec don't need a strong RNG here
+		migrator := NewMigrator(WithTableName(tableName), WithLogger(&logged), WithCaptureNotices())
+
+		config, err := pgxpool.ParseConfig(TestDBs["postgres:latest"].DSN())
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.ConnConfig.OnNotice = migrator.OnNotice
+		db, err := pgxpool.ConnectConfig(context.Background(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		err = migrator.Apply(db, []*Migration{
+			{ID: "2021-01-01 Raise Notice", Script: "DO $$ BEGIN RAISE NOTICE 'hello'; END $$"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := "Migration '2021-01-01 Raise Notice' NOTICE: hello"
+		found := false
+		for _, msg := range logged.msgs {
+			if strings.Contains(msg, expected) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Expected a log message containing '%s'. Got %v", expected, logged.msgs)
+		}
+	})
+}
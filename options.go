@@ -1,6 +1,10 @@
 package pgxschema
 
-import "context"
+import (
+	"context"
+	"regexp"
+	"time"
+)
 
 // Option supports option chaining when creating a Migrator.
 // An Option is a function which takes a Migrator and
@@ -29,6 +33,23 @@ func WithTableName(names ...string) Option {
 	}
 }
 
+// ApplyOption customizes a Migrator for a single call to Apply, without
+// affecting the Migrator itself or other calls running concurrently
+type ApplyOption func(m Migrator) Migrator
+
+// WithCallLogger builds an ApplyOption which replaces the Migrator's Logger
+// for a single call to Apply, e.g. to capture the output of each request in
+// its own buffer. Notices captured via OnNotice are still logged through the
+// Migrator's own Logger, since they are raised on the connection rather than
+// by the call.
+//
+func WithCallLogger(logger Logger) ApplyOption {
+	return func(m Migrator) Migrator {
+		m.Logger = logger
+		return m
+	}
+}
+
 // Logger is the interface for logging operations of the logger.
 // By default the migrator operates silently. Providing a Logger
 // enables output of the migrator's operations.
@@ -54,3 +75,587 @@ func WithContext(ctx context.Context) Option {
 		return m
 	}
 }
+
+// WithDialect builds an Option which will set the Dialect used to generate
+// the Migrator's locking and table creation SQL. Usage:
+// NewMigrator(WithDialect(CockroachDB))
+//
+func WithDialect(dialect Dialect) Option {
+	return func(m Migrator) Migrator {
+		m.dialect = dialect
+		return m
+	}
+}
+
+// WithTableOutsideTransaction builds an Option which causes Apply to create
+// the tracking table before the migration transaction begins. By default the
+// table is created inside that transaction, so it is rolled back along with
+// everything else if a migration fails. With this option the table persists
+// regardless. It can't be combined with the CockroachDB dialect, which
+// obtains its lock while creating the table: NewMigratorE and Apply return
+// ErrTableOutsideTxUnsupported if they are.
+//
+func WithTableOutsideTransaction() Option {
+	return func(m Migrator) Migrator {
+		m.tableOutsideTx = true
+		return m
+	}
+}
+
+// WithDropInvalidIndexes builds an Option which causes RepairConcurrentIndexes
+// to drop the invalid indexes it finds (with DROP INDEX CONCURRENTLY) so that
+// the interrupted migrations which created them can be retried. Invalid
+// indexes on tables locked by another session's CREATE INDEX CONCURRENTLY
+// are never dropped, since they may still be being built.
+//
+func WithDropInvalidIndexes() Option {
+	return func(m Migrator) Migrator {
+		m.dropInvalidIndexes = true
+		return m
+	}
+}
+
+// WithRowScanner builds an Option which customizes how rows of the tracking
+// table are read into AppliedMigrations, allowing custom columns added to the
+// table to be mapped. The columns are selected (unquoted, in the order given)
+// in place of the default column list, so they must match what the scanner
+// expects. If no columns are given, the default list is selected:
+// id, checksum, execution_time_in_millis, applied_at, checksum_algorithm,
+// version, commit
+//
+func WithRowScanner(scanner RowScanner, columns ...string) Option {
+	return func(m Migrator) Migrator {
+		m.rowScanner = scanner
+		m.scanColumns = columns
+		return m
+	}
+}
+
+// WithExplainCallback builds an Option which causes each migration's Script
+// to be run one statement at a time, with every DML statement (SELECT, INSERT,
+// UPDATE, DELETE, etc) first being run under EXPLAIN (FORMAT JSON) and its
+// plan passed to the callback. EXPLAIN does not execute the statement, and
+// DDL statements are never EXPLAINed, so the migration itself is unaffected.
+//
+func WithExplainCallback(callback func(id, sql, planJSON string)) Option {
+	return func(m Migrator) Migrator {
+		m.explainCallback = callback
+		return m
+	}
+}
+
+// WithBuildInfo builds an Option which records the supplied application
+// version and commit in the tracking table alongside each migration applied,
+// making it possible to tell which build introduced a migration.
+//
+func WithBuildInfo(version, commit string) Option {
+	return func(m Migrator) Migrator {
+		m.buildVersion = version
+		m.buildCommit = commit
+		return m
+	}
+}
+
+// WithMinServerVersion builds an Option which causes Apply to fail before
+// running anything if the PostgreSQL server's major version (as reported by
+// SHOW server_version_num) is older than the one provided. This turns cryptic
+// syntax errors from migrations written for newer servers into a clear error.
+//
+func WithMinServerVersion(major int) Option {
+	return func(m Migrator) Migrator {
+		m.minServerVersion = major
+		return m
+	}
+}
+
+// WithPreserveOrder builds an Option which causes Apply to run pending
+// migrations in exactly the order they were provided, rather than sorting
+// them by ID. Use it only when the slice is deliberately dependency-ordered:
+// if the order of the slice ever differs between runs (or between machines),
+// databases can end up with migrations applied in different orders.
+//
+func WithPreserveOrder() Option {
+	return func(m Migrator) Migrator {
+		m.preserveOrder = true
+		return m
+	}
+}
+
+// WithRequiredExtensions builds an Option which causes Apply to install each
+// of the named extensions, with CREATE EXTENSION IF NOT EXISTS, inside the
+// migration transaction before any migrations are run. If the database role
+// lacks permission to install one, ErrExtensionPermissionDenied is returned.
+//
+func WithRequiredExtensions(names ...string) Option {
+	return func(m Migrator) Migrator {
+		m.requiredExtensions = names
+		return m
+	}
+}
+
+// WithPlanValidator builds an Option which passes the plan (the pending
+// migrations, in the order they'll be run) to the provided function before
+// any of them are run. If it returns an error, Apply is aborted without
+// running any migrations. This can be used to enforce custom policies, such
+// as a limit on how many migrations may be applied at once.
+//
+func WithPlanValidator(validator func(plan []*Migration) error) Option {
+	return func(m Migrator) Migrator {
+		m.planValidator = validator
+		return m
+	}
+}
+
+// WithAllowTransactionControl builds an Option which permits migrations to
+// contain transaction control statements (BEGIN, COMMIT, ROLLBACK, etc.). By
+// default, Apply refuses to run such migrations because they would interfere
+// with the transaction it runs them in.
+//
+func WithAllowTransactionControl() Option {
+	return func(m Migrator) Migrator {
+		m.allowTransactionControl = true
+		return m
+	}
+}
+
+// WithBaselineVersion builds an Option for adopting pgxschema on a database
+// whose schema already exists. Pending migrations with IDs at or below the
+// provided baseline ID are assumed to have already been applied: they are
+// recorded in the tracking table without being run. Migrations with later IDs
+// are run as usual.
+//
+func WithBaselineVersion(id string) Option {
+	return func(m Migrator) Migrator {
+		m.baselineVersion = id
+		return m
+	}
+}
+
+// WithLintFailOn builds an Option which runs LintMigrations over the pending
+// migrations before any are run. If any finding is at or above the provided
+// severity, Apply is aborted with ErrLintFailed. Less severe findings are
+// logged.
+//
+func WithLintFailOn(severity LintSeverity) Option {
+	return func(m Migrator) Migrator {
+		m.lintFailOn = severity
+		return m
+	}
+}
+
+// WithHoldConnection builds an Option which keeps the dedicated connection a
+// successful Apply used (when it was given a *pgxpool.Pool), rather than
+// returning it to the pool. Retrieve it with HeldConnection() to run further
+// queries in the same session, e.g. against temporary tables the migrations
+// created.
+//
+func WithHoldConnection() Option {
+	return func(m Migrator) Migrator {
+		m.held = &heldConnection{}
+		return m
+	}
+}
+
+// WithChecksumIncludesID builds an Option which causes the recorded checksum
+// of each migration to hash its ID as well as its Script, so that migrations
+// with identical Scripts have different checksums. Such checksums are
+// recorded with the ChecksumAlgorithmMD5WithID algorithm. By default, only the
+// Script is hashed.
+//
+func WithChecksumIncludesID() Option {
+	return func(m Migrator) Migrator {
+		m.checksumIncludesID = true
+		return m
+	}
+}
+
+// WithRecordFailures builds an Option which records each migration which fails
+// during Apply in a table named after the tracking table, in the same schema
+// (see FailuresTableName). The row holds the migration's ID, the error
+// and when it failed. It's written after the migration transaction has been
+// rolled back, so it survives the rollback. Failures to record a failure are
+// logged rather than returned, so that the migration's error isn't hidden.
+//
+func WithRecordFailures() Option {
+	return func(m Migrator) Migrator {
+		m.recordFailures = true
+		return m
+	}
+}
+
+// WithHeartbeat builds an Option which records each migration run in a small
+// coordination table (named after the tracking table, with a "_heartbeat"
+// suffix), and updates it at the provided interval while the migration lock
+// is held. Other processes can read it with LastHeartbeat to see whether a
+// migration is in progress, rather than blocking on the lock indefinitely.
+// The updates are made on a separate connection, so it only takes effect when
+// Apply is given a *pgxpool.Pool.
+//
+func WithHeartbeat(interval time.Duration) Option {
+	return func(m Migrator) Migrator {
+		m.heartbeatInterval = interval
+		return m
+	}
+}
+
+// WithAppliedAtSource builds an Option which selects the clock providing the
+// applied_at time recorded for each migration. By default (AppliedAtClient)
+// the client's clock is used. AppliedAtStatementTimestamp and
+// AppliedAtClockTimestamp read the database server's clock when each
+// migration starts, at the cost of an extra query per migration.
+//
+func WithAppliedAtSource(source AppliedAtSource) Option {
+	return func(m Migrator) Migrator {
+		m.appliedAtSource = source
+		return m
+	}
+}
+
+// WithApplyTimeout builds an Option which sets a deadline for each Apply call,
+// derived from the Migrator's context. If waiting for the lock or running the
+// migrations takes longer than the provided duration, the transaction is
+// rolled back and Apply returns an error.
+//
+func WithApplyTimeout(timeout time.Duration) Option {
+	return func(m Migrator) Migrator {
+		m.applyTimeout = timeout
+		return m
+	}
+}
+
+// WithServerSideQuoting builds an Option which quotes the tracking table's
+// name with the server's quote_ident function, rather than QuotedIdent's
+// client-side approximation (which, for example, strips whitespace). The
+// quoted name is resolved with one query the first time the table is used,
+// and cached. The lock identifier is still derived from the unquoted name.
+//
+func WithServerSideQuoting() Option {
+	return func(m Migrator) Migrator {
+		m.serverQuoted = &serverQuotedName{}
+		return m
+	}
+}
+
+// WithOnLockWait builds an Option which calls the provided function when the
+// migration lock is held by another process, before waiting for it to be
+// released. This is useful for logging why Apply appears to be stalled. It
+// requires a Dialect which implements TryLocker, such as Postgres, since the
+// lock must first be attempted without blocking.
+//
+func WithOnLockWait(onLockWait func()) Option {
+	return func(m Migrator) Migrator {
+		m.onLockWait = onLockWait
+		return m
+	}
+}
+
+// WithSingleVersionMode builds an Option which causes the tracking table to
+// hold a single row recording the ID of the most recently applied migration,
+// rather than a row per migration. Migrations with IDs at or below that
+// version are considered applied. This is simpler to inspect, but there's no
+// per-migration history: GetAppliedMigrations, Validate and the other
+// methods which read it aren't supported, a migration with an older ID than
+// the current version is never run, and WithPreserveOrder must not be used.
+//
+func WithSingleVersionMode() Option {
+	return func(m Migrator) Migrator {
+		m.singleVersion = true
+		return m
+	}
+}
+
+// WithLogPlan builds an Option which causes Apply to log, via the Logger, a
+// single line listing the IDs of the pending migrations (in the order they'll
+// be run) before running any of them, or "No migrations to apply".
+//
+func WithLogPlan() Option {
+	return func(m Migrator) Migrator {
+		m.logPlan = true
+		return m
+	}
+}
+
+// WithSyntaxCheck builds an Option which causes Apply to dry-run the pending
+// migrations, inside a savepoint which is rolled back, before running any of
+// them. DML statements are only EXPLAINed, while DDL statements are executed.
+// If any statement fails, ErrSyntaxCheckFailed is returned. Since DML isn't
+// executed, DDL which depends on data changed earlier in the plan (e.g. SET
+// NOT NULL after an UPDATE backfill) can fail the check despite being valid.
+//
+func WithSyntaxCheck() Option {
+	return func(m Migrator) Migrator {
+		m.syntaxCheck = true
+		return m
+	}
+}
+
+// WithMigrationLockRetry builds an Option which retries a migration's
+// statements when they fail because a lock they need isn't available
+// (SQLSTATE 55P03, e.g. because a lock_timeout set by the migration elapsed
+// while another session held the table). Each statement is run in a
+// savepoint, so a failed attempt is rolled back without aborting the
+// migration transaction, and retried after backoff, which doubles after each
+// attempt. A statement is tried at most attempts times. This is unrelated to
+// the advisory lock which serializes migrators.
+//
+func WithMigrationLockRetry(attempts int, backoff time.Duration) Option {
+	return func(m Migrator) Migrator {
+		m.lockRetryAttempts = attempts
+		m.lockRetryBackoff = backoff
+		return m
+	}
+}
+
+// WithIDPattern builds an Option which replaces DefaultIDPattern as the
+// pattern Migrator.ParseID uses to split migration IDs into their version and
+// name (e.g. for AppliedMigration's IDVersion and IDName). The parts are taken
+// from the subexpressions named "version" and "name":
+//
+//     WithIDPattern(regexp.MustCompile(`^(?P<version>\d{14})-(?P<name>.+)$`))
+//
+func WithIDPattern(pattern *regexp.Regexp) Option {
+	return func(m Migrator) Migrator {
+		m.idPattern = pattern
+		return m
+	}
+}
+
+// WithDeferredConstraints builds an Option which runs SET CONSTRAINTS ALL
+// DEFERRED at the start of the migration transaction, so that constraints are
+// checked when it commits rather than after each statement. This allows the
+// migrations to violate foreign keys temporarily, e.g. while rows are being
+// reordered. It only affects constraints declared DEFERRABLE; others (and all
+// NOT NULL and CHECK constraints) are still checked immediately. A failed
+// check at commit fails the Apply, and no migrations are applied.
+//
+func WithDeferredConstraints() Option {
+	return func(m Migrator) Migrator {
+		m.deferredConstraints = true
+		return m
+	}
+}
+
+// WithReadOnly builds an Option which prevents the Migrator from changing the
+// database, e.g. because it's connected to a read replica. Apply, and the
+// other methods which change the database or take the migration lock
+// (Resume, RunOnce, TrialApply, Squash, RemoveApplied, PruneFailures,
+// UpgradeTrackingTable and RepairConcurrentIndexes), return
+// ErrReadOnlyMigrator without running anything. Methods which only read,
+// such as DetailedStatus, PendingCount, GetAppliedMigrations and Validate,
+// work as usual.
+//
+func WithReadOnly() Option {
+	return func(m Migrator) Migrator {
+		m.readOnly = true
+		return m
+	}
+}
+
+// WithRole builds an Option which runs SET LOCAL ROLE at the start of the
+// migration transaction, so that the migrations (and the tracking table) run
+// as a role other than the connecting one, e.g. the role which owns the
+// schema. The role is reset when the transaction ends. The connecting role
+// must be a member of it. Everything which runs outside the migration
+// transaction still runs as the connecting role: the advisory lock, the
+// tracking table when WithTableOutsideTransaction is used, bootstrap
+// migrations (see ApplyWithBootstrap), the VACUUM run by
+// WithPostApplyVacuum and the failures recorded by WithRecordFailures. So do
+// the methods which change the database outside of Apply: Squash,
+// UpgradeTrackingTable, RemoveApplied, PruneFailures and
+// RepairConcurrentIndexes.
+//
+func WithRole(role string) Option {
+	return func(m Migrator) Migrator {
+		m.role = role
+		return m
+	}
+}
+
+// WithTrimScriptForChecksum builds an Option which causes the recorded
+// checksum of each migration to ignore trailing newlines and spaces in its
+// Script, so that an editor adding or removing a final newline isn't reported
+// as drift. Other whitespace still counts. Such checksums are recorded with
+// the ChecksumAlgorithmMD5Trimmed (or ChecksumAlgorithmMD5WithIDTrimmed)
+// algorithm, so migrations applied before the option was used are still
+// validated with the algorithm they were recorded with.
+//
+func WithTrimScriptForChecksum() Option {
+	return func(m Migrator) Migrator {
+		m.trimScriptForChecksum = true
+		return m
+	}
+}
+
+// WithStore builds an Option which records the applied migrations in the
+// provided Store instead of the tracking table. The Store is used to decide
+// which migrations Apply runs, and to record each one it runs. Apply still
+// takes the advisory lock, and still creates the tracking table, and methods
+// which read the full records (e.g. GetAppliedMigrations and Validate) still
+// read them from the tracking table. Squash and TrackingInfo, which work on
+// the tracking table's records directly, return ErrUnsupportedWithStore.
+//
+func WithStore(store Store) Option {
+	return func(m Migrator) Migrator {
+		m.store = store
+		return m
+	}
+}
+
+// WithHealthCheck builds an Option which runs the provided query after each
+// migration, in the same transaction. Like a migration's Verify query, it
+// must return a row whose first column is truthy, otherwise the migration
+// fails and is rolled back. Unlike Verify, it applies to every migration, so
+// it suits invariants which no migration may break (e.g. that no rows are
+// orphaned).
+//
+func WithHealthCheck(sql string) Option {
+	return func(m Migrator) Migrator {
+		m.healthCheck = sql
+		return m
+	}
+}
+
+// WithScriptTransform builds an Option which passes each migration's Script
+// through transform just before it is executed, e.g. to substitute a
+// placeholder with an environment-specific schema name. The checksum is still
+// computed from the original Script, so it is the same in every environment.
+// If transform returns an error, the migration fails.
+//
+func WithScriptTransform(transform func(m *Migration, script string) (string, error)) Option {
+	return func(m Migrator) Migrator {
+		m.scriptTransform = transform
+		return m
+	}
+}
+
+// WithExpectedDatabase builds an Option which causes Apply to fail before
+// doing anything else if the connection's current database (as reported by
+// current_database()) isn't the one named. This guards against running
+// migrations against the wrong database in environments with several.
+//
+func WithExpectedDatabase(name string) Option {
+	return func(m Migrator) Migrator {
+		m.expectedDatabase = name
+		return m
+	}
+}
+
+// WithPostApplyVacuum builds an Option which causes Apply to run VACUUM
+// (ANALYZE) on each of the provided tables (which may be schema-qualified, as
+// "schema.table") after committing, if any migrations were run. This reclaims
+// the space left by migrations which delete or rewrite many rows. VACUUM can
+// take a long time on large tables, and the migration lock is held until it
+// finishes. Failures are logged rather than returned, since the migrations
+// have already been committed.
+//
+func WithPostApplyVacuum(tables ...string) Option {
+	return func(m Migrator) Migrator {
+		m.vacuumTables = tables
+		return m
+	}
+}
+
+// WithCaseInsensitiveIDs builds an Option which causes ValidateMigrations to
+// treat IDs which differ only by case (e.g. "2024_Users" and "2024_users") as
+// duplicates, and Apply to refuse to run migrations with such IDs.
+//
+func WithCaseInsensitiveIDs() Option {
+	return func(m Migrator) Migrator {
+		m.caseInsensitiveIDs = true
+		return m
+	}
+}
+
+// WithTablespace builds an Option which keeps the tracking table in the
+// provided tablespace (e.g. one dedicated to metadata) by adding a TABLESPACE
+// clause when it's created. An existing table isn't moved. Dialects which
+// don't implement TablespaceCreator move the table with ALTER TABLE instead,
+// which locks it exclusively and requires owning it.
+//
+func WithTablespace(name string) Option {
+	return func(m Migrator) Migrator {
+		m.tablespace = name
+		return m
+	}
+}
+
+// WithChecksumSigner builds an Option which adds a checksum_signature column
+// to the tracking table (if it doesn't already have one), and records the
+// signature the signer computes (e.g. an HMAC) of each applied migration's
+// checksum. Validate then reports any applied migration whose signature
+// doesn't match, which detects direct tampering with the tracking table.
+// Migrations applied before the option was used have no signature, so they
+// are reported too.
+//
+func WithChecksumSigner(signer func(checksum string) string) Option {
+	return func(m Migrator) Migrator {
+		m.checksumSigner = signer
+		return m
+	}
+}
+
+// WithEventChannel builds an Option which causes Apply to send a
+// MigrationEvent to the provided channel as it progresses: when each
+// migration starts, and is applied or fails, and when Apply completes. This
+// is useful for showing live progress in a UI. Sends never block, so events
+// are dropped if the channel isn't ready for them. Use a buffered channel to
+// avoid missing events.
+//
+func WithEventChannel(ch chan<- MigrationEvent) Option {
+	return func(m Migrator) Migrator {
+		m.events = ch
+		return m
+	}
+}
+
+// WithNotifyChannel builds an Option which causes Apply to send a notification
+// on the provided channel (as with NOTIFY) when at least one migration was
+// run. Its payload is the highest ID among the migrations run. It is sent
+// within the migration transaction, so listeners only receive it once the
+// transaction commits. This is useful for invalidating caches held by other
+// instances of an application.
+//
+func WithNotifyChannel(channel string) Option {
+	return func(m Migrator) Migrator {
+		m.notifyChannel = channel
+		return m
+	}
+}
+
+// WithOrdinalColumn builds an Option which adds an ordinal column to the
+// tracking table (if it doesn't already have one), and records an incrementing
+// ordinal for each migration applied. Unlike applied_at, ordinals can't
+// collide, so they reliably reconstruct the order in which migrations were
+// applied. They are read into AppliedMigration.Ordinal. This option has no
+// effect in single version mode.
+//
+func WithOrdinalColumn() Option {
+	return func(m Migrator) Migrator {
+		m.ordinalColumn = true
+		return m
+	}
+}
+
+// WithTimingLog builds an Option which causes Apply to log, via the Logger,
+// how long each of its phases took: acquiring the lock, creating the tracking
+// table, planning and running the migrations. This is useful when
+// investigating slow deploys.
+//
+func WithTimingLog() Option {
+	return func(m Migrator) Migrator {
+		m.timingLog = true
+		return m
+	}
+}
+
+// WithCaptureNotices builds an Option which routes the NOTICE and WARNING
+// messages raised by migrations (e.g. via RAISE NOTICE) to the Logger, tagged
+// with the ID of the migration which raised them. The Migrator's OnNotice
+// method must also be installed as the connection's OnNotice handler.
+//
+func WithCaptureNotices() Option {
+	return func(m Migrator) Migrator {
+		m.notices = newNoticeRouter()
+		return m
+	}
+}
@@ -2,11 +2,15 @@ package pgxschema
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"strings"
 	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/pashagolub/pgxmock"
 )
 
 func TestWithTableNameOptionWithSchema(t *testing.T) {
@@ -103,3 +107,134 @@ func TestSimpleLogger(t *testing.T) {
 		t.Errorf("Expected logger to print 'Test message'. Got '%s'", str)
 	}
 }
+
+func TestNewMigratorE(t *testing.T) {
+	m, err := NewMigratorE(WithTableName("special", "my_migrations"))
+	if err != nil {
+		t.Errorf("Expected no error for a valid table name. Got %s", err)
+	}
+	if m == nil || m.tableName != "my_migrations" {
+		t.Error("Expected a configured Migrator to be returned")
+	}
+}
+
+func TestNewMigratorERejectsBlankNames(t *testing.T) {
+	_, err := NewMigratorE(WithTableName(" ;; "))
+	if !errors.Is(err, ErrBlankTableName) {
+		t.Errorf("Expected %v, got %v", ErrBlankTableName, err)
+	}
+
+	_, err = NewMigratorE(WithTableName("  ", "my_migrations"))
+	if !errors.Is(err, ErrBlankSchemaName) {
+		t.Errorf("Expected %v, got %v", ErrBlankSchemaName, err)
+	}
+}
+
+func TestWithDialectOption(t *testing.T) {
+	m := NewMigrator()
+	if m.dialect != Postgres {
+		t.Errorf("Expected the Postgres dialect by default. Got %T", m.dialect)
+	}
+	m = NewMigrator(WithDialect(CockroachDB))
+	if m.dialect != CockroachDB {
+		t.Errorf("Expected the CockroachDB dialect. Got %T", m.dialect)
+	}
+}
+
+func TestWithTableOutsideTransactionOption(t *testing.T) {
+	if NewMigrator().tableOutsideTx {
+		t.Error("Expected the tracking table to be created inside the transaction by default")
+	}
+	if !NewMigrator(WithTableOutsideTransaction()).tableOutsideTx {
+		t.Error("Expected WithTableOutsideTransaction to be applied")
+	}
+}
+
+func TestWithTableOutsideTransactionRejectsCockroachDB(t *testing.T) {
+	_, err := NewMigratorE(WithDialect(CockroachDB), WithTableOutsideTransaction())
+	if !errors.Is(err, ErrTableOutsideTxUnsupported) {
+		t.Errorf("Expected %v from NewMigratorE, got %v", ErrTableOutsideTxUnsupported, err)
+	}
+
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrator := NewMigrator(WithDialect(CockroachDB), WithTableOutsideTransaction())
+	err = migrator.Apply(mock, testMigrations(t, "useless-ansi"))
+	if !errors.Is(err, ErrTableOutsideTxUnsupported) {
+		t.Errorf("Expected %v from Apply, got %v", ErrTableOutsideTxUnsupported, err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWithRowScannerOption(t *testing.T) {
+	m := NewMigrator()
+	if m.selectColumns() != AppliedMigrationColumns {
+		t.Errorf("Expected default columns. Got '%s'", m.selectColumns())
+	}
+	m = NewMigrator(WithRowScanner(scanAppliedMigration, "id", "checksum"))
+	if m.selectColumns() != "id, checksum" {
+		t.Errorf("Expected custom columns. Got '%s'", m.selectColumns())
+	}
+	if m.rowScanner == nil {
+		t.Error("Expected the RowScanner to be set")
+	}
+}
+
+func TestWithBuildInfoOption(t *testing.T) {
+	m := NewMigrator()
+	if m.buildVersion != "" || m.buildCommit != "" {
+		t.Errorf("Expected blank build info by default. Got '%s' and '%s'", m.buildVersion, m.buildCommit)
+	}
+	m = NewMigrator(WithBuildInfo("1.2.3", "0a1b2c3"))
+	if m.buildVersion != "1.2.3" || m.buildCommit != "0a1b2c3" {
+		t.Errorf("Expected build info to be set. Got '%s' and '%s'", m.buildVersion, m.buildCommit)
+	}
+}
+
+func TestHeldConnectionWithoutHoldConnection(t *testing.T) {
+	if conn := NewMigrator().HeldConnection(); conn != nil {
+		t.Errorf("Expected no held connection. Got %v", conn)
+	}
+	if conn := NewMigrator(WithHoldConnection()).HeldConnection(); conn != nil {
+		t.Errorf("Expected no held connection before Apply. Got %v", conn)
+	}
+}
+
+func TestApplyWithCallLogger(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^SELECT pg_advisory_lock").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectBegin()
+	mock.ExpectExec("^\\s*CREATE TABLE").WillReturnResult(pgconn.CommandTag{})
+	mock.ExpectQuery("^\\s*SELECT COALESCE\\(character_maximum_length").
+		WillReturnRows(pgxmock.NewRows([]string{"width"}).AddRow(int32(32)))
+	mock.ExpectQuery("^\\s*SELECT DISTINCT id").WillReturnRows(pgxmock.NewRows([]string{"id"}).
+		AddRow("0000-00-00 001 Select 1").AddRow("0000-00-00 002 Select 2"))
+	mock.ExpectCommit()
+	mock.ExpectQuery("^SELECT pg_advisory_unlock").WillReturnRows(pgxmock.NewRows([]string{"pg_advisory_unlock"}).AddRow(true))
+
+	var migratorLog, callLog sliceLog
+	migrator := NewMigrator(WithLogger(&migratorLog))
+	err = migrator.Apply(mock, testMigrations(t, "useless-ansi"), WithCallLogger(&callLog))
+	if err != nil {
+		t.Error(err)
+	}
+	if len(callLog.msgs) == 0 {
+		t.Error("Expected the call's Logger to be used")
+	}
+	if len(migratorLog.msgs) != 0 {
+		t.Errorf("Expected the Migrator's Logger not to be used. Got %v", migratorLog.msgs)
+	}
+	if migrator.Logger != &migratorLog {
+		t.Error("Expected the Migrator's Logger to be unchanged")
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
 )
 
 // Connection defines the interface for either a *pgxpool.Pool or a *pgx.Conn,
@@ -22,8 +23,68 @@ type Queryer interface {
 	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
 }
 
+// CopyFromer defines the interface for a pgx.Tx (or a *pgx.Conn or
+// *pgxpool.Pool) which can bulk-load rows via the COPY protocol. It is needed
+// to apply a Migration with Data.
+type CopyFromer interface {
+	CopyFrom(ctx context.Context, tableName pgx.Identifier, columnNames []string, rowSrc pgx.CopyFromSource) (int64, error)
+}
+
 // Transactor defines the interface for either a *pgxpool.Pool or a *pgx.Conn,
 // both of which can start new transactions.
 type Transactor interface {
 	Begin(ctx context.Context) (pgx.Tx, error)
 }
+
+// Acquirer defines the interface for a *pgxpool.Pool, which can provide a
+// dedicated connection. Session-level state such as advisory locks belongs to
+// a single connection, so when the db provided to Apply is an Acquirer, one
+// connection is acquired and used for the whole migration.
+type Acquirer interface {
+	Acquire(ctx context.Context) (*pgxpool.Conn, error)
+}
+
+// Dialect defines the interface for the SQL which differs between databases
+// that speak the PostgreSQL wire protocol. The Postgres dialect is used by
+// default. A different one can be supplied via the WithDialect() option. Each
+// method receives the unquoted schema (which may be blank) and table names of
+// the tracking table, and is responsible for quoting them.
+//
+type Dialect interface {
+	// LockSQL returns the statement which is run before the migration
+	// transaction begins to prevent concurrent migrators from proceeding. An
+	// empty string skips locking.
+	LockSQL(schemaName, tableName string) string
+
+	// UnlockSQL returns the statement which is run after the migration
+	// transaction ends to release the lock. An empty string skips unlocking.
+	UnlockSQL(schemaName, tableName string) string
+
+	// CreateSQL returns the statement which is run inside the migration
+	// transaction to create the tracking table if it doesn't exist.
+	CreateSQL(schemaName, tableName string) string
+
+	// InsertSQL returns the statement which records an applied migration in
+	// the tracking table.
+	InsertSQL(schemaName, tableName string) string
+
+	// SelectSQL returns the query which reads all applied migrations from the
+	// tracking table.
+	SelectSQL(schemaName, tableName string) string
+}
+
+// TryLocker is optionally implemented by a Dialect which can attempt to obtain
+// its lock without blocking. TryLockSQL returns a query which returns a single
+// boolean reporting whether the lock was obtained. It is used by the
+// WithOnLockWait option to detect contention.
+type TryLocker interface {
+	TryLockSQL(schemaName, tableName string) string
+}
+
+// TablespaceCreator is optionally implemented by a Dialect which can create
+// the tracking table in a particular tablespace. CreateInTablespaceSQL
+// returns the same statements as CreateSQL, with a TABLESPACE clause on the
+// CREATE TABLE. It is used by the WithTablespace option.
+type TablespaceCreator interface {
+	CreateInTablespaceSQL(schemaName, tableName, tablespace string) string
+}
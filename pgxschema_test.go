@@ -27,6 +27,21 @@ var (
 	_ Queryer = pgx.Tx(nil)
 )
 
+// Interface verification that pgx.Conn, pgxpool.Pool and pgx.Tx all support
+// our CopyFromer interface.
+var (
+	_ CopyFromer = &pgx.Conn{}
+	_ CopyFromer = &pgxpool.Pool{}
+	_ CopyFromer = pgx.Tx(nil)
+)
+
+// Interface verification that pgxpool.Pool satisfies our Acquirer interface,
+// and that the connections it provides satisfy our Connection interface.
+var (
+	_ Acquirer   = &pgxpool.Pool{}
+	_ Connection = &pgxpool.Conn{}
+)
+
 // TestDBs holds all of the specific database instances against which tests
 // will run.
 var TestDBs = map[string]*TestDB{
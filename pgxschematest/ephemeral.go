@@ -0,0 +1,85 @@
+// Package pgxschematest provides helpers for testing migrations against a
+// throwaway PostgreSQL database running in Docker.
+package pgxschematest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/ory/dockertest/v3"
+	"github.com/ory/dockertest/v3/docker"
+)
+
+const (
+	username     = "pgxschemauser"
+	password     = "pgxschemasecret"
+	databaseName = "pgxschematests"
+)
+
+// NewEphemeralDB starts a PostgreSQL container from the postgres Docker image
+// with the provided tag (e.g. "14-alpine", or "" for "latest"), and returns a
+// pool connected to its empty database. The returned function closes the pool
+// and removes the container, and should be deferred. The test fails if
+// Docker isn't running or the database can't be reached.
+func NewEphemeralDB(t *testing.T, tag string) (*pgxpool.Pool, func()) {
+	t.Helper()
+	if tag == "" {
+		tag = "latest"
+	}
+
+	pool, err := dockertest.NewPool("")
+	if err != nil {
+		t.Fatalf("Could not connect to Docker: %s", err)
+	}
+
+	resource, err := pool.RunWithOptions(&dockertest.RunOptions{
+		Repository: "postgres",
+		Tag:        tag,
+		Env: []string{
+			fmt.Sprintf("POSTGRES_USER=%s", username),
+			fmt.Sprintf("POSTGRES_PASSWORD=%s", password),
+			fmt.Sprintf("POSTGRES_DB=%s", databaseName),
+		},
+	}, func(config *docker.HostConfig) {
+		config.AutoRemove = true
+		config.RestartPolicy = docker.RestartPolicy{
+			Name: "no",
+		}
+	})
+	if err != nil {
+		t.Fatalf("Could not start container postgres:%s: %s", tag, err)
+	}
+
+	// Even if cleanup is never called, kill off the container eventually
+	_ = resource.Expire(120)
+
+	dsn := fmt.Sprintf("postgres://%s:%s@localhost:%s/%s?sslmode=disable",
+		username, password, resource.GetPort("5432/tcp"), databaseName)
+
+	var db *pgxpool.Pool
+	err = pool.Retry(func() error {
+		db, err = pgxpool.Connect(context.Background(), dsn)
+		if err != nil {
+			return err
+		}
+		err = db.Ping(context.Background())
+		if err != nil {
+			db.Close()
+		}
+		return err
+	})
+	if err != nil {
+		_ = pool.Purge(resource)
+		t.Fatalf("Could not connect to %s: %s", dsn, err)
+	}
+
+	cleanup := func() {
+		db.Close()
+		if err := pool.Purge(resource); err != nil {
+			t.Errorf("Could not remove container postgres:%s: %s", tag, err)
+		}
+	}
+	return db, cleanup
+}
@@ -0,0 +1,36 @@
+package pgxschematest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/adlio/pgxschema"
+	"github.com/ory/dockertest/v3"
+)
+
+func TestNewEphemeralDB(t *testing.T) {
+	pool, err := dockertest.NewPool("")
+	if err == nil {
+		err = pool.Client.Ping()
+	}
+	if err != nil {
+		t.Skipf("Docker is not running: %s", err)
+	}
+
+	db, cleanup := NewEphemeralDB(t, "")
+	defer cleanup()
+
+	migrator := pgxschema.NewMigrator()
+	err = migrator.Apply(db, []*pgxschema.Migration{
+		{ID: "2021-01-01 Create Widgets", Script: "CREATE TABLE widgets (id INTEGER)"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var count int
+	err = db.QueryRow(context.Background(), "SELECT COUNT(*) FROM widgets").Scan(&count)
+	if err != nil {
+		t.Error(err)
+	}
+}
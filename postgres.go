@@ -0,0 +1,322 @@
+package pgxschema
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Postgres is the default Dialect. It serializes concurrent migrators with a
+// session-level advisory lock whose identifier is derived from the name of
+// the migrations tracking table.
+var Postgres = postgresDialect{}
+
+type postgresDialect struct{}
+
+// LockSQL generates the statement which obtains the advisory lock for the
+// provided tracking table. The lock identifier is derived from the table name
+// alone, so that migrators running older versions of this package (which
+// didn't consider the schema) still exclude each other.
+func (p postgresDialect) LockSQL(schemaName, tableName string) string {
+	return fmt.Sprintf(`SELECT pg_advisory_lock(%d)`, LockIdentifierForTable(tableName))
+}
+
+// TryLockSQL generates the query which obtains the advisory lock for the
+// provided tracking table if it is available, returning whether it was
+func (p postgresDialect) TryLockSQL(schemaName, tableName string) string {
+	return fmt.Sprintf(`SELECT pg_try_advisory_lock(%d)`, LockIdentifierForTable(tableName))
+}
+
+// UnlockSQL generates the statement which releases the advisory lock for the
+// provided tracking table
+func (p postgresDialect) UnlockSQL(schemaName, tableName string) string {
+	return fmt.Sprintf(`SELECT pg_advisory_unlock(%d)`, LockIdentifierForTable(tableName))
+}
+
+// CreateSQL generates the statements which create the migrations tracking
+// table, and idempotently add any columns which tables created by earlier
+// versions of this package lack.
+func (p postgresDialect) CreateSQL(schemaName, tableName string) string {
+	return p.CreateInTablespaceSQL(schemaName, tableName, "")
+}
+
+// CreateInTablespaceSQL generates the same statements as CreateSQL, creating
+// the table in the provided tablespace (unless it's blank). A table which
+// already exists is left where it is.
+func (p postgresDialect) CreateInTablespaceSQL(schemaName, tableName, tablespace string) string {
+	tn := QuotedTableName(schemaName, tableName)
+	return fmt.Sprintf(`
+				CREATE TABLE IF NOT EXISTS %s (
+					id VARCHAR(255) NOT NULL,
+					checksum VARCHAR(32) NOT NULL DEFAULT '',
+					execution_time_in_millis INTEGER NOT NULL DEFAULT 0,
+					applied_at TIMESTAMP WITH TIME ZONE NOT NULL,
+					%s
+				)%s;
+				ALTER TABLE %s
+					ADD COLUMN IF NOT EXISTS %s
+			`,
+		tn,
+		strings.Join(addedTrackingColumns, ",\n\t\t\t\t\t"),
+		tablespaceClause(tablespace),
+		tn,
+		strings.Join(addedTrackingColumns, ",\n\t\t\t\t\tADD COLUMN IF NOT EXISTS "),
+	)
+}
+
+// tablespaceClause returns the TABLESPACE clause for a CREATE TABLE
+// statement, or nothing if the tablespace is blank
+func tablespaceClause(tablespace string) string {
+	if tablespace == "" {
+		return ""
+	}
+	return " TABLESPACE " + QuotedIdent(tablespace)
+}
+
+// InsertSQL generates the statement which records an applied migration in
+// the tracking table. Its parameters are the id, checksum,
+// execution_time_in_millis, applied_at, checksum_algorithm, version and commit.
+func (p postgresDialect) InsertSQL(schemaName, tableName string) string {
+	return fmt.Sprintf(`
+				INSERT INTO %s
+				( id, checksum, execution_time_in_millis, applied_at, checksum_algorithm, version, commit )
+				VALUES
+				( $1, $2, $3, $4, $5, $6, $7 )
+				`,
+		QuotedTableName(schemaName, tableName),
+	)
+}
+
+// SelectSQL generates the query which reads the applied migrations from the
+// tracking table. Its columns are AppliedMigrationColumns. Migrations which
+// were recorded more than once are ordered by when they were applied.
+func (p postgresDialect) SelectSQL(schemaName, tableName string) string {
+	return fmt.Sprintf(`
+		SELECT %s
+		FROM %s
+		ORDER BY id ASC, applied_at ASC
+	`, AppliedMigrationColumns, QuotedTableName(schemaName, tableName))
+}
+
+// addedTrackingColumns lists the definitions of the columns which were added
+// to the tracking table after its original four (id, checksum,
+// execution_time_in_millis and applied_at). Each is idempotently added to
+// existing tables by CreateSQL, so each must be nullable or have a default.
+var addedTrackingColumns = []string{
+	"checksum_algorithm VARCHAR(16) NOT NULL DEFAULT 'md5'",
+	"version VARCHAR(255) NOT NULL DEFAULT ''",
+	"commit VARCHAR(255) NOT NULL DEFAULT ''",
+	"rolled_back_at TIMESTAMP WITH TIME ZONE",
+}
+
+// ordinalColumnDefinition is the definition of the column added to the
+// tracking table by WithOrdinalColumn
+const ordinalColumnDefinition = "ordinal BIGINT"
+
+// ordinalAssignSQL generates the statement which assigns the next ordinal to
+// the migration just recorded. Its only parameter is the migration's ID. The
+// lock held while migrating keeps concurrent migrators from assigning the same
+// ordinal.
+func ordinalAssignSQL(tableName string) string {
+	return fmt.Sprintf(`
+				UPDATE %s
+				SET ordinal = (SELECT COALESCE(MAX(ordinal), 0) + 1 FROM %s)
+				WHERE id = $1 AND ordinal IS NULL
+			`, tableName, tableName)
+}
+
+// checksumSignatureColumnDefinition is the definition of the column added to
+// the tracking table by WithChecksumSigner
+const checksumSignatureColumnDefinition = "checksum_signature TEXT"
+
+// checksumSignSQL generates the statement which records the signature of the
+// checksum of the migration just recorded. Its parameters are the migration's
+// ID, checksum and signature.
+func checksumSignSQL(tableName string) string {
+	return fmt.Sprintf(`
+				UPDATE %s
+				SET checksum_signature = $3
+				WHERE id = $1 AND checksum = $2 AND checksum_signature IS NULL
+			`, tableName)
+}
+
+// heartbeatCreateSQL generates the statement which creates the coordination
+// table used by WithHeartbeat. It holds at most one row, which describes the
+// most recent migration run.
+func heartbeatCreateSQL(tableName string) string {
+	return fmt.Sprintf(`
+				CREATE TABLE IF NOT EXISTS %s (
+					id INTEGER NOT NULL PRIMARY KEY,
+					owner VARCHAR(255) NOT NULL DEFAULT '',
+					started_at TIMESTAMP WITH TIME ZONE NOT NULL,
+					heartbeat_at TIMESTAMP WITH TIME ZONE NOT NULL,
+					finished_at TIMESTAMP WITH TIME ZONE
+				)
+			`, tableName)
+}
+
+// heartbeatStartSQL generates the statement which records that a migration run
+// has started. Its only parameter is the owner.
+func heartbeatStartSQL(tableName string) string {
+	return fmt.Sprintf(`
+				INSERT INTO %s (id, owner, started_at, heartbeat_at, finished_at)
+				VALUES (1, $1, now(), now(), NULL)
+				ON CONFLICT (id) DO UPDATE SET
+					owner = EXCLUDED.owner,
+					started_at = EXCLUDED.started_at,
+					heartbeat_at = EXCLUDED.heartbeat_at,
+					finished_at = NULL
+			`, tableName)
+}
+
+// heartbeatBeatSQL generates the statement which records that the migration
+// run is still in progress
+func heartbeatBeatSQL(tableName string) string {
+	return fmt.Sprintf(`UPDATE %s SET heartbeat_at = now() WHERE id = 1`, tableName)
+}
+
+// heartbeatFinishSQL generates the statement which records that the migration
+// run has finished
+func heartbeatFinishSQL(tableName string) string {
+	return fmt.Sprintf(`UPDATE %s SET heartbeat_at = now(), finished_at = now() WHERE id = 1`, tableName)
+}
+
+// heartbeatSelectSQL generates the query which reads the heartbeat row
+func heartbeatSelectSQL(tableName string) string {
+	return fmt.Sprintf(`SELECT owner, started_at, heartbeat_at, finished_at FROM %s WHERE id = 1`, tableName)
+}
+
+// failuresCreateSQL generates the statement which creates the table used by
+// WithRecordFailures. It holds a row for each failed migration attempt.
+func failuresCreateSQL(tableName string) string {
+	return fmt.Sprintf(`
+				CREATE TABLE IF NOT EXISTS %s (
+					id VARCHAR(255) NOT NULL,
+					error TEXT NOT NULL,
+					failed_at TIMESTAMP WITH TIME ZONE NOT NULL
+				)
+			`, tableName)
+}
+
+// failuresInsertSQL generates the statement which records a failed migration.
+// Its parameters are the migration's ID and the error message.
+func failuresInsertSQL(tableName string) string {
+	return fmt.Sprintf(`INSERT INTO %s (id, error, failed_at) VALUES ($1, $2, now())`, tableName)
+}
+
+// failuresPruneSQL generates the statement which deletes failures recorded
+// before a cutoff. Its only parameter is the cutoff's age in milliseconds.
+func failuresPruneSQL(tableName string) string {
+	return fmt.Sprintf(`DELETE FROM %s WHERE failed_at < now() - $1::bigint * interval '1 millisecond'`, tableName)
+}
+
+// leaseCreateSQL generates the statement which creates the coordination table
+// used by RunOnce. It holds a row for each lease key which has been taken.
+func leaseCreateSQL(tableName string) string {
+	return fmt.Sprintf(`
+				CREATE TABLE IF NOT EXISTS %s (
+					lease_key VARCHAR(255) NOT NULL PRIMARY KEY,
+					owner VARCHAR(255) NOT NULL,
+					expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+				)
+			`, tableName)
+}
+
+// leaseAcquireSQL generates the statement which takes a lease, unless another
+// owner holds it and it hasn't expired. It affects a row only if the lease was
+// taken. Its parameters are the lease key, the owner and the lease's duration
+// in milliseconds.
+func leaseAcquireSQL(tableName string) string {
+	return fmt.Sprintf(`
+				INSERT INTO %s AS lease (lease_key, owner, expires_at)
+				VALUES ($1, $2, now() + $3::bigint * interval '1 millisecond')
+				ON CONFLICT (lease_key) DO UPDATE SET
+					owner = EXCLUDED.owner,
+					expires_at = EXCLUDED.expires_at
+				WHERE lease.expires_at < now()
+			`, tableName)
+}
+
+// leaseReleaseSQL generates the statement which releases a lease, if it is
+// still held by the owner. Its parameters are the lease key and the owner.
+func leaseReleaseSQL(tableName string) string {
+	return fmt.Sprintf(`DELETE FROM %s WHERE lease_key = $1 AND owner = $2`, tableName)
+}
+
+// blockingQueriesSQL generates the query which reports the sessions blocking
+// any session which holds or is waiting for the advisory lock with the key
+// passed as $1. pg_locks splits a bigint advisory lock key into its high
+// (classid) and low (objid) 32 bits, and sets objsubid to 1.
+func blockingQueriesSQL() string {
+	return `
+				SELECT blocking.pid, COALESCE(blocking.query, ''), COALESCE(blocking.state, ''), blocked.pid,
+					COALESCE((EXTRACT(EPOCH FROM now() - blocked.query_start) * 1000)::bigint, 0)
+				FROM pg_locks l
+				JOIN pg_stat_activity blocked ON blocked.pid = l.pid
+				JOIN pg_stat_activity blocking ON blocking.pid = ANY(pg_blocking_pids(l.pid))
+				WHERE l.locktype = 'advisory' AND l.objsubid = 1
+					AND ((l.classid::bigint << 32) | l.objid::bigint) = $1
+				ORDER BY blocked.pid, blocking.pid
+			`
+}
+
+// singleVersionCreateSQL generates the statement which creates the tracking
+// table used by WithSingleVersionMode. It holds at most one row, which records
+// the ID of the most recently applied migration.
+func singleVersionCreateSQL(tableName, tablespace string) string {
+	return fmt.Sprintf(`
+				CREATE TABLE IF NOT EXISTS %s (
+					id INTEGER NOT NULL PRIMARY KEY,
+					version VARCHAR(255) NOT NULL,
+					applied_at TIMESTAMP WITH TIME ZONE NOT NULL
+				)%s
+			`, tableName, tablespaceClause(tablespace))
+}
+
+// singleVersionRecordSQL generates the statement which records the version
+// after a migration is applied. Its parameters are the version and applied_at.
+func singleVersionRecordSQL(tableName string) string {
+	return fmt.Sprintf(`
+				INSERT INTO %s (id, version, applied_at)
+				VALUES (1, $1, $2)
+				ON CONFLICT (id) DO UPDATE SET
+					version = EXCLUDED.version,
+					applied_at = EXCLUDED.applied_at
+			`, tableName)
+}
+
+// singleVersionSelectSQL generates the query which reads the current version
+func singleVersionSelectSQL(tableName string) string {
+	return fmt.Sprintf(`SELECT version FROM %s WHERE id = 1`, tableName)
+}
+
+// AppliedAtSource selects the clock which provides the applied_at time
+// recorded for each migration. See WithAppliedAtSource.
+type AppliedAtSource int
+
+const (
+	// AppliedAtClient records the client's clock when the migration started.
+	// This is the default.
+	AppliedAtClient AppliedAtSource = iota
+
+	// AppliedAtStatementTimestamp records the server's statement_timestamp()
+	// when the migration started
+	AppliedAtStatementTimestamp
+
+	// AppliedAtClockTimestamp records the server's clock_timestamp() when the
+	// migration started
+	AppliedAtClockTimestamp
+)
+
+// query returns the statement which reads the server's time for the source,
+// or an empty string for AppliedAtClient. Unlike now(), neither function is
+// frozen at the start of the transaction, so each migration in a single
+// transaction gets its own time.
+func (s AppliedAtSource) query() string {
+	switch s {
+	case AppliedAtStatementTimestamp:
+		return "SELECT statement_timestamp()"
+	case AppliedAtClockTimestamp:
+		return "SELECT clock_timestamp()"
+	}
+	return ""
+}
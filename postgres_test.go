@@ -0,0 +1,73 @@
+package pgxschema
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Interface verification that the Postgres and CockroachDB dialects satisfy
+// the Dialect interface
+var (
+	_ Dialect = Postgres
+	_ Dialect = CockroachDB
+
+	_ TryLocker = Postgres
+
+	_ TablespaceCreator = Postgres
+	_ TablespaceCreator = CockroachDB
+)
+
+func TestPostgresLockSQL(t *testing.T) {
+	expected := fmt.Sprintf("SELECT pg_advisory_lock(%d)", LockIdentifierForTable(DefaultTableName))
+	if actual := Postgres.LockSQL("public", DefaultTableName); actual != expected {
+		t.Errorf("Expected '%s', got '%s'", expected, actual)
+	}
+}
+
+func TestPostgresTryLockSQL(t *testing.T) {
+	expected := fmt.Sprintf("SELECT pg_try_advisory_lock(%d)", LockIdentifierForTable(DefaultTableName))
+	if actual := Postgres.TryLockSQL("public", DefaultTableName); actual != expected {
+		t.Errorf("Expected '%s', got '%s'", expected, actual)
+	}
+}
+
+func TestPostgresUnlockSQL(t *testing.T) {
+	expected := fmt.Sprintf("SELECT pg_advisory_unlock(%d)", LockIdentifierForTable(DefaultTableName))
+	if actual := Postgres.UnlockSQL("public", DefaultTableName); actual != expected {
+		t.Errorf("Expected '%s', got '%s'", expected, actual)
+	}
+}
+
+func TestPostgresCreateSQL(t *testing.T) {
+	sql := Postgres.CreateSQL("public", "schema_migrations")
+	if !strings.Contains(sql, `CREATE TABLE IF NOT EXISTS "public"."schema_migrations"`) {
+		t.Errorf("Expected CreateSQL to create the quoted table. Got:\n%s", sql)
+	}
+	if !strings.Contains(sql, `ALTER TABLE "public"."schema_migrations"`) || !strings.Contains(sql, "ADD COLUMN IF NOT EXISTS checksum_algorithm") {
+		t.Errorf("Expected CreateSQL to add the checksum_algorithm column to existing tables. Got:\n%s", sql)
+	}
+	if !strings.Contains(sql, "ADD COLUMN IF NOT EXISTS rolled_back_at TIMESTAMP WITH TIME ZONE") {
+		t.Errorf("Expected CreateSQL to add the rolled_back_at column to existing tables. Got:\n%s", sql)
+	}
+}
+
+func TestPostgresInsertSQL(t *testing.T) {
+	sql := Postgres.InsertSQL("special", "my_migrations")
+	if !strings.Contains(sql, `INSERT INTO "special"."my_migrations"`) {
+		t.Errorf("Expected InsertSQL to insert into the quoted table. Got:\n%s", sql)
+	}
+	if !strings.Contains(sql, "$7") {
+		t.Errorf("Expected InsertSQL to take 7 parameters. Got:\n%s", sql)
+	}
+}
+
+func TestPostgresSelectSQL(t *testing.T) {
+	sql := Postgres.SelectSQL("", "schema_migrations")
+	if !strings.Contains(sql, `FROM "schema_migrations"`) {
+		t.Errorf("Expected SelectSQL to select from the quoted table. Got:\n%s", sql)
+	}
+	if !strings.Contains(sql, "SELECT "+AppliedMigrationColumns) {
+		t.Errorf("Expected SelectSQL to select the applied migration columns. Got:\n%s", sql)
+	}
+}
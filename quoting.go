@@ -3,6 +3,7 @@ package pgxschema
 import (
 	"hash/crc32"
 	"strings"
+	"sync"
 	"unicode"
 )
 
@@ -46,6 +47,31 @@ func QuotedIdent(ident string) string {
 	return sb.String()
 }
 
+// serverQuotedName caches the tracking table's name as quoted by the
+// server's quote_ident function. See WithServerSideQuoting.
+type serverQuotedName struct {
+	mutex  sync.Mutex
+	quoted string
+}
+
+// get returns the cached name, or an empty string if it hasn't been resolved
+func (sq *serverQuotedName) get() string {
+	if sq == nil {
+		return ""
+	}
+	sq.mutex.Lock()
+	defer sq.mutex.Unlock()
+	return sq.quoted
+}
+
+// IsBlankIdent reports whether the provided identifier would be empty once
+// it has been quoted by QuotedIdent (i.e. it is empty or consists only of
+// whitespace and semicolons).
+func IsBlankIdent(ident string) bool {
+	quoted := QuotedIdent(ident)
+	return quoted == "" || quoted == `""`
+}
+
 // LockIdentifierForTable computes a hash of the migrations table's name which
 // can be used as a unique name for the Postgres advisory lock
 //
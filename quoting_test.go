@@ -43,3 +43,20 @@ func TestLockIdentifierForTable(t *testing.T) {
 		t.Errorf("Expected %v, got %v", expected, id)
 	}
 }
+
+func TestIsBlankIdent(t *testing.T) {
+	table := map[string]bool{
+		"":                  true,
+		"   ":               true,
+		";":                 true,
+		" ; ;\t":            true,
+		"schema_migrations": false,
+		`"`:                 false,
+	}
+	for ident, expected := range table {
+		actual := IsBlankIdent(ident)
+		if expected != actual {
+			t.Errorf("Expected IsBlankIdent(%q) to be %t, got %t", ident, expected, actual)
+		}
+	}
+}
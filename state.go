@@ -0,0 +1,43 @@
+package pgxschema
+
+// MigrationState summarizes a MigrationStatus as a single value, e.g. for
+// display in a UI
+type MigrationState int
+
+const (
+	// StatePending is a provided migration which hasn't been applied
+	StatePending MigrationState = iota
+
+	// StateApplied is a provided migration which has been applied, and whose
+	// checksum still matches the one recorded
+	StateApplied
+
+	// StateDrifted is a provided migration which has been applied, but whose
+	// checksum no longer matches the one recorded (e.g. because its Script
+	// was edited afterwards)
+	StateDrifted
+
+	// StateOrphaned is a migration which has been applied, but wasn't provided
+	StateOrphaned
+
+	// StateRolledBack is a provided migration which was applied, but has since
+	// been marked as rolled back, so it will be applied again
+	StateRolledBack
+)
+
+// String returns the name of the state
+func (s MigrationState) String() string {
+	switch s {
+	case StatePending:
+		return "Pending"
+	case StateApplied:
+		return "Applied"
+	case StateDrifted:
+		return "Drifted"
+	case StateOrphaned:
+		return "Orphaned"
+	case StateRolledBack:
+		return "RolledBack"
+	}
+	return "Unknown"
+}
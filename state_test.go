@@ -0,0 +1,19 @@
+package pgxschema
+
+import "testing"
+
+func TestMigrationStateString(t *testing.T) {
+	table := map[MigrationState]string{
+		StatePending:       "Pending",
+		StateApplied:       "Applied",
+		StateDrifted:       "Drifted",
+		StateOrphaned:      "Orphaned",
+		StateRolledBack:    "RolledBack",
+		MigrationState(99): "Unknown",
+	}
+	for state, expected := range table {
+		if state.String() != expected {
+			t.Errorf("Expected %d to be '%s'. Got '%s'", state, expected, state.String())
+		}
+	}
+}
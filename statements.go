@@ -0,0 +1,346 @@
+package pgxschema
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// statementScanner splits a stream of SQL into individual statements on
+// top-level semicolons. Semicolons inside quoted strings, quoted identifiers,
+// dollar-quoted bodies, comments and BEGIN ATOMIC ... END function bodies do
+// not end a statement.
+type statementScanner struct {
+	r    *bufio.Reader
+	stmt string
+	err  error
+}
+
+func newStatementScanner(r io.Reader) *statementScanner {
+	return &statementScanner{r: bufio.NewReader(r)}
+}
+
+// splitStatements splits a script into its individual statements. Statements
+// which are empty (apart from whitespace) are omitted.
+func splitStatements(script string) []string {
+	statements := make([]string, 0)
+	scanner := newStatementScanner(strings.NewReader(script))
+	for scanner.Next() {
+		statements = append(statements, scanner.Statement())
+	}
+	return statements
+}
+
+// Statement returns the most recent statement found by Next, without its
+// terminating semicolon or surrounding whitespace.
+func (s *statementScanner) Statement() string {
+	return s.stmt
+}
+
+// Err returns the first non-EOF error encountered while reading
+func (s *statementScanner) Err() error {
+	return s.err
+}
+
+// Next advances to the next non-empty statement, returning false when the
+// input is exhausted or an error occurs.
+func (s *statementScanner) Next() bool {
+	for s.err == nil {
+		stmt, err := s.readStatement()
+		if err != nil && err != io.EOF {
+			s.err = err
+			return false
+		}
+		s.stmt = strings.TrimSpace(stmt)
+		if s.stmt != "" {
+			return true
+		}
+		if err == io.EOF {
+			return false
+		}
+	}
+	return false
+}
+
+// readStatement reads runes up to and including the next top-level semicolon,
+// returning the statement text without the semicolon.
+func (s *statementScanner) readStatement() (string, error) {
+	var sb strings.Builder
+	var prev, prevPrev rune
+	var words atomicTracker
+	for {
+		r, _, err := s.r.ReadRune()
+		if err != nil {
+			return sb.String(), err
+		}
+		words.next(r)
+
+		switch {
+		case r == ';' && !words.inAtomic():
+			return sb.String(), nil
+		case r == '\'':
+			escapes := (prev == 'E' || prev == 'e') && !isIdentRune(prevPrev)
+			sb.WriteRune(r)
+			err = s.readQuoted(&sb, '\'', escapes)
+		case r == '"':
+			sb.WriteRune(r)
+			err = s.readQuoted(&sb, '"', false)
+		case r == '-' && s.peekIs('-'):
+			sb.WriteRune(r)
+			err = s.readLineComment(&sb)
+		case r == '/' && s.peekIs('*'):
+			sb.WriteRune(r)
+			err = s.readBlockComment(&sb)
+		case r == '$' && !isIdentRune(prev):
+			sb.WriteRune(r)
+			err = s.readDollarQuoted(&sb)
+		default:
+			sb.WriteRune(r)
+		}
+		if err != nil {
+			return sb.String(), err
+		}
+		prevPrev, prev = prev, r
+	}
+}
+
+// atomicTracker follows the unquoted words of a statement to tell whether it
+// is inside the body of a SQL-standard function (BEGIN ATOMIC ... END), whose
+// statements end with semicolons which don't end the enclosing statement.
+// CASE expressions in the body also end with END, so they are counted too.
+type atomicTracker struct {
+	word     strings.Builder
+	lastWord string
+	depth    int
+}
+
+// next records a rune read outside of quotes and comments
+func (at *atomicTracker) next(r rune) {
+	if isIdentRune(r) {
+		at.word.WriteRune(r)
+		return
+	}
+	if at.word.Len() == 0 {
+		return
+	}
+	word := strings.ToUpper(at.word.String())
+	at.word.Reset()
+	switch {
+	case word == "ATOMIC" && at.lastWord == "BEGIN" && at.depth == 0:
+		at.depth = 1
+	case word == "CASE" && at.depth > 0:
+		at.depth++
+	case word == "END" && at.depth > 0:
+		at.depth--
+	}
+	at.lastWord = word
+}
+
+// inAtomic reports whether a BEGIN ATOMIC body is open
+func (at *atomicTracker) inAtomic() bool {
+	return at.depth > 0
+}
+
+// readQuoted consumes a string literal or quoted identifier whose opening
+// quote has already been written. A doubled quote is an escaped quote. If
+// backslashes is true (for E'...' escape strings), a backslash escapes the next rune.
+func (s *statementScanner) readQuoted(sb *strings.Builder, quote rune, backslashes bool) error {
+	for {
+		r, _, err := s.r.ReadRune()
+		if err != nil {
+			return err
+		}
+		sb.WriteRune(r)
+		switch {
+		case backslashes && r == '\\':
+			r, _, err = s.r.ReadRune()
+			if err != nil {
+				return err
+			}
+			sb.WriteRune(r)
+		case r == quote:
+			if !s.peekIs(quote) {
+				return nil
+			}
+			r, _, _ = s.r.ReadRune()
+			sb.WriteRune(r)
+		}
+	}
+}
+
+// readLineComment consumes a -- comment through the end of the line
+func (s *statementScanner) readLineComment(sb *strings.Builder) error {
+	for {
+		r, _, err := s.r.ReadRune()
+		if err != nil {
+			return err
+		}
+		sb.WriteRune(r)
+		if r == '\n' {
+			return nil
+		}
+	}
+}
+
+// readBlockComment consumes a /* */ comment, which may be nested, whose
+// opening / has already been written
+func (s *statementScanner) readBlockComment(sb *strings.Builder) error {
+	star, _, err := s.r.ReadRune()
+	if err != nil {
+		return err
+	}
+	sb.WriteRune(star)
+	depth := 1
+	var prev rune
+	for {
+		r, _, err := s.r.ReadRune()
+		if err != nil {
+			return err
+		}
+		sb.WriteRune(r)
+		switch {
+		case prev == '/' && r == '*':
+			depth++
+			r = 0
+		case prev == '*' && r == '/':
+			depth--
+			if depth == 0 {
+				return nil
+			}
+			r = 0
+		}
+		prev = r
+	}
+}
+
+// readDollarQuoted consumes a $tag$ ... $tag$ body whose opening $ has
+// already been written. If the $ doesn't begin a valid tag (e.g. it is a
+// positional parameter like $1), only the runes examined are consumed.
+func (s *statementScanner) readDollarQuoted(sb *strings.Builder) error {
+	var tag strings.Builder
+	tag.WriteRune('$')
+	for {
+		r, _, err := s.r.ReadRune()
+		if err != nil {
+			sb.WriteString(tag.String()[1:])
+			return err
+		}
+		if r == '$' {
+			break
+		}
+		validStart := tag.Len() > 1 || !unicode.IsDigit(r)
+		if !isIdentRune(r) || !validStart {
+			_ = s.r.UnreadRune()
+			sb.WriteString(tag.String()[1:])
+			return nil
+		}
+		tag.WriteRune(r)
+	}
+	tag.WriteRune('$')
+	delimiter := tag.String()
+	sb.WriteString(delimiter[1:])
+
+	var body strings.Builder
+	for {
+		r, _, err := s.r.ReadRune()
+		if err != nil {
+			sb.WriteString(body.String())
+			return err
+		}
+		body.WriteRune(r)
+		if r == '$' && strings.HasSuffix(body.String(), delimiter) {
+			sb.WriteString(body.String())
+			return nil
+		}
+	}
+}
+
+// peekIs reports whether the next rune to be read is r, without consuming it
+func (s *statementScanner) peekIs(r rune) bool {
+	next, _, err := s.r.ReadRune()
+	if err != nil {
+		return false
+	}
+	_ = s.r.UnreadRune()
+	return next == r
+}
+
+// isIdentRune reports whether r can be part of an unquoted identifier
+func isIdentRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// firstKeyword returns the upper-cased first word of a statement, skipping
+// any leading whitespace and comments
+func firstKeyword(stmt string) string {
+	keyword, _ := nextKeyword(stmt)
+	return keyword
+}
+
+// nextKeyword returns the upper-cased first word of a statement, skipping any
+// leading whitespace and comments, along with the remainder of the statement
+// following that word
+func nextKeyword(stmt string) (keyword, rest string) {
+	for {
+		stmt = strings.TrimLeftFunc(stmt, unicode.IsSpace)
+		switch {
+		case strings.HasPrefix(stmt, "--"):
+			end := strings.IndexByte(stmt, '\n')
+			if end < 0 {
+				return "", ""
+			}
+			stmt = stmt[end+1:]
+		case strings.HasPrefix(stmt, "/*"):
+			end := strings.Index(stmt, "*/")
+			if end < 0 {
+				return "", ""
+			}
+			stmt = stmt[end+2:]
+		default:
+			end := strings.IndexFunc(stmt, func(r rune) bool { return !isIdentRune(r) })
+			if end < 0 {
+				end = len(stmt)
+			}
+			return strings.ToUpper(stmt[:end]), stmt[end:]
+		}
+	}
+}
+
+// isDML reports whether a statement reads or modifies data (and can therefore
+// be EXPLAINed without executing it), as opposed to being DDL or a utility
+// command
+func isDML(stmt string) bool {
+	switch firstKeyword(stmt) {
+	case "SELECT", "INSERT", "UPDATE", "DELETE", "WITH", "MERGE", "VALUES":
+		return true
+	}
+	return false
+}
+
+// isTransactionControl reports whether a statement begins, commits or aborts
+// a transaction. Savepoint statements (including ROLLBACK TO SAVEPOINT) are
+// not considered transaction control, since they are safe inside a
+// transaction.
+func isTransactionControl(stmt string) bool {
+	keyword, rest := nextKeyword(stmt)
+	switch keyword {
+	case "BEGIN", "START", "COMMIT", "END", "ABORT":
+		return true
+	case "ROLLBACK":
+		next, _ := nextKeyword(rest)
+		return next != "TO"
+	}
+	return false
+}
+
+// findTransactionControl returns the first top-level transaction control
+// statement in a script, or an empty string if there is none
+func findTransactionControl(script string) string {
+	for _, stmt := range splitStatements(script) {
+		if isTransactionControl(stmt) {
+			return stmt
+		}
+	}
+	return ""
+}
@@ -0,0 +1,103 @@
+package pgxschema
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+	type splitTest struct {
+		script   string
+		expected []string
+	}
+	tests := []splitTest{
+		{"", []string{}},
+		{" ; ;\n", []string{}},
+		{"SELECT 1", []string{"SELECT 1"}},
+		{"SELECT 1; SELECT 2;", []string{"SELECT 1", "SELECT 2"}},
+		{"SELECT ';'; SELECT 'it''s;'", []string{"SELECT ';'", "SELECT 'it''s;'"}},
+		{`SELECT E'\';'; SELECT 2`, []string{`SELECT E'\';'`, "SELECT 2"}},
+		{`SELECT 1 AS "a;b"; SELECT 2`, []string{`SELECT 1 AS "a;b"`, "SELECT 2"}},
+		{"SELECT 1 -- trailing; comment\n; SELECT 2", []string{"SELECT 1 -- trailing; comment", "SELECT 2"}},
+		{"SELECT /* a; /* nested; */ b; */ 1; SELECT 2", []string{"SELECT /* a; /* nested; */ b; */ 1", "SELECT 2"}},
+		{
+			"CREATE FUNCTION f() RETURNS INT AS $$ BEGIN RETURN 1; END; $$ LANGUAGE plpgsql; SELECT f()",
+			[]string{"CREATE FUNCTION f() RETURNS INT AS $$ BEGIN RETURN 1; END; $$ LANGUAGE plpgsql", "SELECT f()"},
+		},
+		{
+			"DO $body$ BEGIN PERFORM 1; END $body$; SELECT 2",
+			[]string{"DO $body$ BEGIN PERFORM 1; END $body$", "SELECT 2"},
+		},
+		{"PREPARE p AS SELECT $1; EXECUTE p(1)", []string{"PREPARE p AS SELECT $1", "EXECUTE p(1)"}},
+		{
+			"CREATE FUNCTION f() RETURNS INT LANGUAGE SQL BEGIN ATOMIC SELECT 1; SELECT 2; END; SELECT f()",
+			[]string{"CREATE FUNCTION f() RETURNS INT LANGUAGE SQL BEGIN ATOMIC SELECT 1; SELECT 2; END", "SELECT f()"},
+		},
+		{
+			"CREATE PROCEDURE p() begin atomic\n\tSELECT CASE WHEN true THEN 1 END;\n\tSELECT 'end;';\nend; SELECT 3",
+			[]string{"CREATE PROCEDURE p() begin atomic\n\tSELECT CASE WHEN true THEN 1 END;\n\tSELECT 'end;';\nend", "SELECT 3"},
+		},
+		{"BEGIN; SELECT 1; END", []string{"BEGIN", "SELECT 1", "END"}},
+	}
+	for _, test := range tests {
+		actual := splitStatements(test.script)
+		if strings.Join(actual, "|") != strings.Join(test.expected, "|") || len(actual) != len(test.expected) {
+			t.Errorf("Splitting %q: expected %q, got %q", test.script, test.expected, actual)
+		}
+	}
+}
+
+func TestIsDML(t *testing.T) {
+	table := map[string]bool{
+		"SELECT 1":                             true,
+		"  insert into users (id) values (1)":  true,
+		"-- comment\nUPDATE users SET id = 2":  true,
+		"/* comment */ DELETE FROM users":      true,
+		"WITH x AS (SELECT 1) SELECT * FROM x": true,
+		"CREATE TABLE users (id INTEGER)":      false,
+		"ALTER TABLE users ADD COLUMN x INT":   false,
+		"-- only a comment":                    false,
+		"":                                     false,
+	}
+	for stmt, expected := range table {
+		if actual := isDML(stmt); actual != expected {
+			t.Errorf("Expected isDML(%q) to be %t, got %t", stmt, expected, actual)
+		}
+	}
+}
+
+func TestIsTransactionControl(t *testing.T) {
+	table := map[string]bool{
+		"BEGIN": true,
+		"begin transaction isolation level serializable": true,
+		"START TRANSACTION":                   true,
+		"-- done\nCOMMIT":                     true,
+		"END":                                 true,
+		"ROLLBACK":                            true,
+		"ABORT":                               true,
+		"ROLLBACK TO SAVEPOINT before_update": false,
+		"rollback /* partial */ to before_update": false,
+		"SAVEPOINT before_update":                 false,
+		"DO $$ BEGIN PERFORM 1; END $$":           false,
+		"CREATE TABLE commits (id INTEGER)":       false,
+		"":                                        false,
+	}
+	for stmt, expected := range table {
+		if actual := isTransactionControl(stmt); actual != expected {
+			t.Errorf("Expected isTransactionControl(%q) to be %t, got %t", stmt, expected, actual)
+		}
+	}
+}
+
+func TestFindTransactionControl(t *testing.T) {
+	if stmt := findTransactionControl("CREATE TABLE t (id INTEGER); COMMIT; SELECT 1"); stmt != "COMMIT" {
+		t.Errorf("Expected to find 'COMMIT'. Got '%s'", stmt)
+	}
+	if stmt := findTransactionControl("SELECT 'BEGIN; COMMIT'"); stmt != "" {
+		t.Errorf("Expected quoted statements to be ignored. Got '%s'", stmt)
+	}
+	atomic := "CREATE FUNCTION add(a INT, b INT) RETURNS INT LANGUAGE SQL BEGIN ATOMIC SELECT a + b; END"
+	if stmt := findTransactionControl(atomic); stmt != "" {
+		t.Errorf("Expected the END of a BEGIN ATOMIC body to be allowed. Got '%s'", stmt)
+	}
+}
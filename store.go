@@ -0,0 +1,103 @@
+package pgxschema
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgconn"
+)
+
+// Store records which migrations have been applied. By default, a Migrator
+// records them in its tracking table in the database being migrated, but a
+// different Store can be provided via WithStore (e.g. to keep the records in
+// another system in hybrid setups).
+//
+// Each method receives the Queryer the Migrator is using at the time, which
+// for RecordApplied and RemoveApplied is the migration transaction. A Store
+// which keeps its records elsewhere may ignore it, but then its records
+// aren't rolled back along with a failed Apply.
+type Store interface {
+	// AppliedIDs returns the IDs of the migrations which have been applied
+	// (and not since removed)
+	AppliedIDs(ctx context.Context, db Queryer) (map[string]struct{}, error)
+
+	// RecordApplied records that a migration has been applied
+	RecordApplied(ctx context.Context, db Queryer, record AppliedMigration) error
+
+	// RemoveApplied records that a migration is no longer applied, so that
+	// Apply will run it again
+	RemoveApplied(ctx context.Context, db Queryer, id string) error
+}
+
+// trackingTableStore is the default Store, which keeps the records in the
+// Migrator's tracking table
+type trackingTableStore struct {
+	m *Migrator
+}
+
+// AppliedIDs reads the distinct IDs from the tracking table, leaving out
+// those marked as rolled back
+func (s trackingTableStore) AppliedIDs(ctx context.Context, db Queryer) (map[string]struct{}, error) {
+	return s.migrator(ctx).trackedIDs(db)
+}
+
+// RecordApplied inserts a row into the tracking table
+func (s trackingTableStore) RecordApplied(ctx context.Context, db Queryer, record AppliedMigration) error {
+	return s.migrator(ctx).insertRecord(db, record)
+}
+
+// RemoveApplied marks the migration's rows in the tracking table as rolled
+// back. They are kept, so that the history of the migration is preserved.
+// The single version table only records the latest version, so migrations
+// can't be removed from it individually.
+func (s trackingTableStore) RemoveApplied(ctx context.Context, db Queryer, id string) error {
+	m := s.migrator(ctx)
+	if m.singleVersion {
+		return fmt.Errorf("migration '%s' can't be removed in single version mode", id)
+	}
+	_, err := db.Exec(ctx, fmt.Sprintf("UPDATE %s SET rolled_back_at = now() WHERE id = $1 AND rolled_back_at IS NULL", m.QuotedTableName()), id)
+	return err
+}
+
+// migrator returns a copy of the store's Migrator which uses ctx for its
+// queries
+func (s trackingTableStore) migrator(ctx context.Context) *Migrator {
+	mc := *s.m
+	mc.ctx = ctx
+	return &mc
+}
+
+// trackingStore returns the Store provided via WithStore, or the default one
+// which uses the tracking table
+func (m *Migrator) trackingStore() Store {
+	if m.store != nil {
+		return m.store
+	}
+	return trackingTableStore{m: m}
+}
+
+// RemoveApplied records, in the Migrator's Store, that the migration with
+// the provided ID is no longer applied, so that the next Apply runs it again.
+// With the default Store, its rows in the tracking table are marked as rolled
+// back rather than deleted.
+func (m *Migrator) RemoveApplied(db Queryer, id string) error {
+	if db == nil {
+		return ErrNilDB
+	}
+	if m.readOnly {
+		return ErrReadOnlyMigrator
+	}
+	if m.store == nil {
+		err := m.resolveQuoting(db)
+		if err != nil {
+			return err
+		}
+	}
+	err := m.trackingStore().RemoveApplied(m.ctx, db, id)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == undefinedTable {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,155 @@
+package pgxschema
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/pashagolub/pgxmock"
+)
+
+// memoryStore is a Store which keeps its records in memory
+type memoryStore struct {
+	records map[string]AppliedMigration
+}
+
+func (s *memoryStore) AppliedIDs(ctx context.Context, db Queryer) (map[string]struct{}, error) {
+	ids := make(map[string]struct{}, len(s.records))
+	for id := range s.records {
+		ids[id] = struct{}{}
+	}
+	return ids, nil
+}
+
+func (s *memoryStore) RecordApplied(ctx context.Context, db Queryer, record AppliedMigration) error {
+	s.records[record.ID] = record
+	return nil
+}
+
+func (s *memoryStore) RemoveApplied(ctx context.Context, db Queryer, id string) error {
+	delete(s.records, id)
+	return nil
+}
+
+func TestRunWithStore(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^SELECT 2").WillReturnResult(pgconn.CommandTag{})
+
+	store := &memoryStore{records: map[string]AppliedMigration{
+		"0000-00-00 001 Select 1": {},
+	}}
+	migrator := NewMigrator(WithStore(store), WithBuildInfo("1.2.3", "abc123"))
+	count, err := migrator.run(mock, testMigrations(t, "useless-ansi"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("Expected only the migration missing from the Store to run. Ran %d", count)
+	}
+	record, exists := store.records["0000-00-00 002 Select 2"]
+	if !exists {
+		t.Fatal("Expected the migration to be recorded in the Store")
+	}
+	if record.Checksum != record.MD5() || record.ChecksumAlgorithm != ChecksumAlgorithmMD5 || record.BuildVersion != "1.2.3" || record.AppliedAt.IsZero() {
+		t.Errorf("Expected a complete record. Got %+v", record)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	err = migrator.RemoveApplied(mock, "0000-00-00 001 Select 1")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(store.records) != 1 {
+		t.Errorf("Expected the migration to be removed from the Store. Got %v", store.records)
+	}
+}
+
+func TestSquashAndTrackingInfoWithStore(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrator := NewMigrator(WithStore(&memoryStore{records: map[string]AppliedMigration{}}))
+	err = migrator.Squash(mock, &Migration{ID: "2021-01-01 000 Baseline"})
+	if !errors.Is(err, ErrUnsupportedWithStore) {
+		t.Errorf("Expected Squash to return %v, got %v", ErrUnsupportedWithStore, err)
+	}
+	_, _, err = migrator.TrackingInfo(BadQueryer{})
+	if !errors.Is(err, ErrUnsupportedWithStore) {
+		t.Errorf("Expected TrackingInfo to return %v, got %v", ErrUnsupportedWithStore, err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRemoveApplied(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^UPDATE \"schema_migrations\" SET rolled_back_at = now\\(\\) WHERE id = \\$1 AND rolled_back_at IS NULL$").
+		WithArgs("2021-01-01 001").
+		WillReturnResult(pgconn.CommandTag("UPDATE 1"))
+	mock.ExpectExec("^UPDATE").WillReturnError(&pgconn.PgError{Code: undefinedTable})
+
+	migrator := NewMigrator()
+	err = migrator.RemoveApplied(mock, "2021-01-01 001")
+	if err != nil {
+		t.Error(err)
+	}
+	err = migrator.RemoveApplied(mock, "2021-01-01 001")
+	if err != nil {
+		t.Errorf("Expected nothing to remove when the table is missing. Got %v", err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	err = migrator.RemoveApplied(nil, "2021-01-01 001")
+	if !errors.Is(err, ErrNilDB) {
+		t.Errorf("Expected %v, got %v", ErrNilDB, err)
+	}
+	err = migrator.RemoveApplied(BadQueryer{}, "2021-01-01 001")
+	expectErrorContains(t, err, "FAIL")
+	err = NewMigrator(WithSingleVersionMode()).RemoveApplied(BadQueryer{}, "2021-01-01 001")
+	expectErrorContains(t, err, "single version mode")
+}
+
+func TestRemoveAppliedThenApply(t *testing.T) {
+	withLatestDB(t, func(db *pgxpool.Pool) {
+		migrator := makeTestMigrator()
+		migrations := testMigrations(t, "useless-ansi")
+		err := migrator.Apply(db, migrations)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = migrator.RemoveApplied(db, "0000-00-00 002 Select 2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pending, err := migrator.PendingCount(db, migrations)
+		if err != nil {
+			t.Error(err)
+		}
+		if pending != 1 {
+			t.Errorf("Expected the removed migration to be pending. Got %d pending", pending)
+		}
+
+		changed, err := migrator.ApplyReportingChanges(db, migrations)
+		if err != nil {
+			t.Error(err)
+		}
+		if !changed {
+			t.Error("Expected the removed migration to be applied again")
+		}
+	})
+}